@@ -0,0 +1,113 @@
+package main
+
+import "fmt"
+import "net"
+import "os"
+import "strings"
+import "time"
+
+// The maximum number of live updates we hold back while waiting for the server to finish sending
+// the backfill. If we reach this limit we assume the server doesn't support HISTORY requests.
+const maxPendingUpdates = 10
+
+// A live update held back until the backfill has been displayed.
+type pendingUpdate struct {
+	source  net.Addr
+	message string
+}
+
+// If set to true, we've requested the vehicle's recent history and are waiting for the server's
+// HISTORY-END packet. Live updates which arrive in the meantime are held in pendingUpdates.
+var backfilling bool
+var pendingUpdates []pendingUpdate
+
+// The timestamp of the newest update we've displayed from the backfill. Live updates at or before
+// this time duplicate the backfill and are skipped.
+var backfillCutoff time.Time
+
+// This function returns a HISTORY request packet for the vehicle's newest count locations.
+func historyRequest(vin string, count int, requestFields string) string {
+	return fmt.Sprintf("HISTORY %s count=%d%s", vin, count, requestFields)
+}
+
+// This function handles a packet from the subscription feed. If we've requested a backfill, it
+// displays the backfilled updates first and then any live updates which arrived in the meantime.
+// If we've requested a snapshot, the server sends it before any live updates so its packets are
+// displayed as they arrive. Everything else is passed straight to handlePacket. It returns any
+// error from handlePacket.
+func handleFeedPacket(source net.Addr, message string) error {
+	// JSON updates are converted to text updates so the rest of the client only handles text.
+	if strings.HasPrefix(message, "{") {
+		update, err := decodeJSONUpdate(message)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid JSON update.\n  -->  %s\n", err.Error())
+			return nil
+		}
+		message = update
+	}
+
+	if strings.HasPrefix(message, "SNAPSHOT-END") {
+		elements, _ := splitFields(message)
+		if len(elements) == 2 {
+			fmt.Printf("Received a snapshot of %s vehicles. Switching to live updates.\n", elements[1])
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(message, "SNAPSHOT ") {
+		displayingStored = true
+		err := handlePacket(source, strings.TrimPrefix(message, "SNAPSHOT "))
+		displayingStored = false
+		return err
+	}
+
+	if strings.HasPrefix(message, "HISTORY-END") {
+		elements, _ := splitFields(message)
+		if len(elements) == 2 {
+			fmt.Printf("Backfilled %s updates. Switching to live updates.\n", elements[1])
+		}
+		return flushPendingUpdates()
+	}
+
+	if strings.HasPrefix(message, "HISTORY ") {
+		update := strings.TrimPrefix(message, "HISTORY ")
+		displayingStored = true
+		err := handlePacket(source, update)
+		displayingStored = false
+		if err != nil {
+			return err
+		}
+
+		elements, _ := splitFields(update)
+		if timestamp, err := time.Parse(time.RFC3339Nano, elements[0]); err == nil {
+			backfillCutoff = timestamp
+		}
+		return nil
+	}
+
+	// ERROR and SHUTDOWN packets are never held back.
+	if backfilling && !strings.HasPrefix(message, "ERROR") && message != "SHUTDOWN" {
+		pendingUpdates = append(pendingUpdates, pendingUpdate{source, message})
+		if len(pendingUpdates) >= maxPendingUpdates {
+			fmt.Fprintf(os.Stderr, "Warning: no history received from the server, skipping the backfill.\n")
+			return flushPendingUpdates()
+		}
+		return nil
+	}
+
+	return handlePacket(source, message)
+}
+
+// This function ends the backfill and displays any live updates we've held back. It stops at the
+// first error from handlePacket.
+func flushPendingUpdates() error {
+	backfilling = false
+	pending := pendingUpdates
+	pendingUpdates = nil
+	for _, update := range pending {
+		if err := handlePacket(update.source, update.message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
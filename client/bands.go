@@ -0,0 +1,37 @@
+package main
+
+import "fmt"
+import "os"
+import "strconv"
+import "time"
+
+// This function displays a band update packet. A band update packet has the format: [BAND
+// <timestamp> <vin> <from> <to> <speed>], optionally followed by [<key>=<value>] fields. The server
+// only sends these to subscribers which asked for band updates with the --bands flag.
+func handleBandPacket(message string) {
+	elements, _ := splitFields(message)
+	if len(elements) != 6 {
+		fmt.Fprintf(os.Stderr, "Error: invalid band packet.\n")
+		return
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, elements[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid timestamp.\n")
+		return
+	}
+
+	speed, err := strconv.ParseFloat(elements[5], 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid speed.\n")
+		return
+	}
+
+	if output != nil {
+		output.write(message)
+	}
+
+	timeString := formatTimestamp(timestamp)
+
+	fmt.Printf("[%s]  %s -> %s  %5.2f m/s\n", timeString, elements[3], elements[4], speed)
+}
@@ -0,0 +1,78 @@
+package main
+
+import "bufio"
+import "fmt"
+import "net"
+import "os"
+import "strconv"
+import "sync"
+import "time"
+
+// A capture appends every datagram the client receives to a file, one per line, in the format:
+// [<arrival-time> <source> <payload>]. The arrival time is an RFC3339 timestamp with nanoseconds
+// and the payload is a double-quoted Go string literal, so batches containing newlines and binary
+// compressed packets are captured byte for byte and can be decoded with strconv.Unquote. Packets
+// can be captured from the listening loop and the TLS reader, so writes are serialized by the
+// mutex.
+type capture struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	err    error
+}
+
+// If not nil, we capture every datagram we receive. Set by --capture.
+var capturing *capture
+
+// This function opens a capture appending to the file at path. The file is created if it doesn't
+// exist.
+func openCapture(path string) (*capture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &capture{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// This function appends a received datagram to the capture, before any decompression or
+// parsing. We only report the first write error so a full disk doesn't flood the terminal.
+func (c *capture) record(arrival time.Time, source net.Addr, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	_, err := fmt.Fprintf(
+		c.writer,
+		"%s %s %s\n",
+		arrival.UTC().Format(time.RFC3339Nano),
+		source,
+		strconv.Quote(string(payload)))
+	if err != nil {
+		c.err = err
+		fmt.Fprintf(os.Stderr, "Error: failed to capture packet. Capture stopped.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function flushes any buffered datagrams to the file and closes it. Datagrams captured after
+// the capture is closed are discarded.
+func (c *capture) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// A write error has already been reported.
+	var err error
+	if c.err == nil {
+		err = c.writer.Flush()
+	}
+
+	closeErr := c.file.Close()
+	c.err = os.ErrClosed
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
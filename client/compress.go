@@ -0,0 +1,32 @@
+package main
+
+import "bytes"
+import "compress/gzip"
+import "errors"
+import "io"
+
+// This function returns true if the packet is gzip-compressed, i.e. if it begins with the gzip
+// magic number. A text packet can never begin with these bytes.
+func isCompressed(payload []byte) bool {
+	return len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b
+}
+
+// This function decompresses a gzip-compressed packet. The server compresses packets of at most
+// [maxPacketSize] bytes so we refuse to decompress anything larger.
+func decompressPacket(payload []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxPacketSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPacketSize {
+		return nil, errors.New("decompressed packet is too large")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import "fmt"
+import "math"
+import "sort"
+import "strconv"
+import "time"
+
+// If the --delta flag is set, the server sends a full update packet -- a keyframe -- followed by
+// delta packets with the format:
+//
+//	DELTA <vin> <milliseconds> <latitude-delta> <longitude-delta> [<speed>] [<key>=<value>]
+//
+// The deltas are relative to the previous update, with coordinates in millionths of a degree. We
+// record the position from each full update we display in deltaBase and use it to reconstruct the
+// next update's absolute position.
+var deltaBase struct {
+	valid     bool
+	vin       string
+	timestamp time.Time
+	latitude  int64
+	longitude int64
+}
+
+// This function records the position from a full update as the base for the next delta.
+func recordDeltaBase(vin string, timestamp time.Time, latitude, longitude float64) {
+	deltaBase.valid = true
+	deltaBase.vin = vin
+	deltaBase.timestamp = timestamp
+	deltaBase.latitude = int64(math.Round(latitude * 1e6))
+	deltaBase.longitude = int64(math.Round(longitude * 1e6))
+}
+
+// This function reconstructs a full update packet from a delta packet.
+func applyDelta(message string) (string, error) {
+	elements, options := splitFields(message)
+	if len(elements) != 5 && len(elements) != 6 {
+		return "", fmt.Errorf("invalid delta packet")
+	}
+
+	vin := elements[1]
+	if !deltaBase.valid || deltaBase.vin != vin {
+		return "", fmt.Errorf("delta packet for %s without a keyframe", vin)
+	}
+
+	milliseconds, err := strconv.ParseInt(elements[2], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid time delta '%s'", elements[2])
+	}
+
+	latitudeDelta, err := strconv.ParseInt(elements[3], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid latitude delta '%s'", elements[3])
+	}
+
+	longitudeDelta, err := strconv.ParseInt(elements[4], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid longitude delta '%s'", elements[4])
+	}
+
+	timestamp := deltaBase.timestamp.Add(time.Duration(milliseconds) * time.Millisecond)
+	latitude := float64(deltaBase.latitude+latitudeDelta) / 1e6
+	longitude := float64(deltaBase.longitude+longitudeDelta) / 1e6
+
+	update := fmt.Sprintf("%s %s %.6f %.6f", timestamp.Format(time.RFC3339Nano), vin, latitude, longitude)
+	if len(elements) == 6 {
+		update += " " + elements[5]
+	}
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		update += " " + key + "=" + options[key]
+	}
+
+	return update, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import "fmt"
+import "os"
+import "sort"
+import "sync"
+import "time"
+
+// How often we check for held updates which are due to be displayed. This limits the precision of
+// the --display-interval.
+const displayTick = 100 * time.Millisecond
+
+// This type limits how often each vehicle's updates are printed. An update is printed at once if
+// the vehicle's last printed update is at least [interval] old. Otherwise it's held, replacing any
+// update already held for the vehicle, until the interval has elapsed. This keeps a high-frequency
+// feed readable while always showing each vehicle's latest update.
+type displayThrottle struct {
+	mutex     sync.Mutex
+	interval  time.Duration
+	lastShown map[string]time.Time
+	held      map[string]string
+}
+
+// If not nil, we print at most one update per vehicle per interval. Set by --display-interval.
+var throttle *displayThrottle
+
+// If not nil, we append every update line to this file, including updates held back and replaced
+// by --display-interval. Set by --log-file.
+var logFile *os.File
+
+// This function returns a new throttle and starts the goroutine which displays held updates once
+// they're due.
+func newDisplayThrottle(interval time.Duration) *displayThrottle {
+	t := &displayThrottle{
+		interval:  interval,
+		lastShown: make(map[string]time.Time),
+		held:      make(map[string]string),
+	}
+
+	go func() {
+		ticker := time.NewTicker(displayTick)
+		for now := range ticker.C {
+			t.flush(now, false)
+		}
+	}()
+
+	return t
+}
+
+// This function prints the vehicle's update line if it's due, otherwise holds it.
+func (t *displayThrottle) add(vin string, line string, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, waiting := t.held[vin]
+	if !waiting && now.Sub(t.lastShown[vin]) >= t.interval {
+		fmt.Println(line)
+		t.lastShown[vin] = now
+		return
+	}
+
+	t.held[vin] = line
+}
+
+// This function prints each held update whose vehicle's interval has elapsed, or every held update
+// if force is true. Updates are printed in VIN order.
+func (t *displayThrottle) flush(now time.Time, force bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var due []string
+	for vin := range t.held {
+		if force || now.Sub(t.lastShown[vin]) >= t.interval {
+			due = append(due, vin)
+		}
+	}
+	sort.Strings(due)
+
+	for _, vin := range due {
+		fmt.Println(t.held[vin])
+		t.lastShown[vin] = now
+		delete(t.held, vin)
+	}
+}
+
+// This function displays a vehicle's update line, subject to --display-interval, and appends it
+// to the --log-file. Stored updates from a backfill or snapshot are always printed as they'd
+// otherwise be collapsed into a single line.
+func displayLine(vin string, line string) {
+	logLine(line)
+
+	if throttle == nil || displayingStored {
+		fmt.Println(line)
+		return
+	}
+
+	throttle.add(vin, line, time.Now())
+}
+
+// This function appends a line to the --log-file, if it's set.
+func logLine(line string) {
+	if logFile == nil {
+		return
+	}
+
+	_, err := fmt.Fprintln(logFile, line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write to log file.\n  -->  %s\n", err.Error())
+	}
+}
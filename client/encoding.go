@@ -0,0 +1,135 @@
+package main
+
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "math"
+import "strconv"
+import "strings"
+import "time"
+
+// The first byte of a binary update packet. A text packet never begins with this byte.
+const binaryUpdateMarker = 0x01
+
+// The JSON representation of an update, as sent to subscribers with [format=json]. A speed of -1
+// means the speed isn't available and a missing speed means the server is running with --no-speed.
+type updateJSON struct {
+	Timestamp string   `json:"timestamp"`
+	VIN       string   `json:"vin"`
+	Fleet     string   `json:"fleet"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Speed     *float64 `json:"speed"`
+	NoFix     bool     `json:"no_fix"`
+	Odometer  *float64 `json:"odometer"`
+	Ignition  string   `json:"ignition"`
+	Battery   *float64 `json:"battery"`
+	Status    string   `json:"status"`
+	Violation *bool    `json:"violation"`
+	Origin    string   `json:"origin"`
+}
+
+// This function returns true if the packet is a binary update, i.e. if it begins with the binary
+// marker byte.
+func isBinaryUpdate(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == binaryUpdateMarker
+}
+
+// This function undoes any compression or binary encoding of a received packet, returning its
+// payload as newline-delimited text messages. JSON updates are decoded message by message.
+func decodePayload(payload []byte) ([]byte, error) {
+	if isCompressed(payload) {
+		return decompressPacket(payload)
+	}
+
+	if isBinaryUpdate(payload) {
+		update, err := decodeBinaryUpdate(payload)
+		return []byte(update), err
+	}
+
+	return payload, nil
+}
+
+// This function converts a binary update packet into a text update. See the server's
+// encodeBinary() function for the layout.
+func decodeBinaryUpdate(payload []byte) (string, error) {
+	if len(payload) < 35 || len(payload) < 35+int(payload[34]) {
+		return "", errors.New("binary update is too short")
+	}
+
+	nanoseconds := int64(binary.BigEndian.Uint64(payload[1:]))
+	flags := payload[9]
+	latitude := math.Float64frombits(binary.BigEndian.Uint64(payload[10:]))
+	longitude := math.Float64frombits(binary.BigEndian.Uint64(payload[18:]))
+	speed := math.Float64frombits(binary.BigEndian.Uint64(payload[26:]))
+	vinEnd := 35 + int(payload[34])
+
+	fields := []string{time.Unix(0, nanoseconds).UTC().Format(time.RFC3339Nano), string(payload[35:vinEnd])}
+	if flags&1 != 0 {
+		fields = append(fields, noFix, noFix)
+	} else {
+		fields = append(fields, formatFloat(latitude), formatFloat(longitude))
+	}
+	if flags&2 != 0 {
+		fields = append(fields, formatFloat(speed))
+	}
+	if vinEnd < len(payload) {
+		fields = append(fields, string(payload[vinEnd:]))
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// This function converts a JSON update into a text update.
+func decodeJSONUpdate(message string) (string, error) {
+	var update updateJSON
+	err := json.Unmarshal([]byte(message), &update)
+	if err != nil {
+		return "", err
+	}
+
+	if update.Timestamp == "" || update.VIN == "" {
+		return "", errors.New("JSON update is missing its timestamp or VIN")
+	}
+
+	fields := []string{update.Timestamp, update.VIN}
+	if update.NoFix {
+		fields = append(fields, noFix, noFix)
+	} else if update.Latitude != nil && update.Longitude != nil {
+		fields = append(fields, formatFloat(*update.Latitude), formatFloat(*update.Longitude))
+	} else {
+		return "", errors.New("JSON update is missing its coordinates")
+	}
+
+	if update.Speed != nil {
+		fields = append(fields, formatFloat(*update.Speed))
+	}
+	if update.Fleet != "" {
+		fields = append(fields, "fleet="+update.Fleet)
+	}
+	if update.Odometer != nil {
+		fields = append(fields, "odometer="+formatFloat(*update.Odometer))
+	}
+	if update.Ignition != "" {
+		fields = append(fields, "ignition="+update.Ignition)
+	}
+	if update.Battery != nil {
+		fields = append(fields, "battery="+formatFloat(*update.Battery))
+	}
+	if update.Status != "" {
+		fields = append(fields, "status="+update.Status)
+	}
+	if update.Violation != nil {
+		fields = append(fields, "violation="+strconv.FormatBool(*update.Violation))
+	}
+	if update.Origin != "" {
+		fields = append(fields, "origin="+update.Origin)
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// This function formats a number with as few digits as necessary to represent it exactly.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,112 @@
+package main
+
+import "fmt"
+import "math"
+import "time"
+
+// If the --destination option is set, we display the vehicle's estimated time of arrival at this
+// point with each update.
+var destination *destinationPoint
+
+type destinationPoint struct {
+	latitude  float64
+	longitude float64
+}
+
+// The function used to measure the distance to the destination, either [getDistance] for the
+// great-circle distance or [rhumbDistance] for the rhumb-line distance. Set by --distance-method.
+var measureDistance = getDistance
+
+// A vehicle within this many meters of the destination has arrived.
+const arrivalRadius = 10.0
+
+// A vehicle moving slower than this in m/s is treated as stationary -- the ETA would be
+// meaninglessly large.
+const minETASpeed = 0.5
+
+// This function parses a destination with the format: [<lat>,<long>].
+func parseDestination(arg string) (*destinationPoint, error) {
+	var latitude, longitude float64
+	_, err := fmt.Sscanf(arg, "%f,%f", &latitude, &longitude)
+	if err != nil {
+		return nil, err
+	}
+
+	if !(latitude >= -90 && latitude <= 90) || !(longitude >= -180 && longitude <= 180) {
+		return nil, fmt.Errorf("coordinates out of range")
+	}
+
+	return &destinationPoint{latitude: latitude, longitude: longitude}, nil
+}
+
+// This function returns the vehicle's ETA at the destination for display, e.g. "ETA 4m12s
+// (1.250 km)". The ETA assumes the vehicle travels in a straight line at its current speed. A speed
+// of -1.0 means the speed is not available.
+func formatETA(latitude, longitude, speed float64) string {
+	distance := measureDistance(latitude, longitude, destination.latitude, destination.longitude)
+	if distance <= arrivalRadius {
+		return "arrived"
+	}
+
+	if speed < minETASpeed {
+		return fmt.Sprintf("ETA unknown (%.3f km)", distance/1000)
+	}
+
+	eta := time.Duration(distance / speed * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("ETA %s (%.3f km)", eta, distance/1000)
+}
+
+// This function returns the great-circle distance in meters between two points on the earth's
+// surface calculated using the haversine formula, exactly as on the server. Latitude and longitude
+// are assumed to be specified in degrees.
+// Ref: http://www.movable-type.co.uk/scripts/latlong.html
+func getDistance(lat1, long1, lat2, long2 float64) float64 {
+	// Average radius of the earth in meters.
+	const earthRadius = 6371009
+
+	phi1 := lat1 * math.Pi / 180.0
+	phi2 := lat2 * math.Pi / 180.0
+	deltaPhi := phi2 - phi1
+	deltaLambda := (long2 - long1) * math.Pi / 180.0
+
+	a := math.Pow(math.Sin(deltaPhi/2), 2) + math.Cos(phi1)*math.Cos(phi2)*math.Pow(math.Sin(deltaLambda/2), 2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+
+	return earthRadius * c
+}
+
+// This function returns the rhumb-line distance in meters between two points on the earth's
+// surface, i.e. the length of the path between them which keeps a constant compass bearing. This
+// is never shorter than the great-circle distance; the difference is negligible over short
+// distances but grows with distance and latitude. Latitude and longitude are assumed to be
+// specified in degrees.
+// Ref: http://www.movable-type.co.uk/scripts/latlong.html
+func rhumbDistance(lat1, long1, lat2, long2 float64) float64 {
+	// Average radius of the earth in meters.
+	const earthRadius = 6371009
+
+	phi1 := lat1 * math.Pi / 180.0
+	phi2 := lat2 * math.Pi / 180.0
+	deltaPhi := phi2 - phi1
+	deltaLambda := (long2 - long1) * math.Pi / 180.0
+
+	// The stretched latitude difference on a Mercator projection.
+	deltaPsi := math.Log(math.Tan(math.Pi/4+phi2/2) / math.Tan(math.Pi/4+phi1/2))
+
+	// On an east-west line deltaPsi is zero so we use the limit of deltaPhi/deltaPsi instead.
+	q := math.Cos(phi1)
+	if math.Abs(deltaPsi) > 1e-12 {
+		q = deltaPhi / deltaPsi
+	}
+
+	// Take the shorter way around if the line crosses the antimeridian.
+	if math.Abs(deltaLambda) > math.Pi {
+		if deltaLambda > 0 {
+			deltaLambda -= 2 * math.Pi
+		} else {
+			deltaLambda += 2 * math.Pi
+		}
+	}
+
+	return earthRadius * math.Sqrt(deltaPhi*deltaPhi+q*q*deltaLambda*deltaLambda)
+}
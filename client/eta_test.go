@@ -0,0 +1,63 @@
+package main
+
+import "math"
+import "testing"
+
+// One degree of arc on a sphere with the earth's average radius, in meters.
+const metersPerDegree = 6371009 * math.Pi / 180
+
+// This function fails the test if the distance isn't within the tolerance of the expected value.
+func checkDistance(t *testing.T, name string, distance float64, expected float64, tolerance float64) {
+	t.Helper()
+	if math.Abs(distance-expected) > tolerance {
+		t.Errorf("%s: expected %.1fm, found %.1fm", name, expected, distance)
+	}
+}
+
+func TestDistanceDublinToNewYork(t *testing.T) {
+	greatCircle := getDistance(53.3498, -6.2603, 40.7128, -74.0060)
+	rhumb := rhumbDistance(53.3498, -6.2603, 40.7128, -74.0060)
+
+	checkDistance(t, "great-circle", greatCircle, 5115e3, 10e3)
+	checkDistance(t, "rhumb", rhumb, 5290e3, 10e3)
+	if rhumb <= greatCircle {
+		t.Errorf("expected the rhumb line to be longer than the great circle")
+	}
+}
+
+func TestRhumbDistanceMeridian(t *testing.T) {
+	// Along a meridian the rhumb line is the great circle.
+	checkDistance(t, "northbound", rhumbDistance(10, 20, 30, 20), 20*metersPerDegree, 1e-6)
+	checkDistance(t, "southbound", rhumbDistance(30, 20, 10, 20), 20*metersPerDegree, 1e-6)
+	checkDistance(t, "great-circle", getDistance(10, 20, 30, 20), 20*metersPerDegree, 1e-3)
+}
+
+func TestRhumbDistanceEastWest(t *testing.T) {
+	// Along a parallel deltaPsi is zero so the distance comes from the cos(latitude) limit.
+	checkDistance(t, "equator", rhumbDistance(0, 10, 0, 12), 2*metersPerDegree, 1e-6)
+	checkDistance(t, "60N", rhumbDistance(60, 10, 60, 12), 2*metersPerDegree*math.Cos(60*math.Pi/180), 1e-6)
+	checkDistance(t, "60S westbound", rhumbDistance(-60, 12, -60, 10), 2*metersPerDegree*math.Cos(60*math.Pi/180), 1e-6)
+
+	// Away from the equator the great circle between two points on a parallel is shorter.
+	if getDistance(60, 10, 60, 12) >= rhumbDistance(60, 10, 60, 12) {
+		t.Errorf("expected the great circle to be shorter than the rhumb line along 60N")
+	}
+}
+
+func TestDistanceAcrossAntimeridian(t *testing.T) {
+	// At the equator the rhumb line and the great circle are the same line.
+	checkDistance(t, "eastbound (rhumb)", rhumbDistance(0, 179.5, 0, -179.5), metersPerDegree, 1e-6)
+	checkDistance(t, "westbound (rhumb)", rhumbDistance(0, -179.5, 0, 179.5), metersPerDegree, 1e-6)
+	checkDistance(t, "eastbound (great-circle)", getDistance(0, 179.5, 0, -179.5), metersPerDegree, 1e-3)
+	checkDistance(t, "westbound (great-circle)", getDistance(0, -179.5, 0, 179.5), metersPerDegree, 1e-3)
+
+	// Along a parallel away from the equator the east-west branch applies too.
+	expected := metersPerDegree * math.Cos(60*math.Pi/180)
+	checkDistance(t, "eastbound at 60N (rhumb)", rhumbDistance(60, 179.5, 60, -179.5), expected, 1e-6)
+
+	// A diagonal crossing takes the short way round.
+	diagonal := rhumbDistance(10, 179, 11, -179)
+	if diagonal > 3*metersPerDegree {
+		t.Errorf("expected the rhumb line to take the short way round, found %.1fm", diagonal)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+// In follow mode the client always tracks the fastest vehicle in the fleet. It periodically
+// requests a SNAPSHOT of the fleet from the server, finds the fastest vehicle, and if this has
+// changed, unsubscribes from the old vehicle and subscribes to the new one. The requestFields
+// string contains any optional fields to append to each request packet.
+func runFollowClient(localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, requestFields string, interval time.Duration) {
+	// We listen before printing the header as the client falls back to the next free port if its
+	// port is already in use.
+	listener, err := listenClientUDP(localAddr)
+	if err != nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"Error: unable to initialize listener on address '%s'.\n  -->  %s\n",
+			localAddr,
+			err.Error())
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	fmt.Println("-------------------------")
+	fmt.Println("Running Subscriber Client")
+	fmt.Println("-------------------------")
+	fmt.Printf("Client: %s\n", localAddr)
+	fmt.Printf("Server: %s\n", remoteAddr)
+	fmt.Printf("VIN:    fastest, re-evaluated every %s\n", interval)
+	fmt.Printf("Exit:   Ctrl-C\n")
+	fmt.Println("-------------------------")
+
+	// Request a new snapshot of the fleet at each interval. The replies are handled in the
+	// listening loop below.
+	go func() {
+		for {
+			_, err := listener.WriteTo([]byte("SNAPSHOT"+requestFields), remoteAddr)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to send snapshot request.\n  -->  %s\n", err.Error())
+			}
+			time.Sleep(interval)
+		}
+	}()
+
+	follow(listener, remoteAddr, requestFields)
+}
+
+// This is the listening loop for follow mode. It handles both snapshot replies and update packets.
+// We only display updates for the vehicle we're currently following as a few updates for the
+// previous vehicle may still be in flight after we switch.
+func follow(conn packetConn, remoteAddr net.Addr, requestFields string) {
+	// The VIN of the vehicle we're currently following.
+	current := ""
+
+	// The fastest vehicle in the snapshot we're currently receiving.
+	fastestVIN := ""
+	fastestSpeed := -1.0
+
+	buffer := make([]byte, maxPacketSize)
+	failures := 0
+
+	for {
+		n, source, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil && !isRecoverableReadError(err) {
+			exitClient(fmt.Errorf("%w: %v", errListenerFailed, err))
+		}
+		if err != nil {
+			failures++
+			fmt.Fprintf(os.Stderr, "Error: invalid read.\n  -->  %s\n", err.Error())
+			time.Sleep(readBackoff(failures))
+			continue
+		}
+		failures = 0
+
+		if capturing != nil {
+			capturing.record(time.Now(), source, buffer[:n])
+		}
+
+		payload, err := decodePayload(buffer[:n])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid packet.\n  -->  %s\n", err.Error())
+			continue
+		}
+
+		for _, message := range splitMessages(payload) {
+			if strings.HasPrefix(message, "{") {
+				message, err = decodeJSONUpdate(message)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid JSON update.\n  -->  %s\n", err.Error())
+					continue
+				}
+			}
+
+			if strings.HasPrefix(message, "SNAPSHOT-END") {
+				if fastestVIN != "" && fastestVIN != current {
+					switchSubscription(conn, remoteAddr, current, fastestVIN, fastestSpeed, requestFields)
+					current = fastestVIN
+				}
+				fastestVIN = ""
+				fastestSpeed = -1.0
+				continue
+			}
+
+			// A snapshot packet has the format: [SNAPSHOT <timestamp> <vin> <latitude> <longitude>
+			// <speed>], optionally followed by [<key>=<value>] fields. The speed field is omitted
+			// if the server is running with --no-speed, in which case we can't follow anything.
+			if strings.HasPrefix(message, "SNAPSHOT") {
+				elements, _ := splitFields(message)
+				if len(elements) == 5 {
+					fmt.Fprintf(os.Stderr, "Error: the server isn't reporting speeds.\n")
+					os.Exit(1)
+				}
+				if len(elements) != 6 {
+					fmt.Fprintf(os.Stderr, "Error: invalid snapshot packet.\n")
+					continue
+				}
+
+				speed, err := strconv.ParseFloat(elements[5], 64)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid speed.\n")
+					continue
+				}
+
+				if speed > fastestSpeed {
+					fastestVIN = elements[2]
+					fastestSpeed = speed
+				}
+				continue
+			}
+
+			elements, _ := splitFields(message)
+			if len(elements) > 1 && elements[1] != current {
+				continue
+			}
+
+			if err := handlePacket(source, message); err != nil {
+				exitClient(err)
+			}
+		}
+	}
+}
+
+// This function unsubscribes from the old vehicle (if any) and subscribes to the new one.
+func switchSubscription(conn packetConn, remoteAddr net.Addr, oldVIN, newVIN string, speed float64, requestFields string) {
+	if oldVIN != "" {
+		_, err := conn.WriteTo([]byte("UNSUBSCRIBE "+oldVIN+requestFields), remoteAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to send unsubscribe packet.\n  -->  %s\n", err.Error())
+		}
+	}
+
+	_, err := conn.WriteTo([]byte("SUBSCRIBE "+newVIN+requestFields), remoteAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to send subscription packet.\n  -->  %s\n", err.Error())
+		return
+	}
+
+	fmt.Printf("Following %s (%.2f m/s)\n", newVIN, speed)
+}
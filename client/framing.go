@@ -0,0 +1,23 @@
+package main
+
+import "strings"
+
+// The largest possible UDP payload. We read packets into a buffer of this size so a packet can never
+// be silently truncated by a short read.
+const maxPacketSize = 65507
+
+// Messages are framed by newlines. A single packet can carry several newline-delimited messages,
+// e.g. a batch of updates, and the final newline is optional so a packet containing a single
+// message doesn't need one. On a TLS connection, which is a stream rather than a sequence of
+// packets, the newlines are required. This function splits a packet's payload into its messages,
+// ignoring empty lines and any carriage returns.
+func splitMessages(payload []byte) []string {
+	var messages []string
+	for _, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			messages = append(messages, line)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+import "sync"
+import "time"
+
+// This type records the running minimum, average, and maximum latency of the updates we receive,
+// measured from the vehicle's timestamp to the time the update arrives. The signal handler reads
+// the stats while the listening loop updates them so access is serialized by the mutex.
+type latencyStats struct {
+	mutex sync.Mutex
+	count int
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+}
+
+// If not nil, we measure the latency of each live update. Set by the --latency flag.
+var latency *latencyStats
+
+// If set to true, we're displaying stored updates from a backfill or snapshot rather than live
+// updates, so their timestamps say nothing about the pipeline's latency.
+var displayingStored bool
+
+// This function adds a latency measurement to the stats.
+func (s *latencyStats) record(observed time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.count == 0 || observed < s.min {
+		s.min = observed
+	}
+	if s.count == 0 || observed > s.max {
+		s.max = observed
+	}
+	s.count++
+	s.total += observed
+}
+
+// This function returns the stats in the format [min <ms> avg <ms> max <ms>].
+func (s *latencyStats) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.count == 0 {
+		return "no updates"
+	}
+
+	return fmt.Sprintf(
+		"min %s  avg %s  max %s",
+		formatLatency(s.min),
+		formatLatency(s.total/time.Duration(s.count)),
+		formatLatency(s.max))
+}
+
+// This function formats a latency in milliseconds, e.g. [12.3ms]. A negative latency means the
+// vehicle's clock is ahead of the client's.
+func formatLatency(observed time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(observed)/float64(time.Millisecond))
+}
+
+// This function prints the latency stats, if --latency is set.
+func printLatencySummary() {
+	if latency != nil {
+		fmt.Printf("Latency: %s.\n", latency)
+	}
+}
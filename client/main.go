@@ -1,12 +1,32 @@
 package main
 
+import "context"
+import "crypto/tls"
+import "errors"
 import "fmt"
+import "io"
 import "net"
 import "os"
+import "os/signal"
 import "flag"
 import "time"
 import "strings"
 import "strconv"
+import "sync/atomic"
+import "syscall"
+
+// A vehicle with no GPS fix reports this sentinel in place of its latitude and longitude.
+const noFix = "nofix"
+
+// How long the client waits for a reply to a one-shot query before giving up.
+const queryTimeout = 5 * time.Second
+
+// The handlePacket function returns this error when the server tells us it's shutting down. This
+// isn't a failure so runClient returns nil.
+var errServerShutdown = errors.New("the server is shutting down")
+
+// The handlePacket function returns this error after displaying an alert if --exit-on-alert is set.
+var errAlert = errors.New("exiting on alert")
 
 var helptext = `Usage: client
 
@@ -15,29 +35,203 @@ var helptext = `Usage: client
   hitting Ctrl-C.
 
 Options:
+  --backfill <int>          Display the vehicle's newest n stored locations
+                            before switching to live updates.
+                            Default: 0.
+  --batch <duration>        Ask the server to batch updates and send them
+                            together at this interval, e.g. "5s".
+                            Default: no batching.
+  --capture <file>          Append every packet received from a subscription
+                            to this file with its arrival time and source
+                            address, e.g. for debugging packet formats.
   --client-host <string>    IP address that the client will listen on.
                             Default: "localhost".
   --client-port <int>       Port number that the client will listen on.
                             Default: 8001.
+  --destination <string>    Display the vehicle's ETA at this destination in
+                            the format 'lat,long', assuming it travels in a
+                            straight line at its current speed.
+                            Default: no ETA.
+  --distance-method <string>
+                            How to measure the distance to the --destination:
+                            'great-circle' for the shortest distance, or
+                            'rhumb' for the distance along a line of constant
+                            bearing.
+                            Default: "great-circle".
+  --display-interval <duration>
+                            Print at most one update per vehicle in each
+                            interval, showing the vehicle's latest update.
+                            Alerts are always printed.
+                            Default: print every update.
+  --fleet <string>          Fleet namespace of the target vehicle.
+                            Default: the server's default namespace.
+  --format <string>         Format of update packets from the server: 'text',
+                            'json', or 'binary'. Binary updates can't be
+                            batched or sent over TLS.
+                            Default: "text".
+  --follow-interval <duration>
+                            How often to re-evaluate the fastest vehicle in
+                            --follow mode.
+                            Default: "10s".
+  --listen-retries <int>    Number of times in a row to re-create the listening
+                            socket and resubscribe after a fatal read error
+                            before giving up.
+                            Default: 5.
+  --log-file <path>         Append every update to this file, including
+                            updates skipped by --display-interval.
+  --low-battery <float>     Print a LOW BATTERY alert when the vehicle's
+                            battery level drops below this percentage.
+                            Default: no alert.
+  --map-bounds <string>     Fixed bounds for the --map display in the format
+                            'lat1,long1,lat2,long2'. If omitted, the bounds
+                            are derived from the incoming updates.
+  --output-socket <path>    Unix domain socket to create for local consumers.
+                            Each update packet is written to every connected
+                            consumer as a line of text.
+  --projection <string>     Coordinate projection for output: 'none' for
+                            latitude/longitude, 'webmercator', or 'utm'.
+                            Default: "none".
   --server-host <string>    IP address of the fleet server.
                             Default: "localhost"
   --server-port <int>       Port number of the fleet server.
                             Default: 8000.
-  --vin <string>            VIN of the target vehicle to subscribe to.
+  --set-rate <duration>     Ask the server to change the vehicle's reporting
+                            interval, e.g. "500ms", and exit. The vehicle
+                            must be running with --control.
+  --speed-limit <float>     Print a SPEEDING alert when the vehicle's speed
+                            in m/s exceeds this limit.
+                            Default: no limit.
+  --status <codes>          Only receive updates with one of these status
+                            codes, e.g. 'panic,door-open', or '*' for any
+                            status code.
+                            Default: receive every update.
+  --subscribe-retries <int> Number of times to resend the subscription request
+                            if the server hasn't replied.
+                            Default: 3.
+  --subscribe-retry-interval <duration>
+                            Interval between subscription retries.
+                            Default: "2s".
+  --time-format <string>    Format for absolute timestamps: 'rfc3339',
+                            'rfc3339nano', or a custom Go time layout, e.g.
+                            "15:04:05.000".
+                            Default: "rfc3339".
+  --tls-ca <file>           CA certificate file. If set, the client subscribes
+                            over a TLS connection to the server's TCP port and
+                            verifies the server's certificate against this CA.
+  --token <string>          Auth token to include in requests to the server.
+  --vin <string>            VIN of the target vehicle to subscribe to, or '*'
+                            for every vehicle in the fleet.
                             Default: "1HGBH41JXMN000000".
 
 Flags:
   -h, --help                Print this help text and exit.
+  --bands                   Only receive an update when the vehicle's speed
+                            moves into a different band, as defined by the
+                            server's --speed-bands option.
+  --compress                Ask the server to gzip-compress large batches of
+                            updates. Requires --batch.
+  --dedup                   Suppress consecutive duplicate updates with the
+                            same timestamp and position.
+  --delta                   Ask the server to send positions as deltas from
+                            the previous update to save bandwidth.
+  --drops                   Request the server's dropped packet counts by
+                            reason, print them, and exit.
+  --exit-on-alert           Exit with status code 2 after the first SPEEDING,
+                            ZONE VIOLATION, or LOW BATTERY alert.
+  --fleet-stats             Request aggregate statistics for the fleet from
+                            the server, print them, and exit.
+  --follow                  Ignore --vin and always track the fastest vehicle
+                            in the fleet.
+  --human-time              Show each update's timestamp relative to the
+                            current time, e.g. '3s ago'.
+  --latency                 Display the latency of each update, i.e. the time
+                            since the vehicle sent it, with a running min,
+                            avg, and max. Assumes the vehicle's clock is in
+                            sync with the client's.
+  --map                     Display the vehicle's position on an ASCII map.
+                            Falls back to text output if stdout is not a
+                            terminal.
+  --only-moving             Only display updates with a speed above zero.
+                            Prints the number of suppressed updates on exit.
+  --print-config            Print the effective value of every option on
+                            startup.
+  --query                   Request a single reading for the vehicle from the
+                            server, print it, and exit.
+  --show-source             Print the source address of each update and warn
+                            if updates arrive from an unexpected address.
+  --snapshot                Start a '*' subscription with the current state of
+                            every vehicle in the fleet, with no gap before
+                            the live updates.
+  --stats                   Request the vehicle's subscriber delivery
+                            statistics from the server, print them, and exit.
+  --verbose                 Print each raw packet and its source before the
+                            parsed output.
 `
 
+// If the --map flag is set, this is the map we use to display the vehicle's position. If nil, we
+// print each update as a line of text. As on the server, we're using a global variable here to
+// avoid passing display settings through every function.
+var mapView *asciiMap
+
+// If set to true, we print each raw packet and its source address before the parsed output. As on
+// the server, this is useful for diagnosing format mismatches.
+var verbose bool
+
+// If set to true, we print the source address of each update packet and warn if it doesn't match
+// the address of the server we subscribed to.
+var showSource bool
+
+// The projection we use to display each update's coordinates.
+var projection string
+
+// If set to true, we display each update's timestamp relative to the current time.
+var humanTime bool
+
+// The Go layout we use to display each update's absolute timestamp. See [parseTimeFormat].
+var timeLayout string
+
+// If non-zero, we print an alert when the vehicle's speed in m/s exceeds this limit. If exitOnAlert
+// is true, we exit after the first alert.
+var speedLimit float64
+var exitOnAlert bool
+
+// If non-zero, we print an alert when the vehicle's battery level drops below this percentage.
+var lowBattery float64
+var lowBatteryAlerted bool
+
+// If set to true, we suppress updates that repeat the timestamp and position of the last update we
+// displayed. The key identifies the last displayed update.
+var dedup bool
+var lastDisplayed string
+
+// If set to true, we only display updates from moving vehicles, i.e. updates with a speed above
+// zero. We count the updates we suppress and print the total when the client exits. The count is
+// updated atomically as the signal handler reads it.
+var onlyMoving bool
+var suppressedUpdates int64
+
+// If set to true, we label each displayed update with its VIN. A wildcard subscription receives
+// updates from every vehicle in the fleet so they'd be indistinguishable otherwise.
+var showVIN bool
+
+// The number of stored locations to request from the server when we subscribe.
+var backfill int
+
+// We resend the subscription request up to subscribeRetries times at this interval until the
+// server replies, in case the first request is lost.
+var subscribeRetries int
+var subscribeRetryInterval time.Duration
+
+// If not nil, we write a copy of each update to consumers connected to this Unix domain socket.
+var output *outputSocket
+
 func main() {
 	// This is the IP address the client will listen on for updates.
 	var localHost string
 	flag.StringVar(&localHost, "client-host", "localhost", "IP address for client.")
 
-	// This is the port number the client will listen on for updates.
-	// Improvement: figure out how to automatically select an available port number to use as the
-	// default to make it easier to run multiple clients simultaneously.
+	// This is the port number the client will listen on for updates. If the port is already in use
+	// the client falls back to the next free port, so several clients can run with the default.
 	var localPort string
 	flag.StringVar(&localPort, "client-port", "8001", "Port number for client.")
 
@@ -53,12 +247,285 @@ func main() {
 	var vin string
 	flag.StringVar(&vin, "vin", "1HGBH41JXMN000000", "VIN of target vehicle.")
 
+	// This is the fleet namespace of the target vehicle. An empty string selects the server's
+	// default namespace.
+	var namespace string
+	flag.StringVar(&namespace, "fleet", "", "Fleet namespace of target vehicle.")
+
+	// If set to true, we display the vehicle's position on an ASCII map instead of printing text.
+	var showMap bool
+	flag.BoolVar(&showMap, "map", false, "Display an ASCII map.")
+
+	// If set, we display the vehicle's ETA at this destination.
+	var destinationArg string
+	flag.StringVar(&destinationArg, "destination", "", "Destination for ETA display.")
+
+	// The method used to measure the distance to the destination.
+	var distanceMethod string
+	flag.StringVar(&distanceMethod, "distance-method", "great-circle", "Distance method for the ETA.")
+
+	// Optional fixed bounds for the ASCII map.
+	var mapBounds string
+	flag.StringVar(&mapBounds, "map-bounds", "", "Bounds for the ASCII map.")
+
+	// If set to true, we print the source address of each update.
+	flag.BoolVar(&showSource, "show-source", false, "Print the source of each update.")
+
+	flag.BoolVar(&verbose, "verbose", false, "Print raw packets.")
+
+	flag.BoolVar(&humanTime, "human-time", false, "Show relative timestamps.")
+
+	var timeFormat string
+	flag.StringVar(&timeFormat, "time-format", "rfc3339", "Timestamp format for output.")
+
+	flag.BoolVar(&dedup, "dedup", false, "Suppress duplicate updates.")
+
+	flag.BoolVar(&onlyMoving, "only-moving", false, "Only display updates from moving vehicles.")
+
+	// If set to true, we measure and display the latency of each update.
+	var measureLatency bool
+	flag.BoolVar(&measureLatency, "latency", false, "Display update latency stats.")
+
+	flag.Float64Var(&speedLimit, "speed-limit", 0, "Speed limit in m/s.")
+
+	flag.Float64Var(&lowBattery, "low-battery", 0, "Low battery threshold percentage.")
+
+	flag.BoolVar(&exitOnAlert, "exit-on-alert", false, "Exit after the first alert.")
+
+	flag.IntVar(&backfill, "backfill", 0, "Number of stored locations to display first.")
+
+	flag.IntVar(&subscribeRetries, "subscribe-retries", 3, "Number of times to resend the subscription.")
+	flag.IntVar(&listenRetries, "listen-retries", 5, "Number of times to re-create a failed listener.")
+
+	flag.DurationVar(&subscribeRetryInterval, "subscribe-retry-interval", 2*time.Second, "Subscription retry interval.")
+
+	var outputPath string
+	flag.StringVar(&outputPath, "output-socket", "", "Unix domain socket for local consumers.")
+
+	// If set to true, we ask the server to send delta updates.
+	var delta bool
+	flag.BoolVar(&delta, "delta", false, "Request delta updates.")
+
+	// If set to true, we ask the server to send speed band changes instead of updates.
+	var bands bool
+	flag.BoolVar(&bands, "bands", false, "Request speed band changes.")
+
+	// If set to true, we ask the server to compress large batches.
+	var compress bool
+	flag.BoolVar(&compress, "compress", false, "Request compressed batches.")
+
+	// If set to true, we ask the server to start a wildcard subscription with a snapshot.
+	var snapshot bool
+	flag.BoolVar(&snapshot, "snapshot", false, "Request a snapshot with a wildcard subscription.")
+
+	// If not empty, we ask the server to only send updates with one of these status codes.
+	var statusFilter string
+	flag.StringVar(&statusFilter, "status", "", "Status codes to subscribe to.")
+
+	// The format we ask the server to send our updates in.
+	var format string
+	flag.StringVar(&format, "format", "text", "Format of update packets.")
+
+	// If non-zero, we ask the server to batch our updates at this interval.
+	var batch time.Duration
+	flag.DurationVar(&batch, "batch", 0, "Batch interval for updates.")
+
+	// This is the projection we use to display coordinates.
+	flag.StringVar(&projection, "projection", "none", "Coordinate projection for output.")
+
+	// If set to true, we request a single reading instead of subscribing.
+	var query bool
+	flag.BoolVar(&query, "query", false, "Request a single reading and exit.")
+
+	// If set to true, we request the vehicle's delivery statistics instead of subscribing.
+	var stats bool
+	flag.BoolVar(&stats, "stats", false, "Request delivery statistics and exit.")
+
+	// If set to true, we request the server's dropped packet counts instead of subscribing.
+	var drops bool
+	flag.BoolVar(&drops, "drops", false, "Request dropped packet counts and exit.")
+
+	// If set to true, we request aggregate statistics for the fleet instead of subscribing.
+	var fleetStats bool
+	flag.BoolVar(&fleetStats, "fleet-stats", false, "Request fleet statistics and exit.")
+
+	// If non-zero, we ask the server to change the vehicle's reporting interval instead of
+	// subscribing.
+	var setRate time.Duration
+	flag.DurationVar(&setRate, "set-rate", 0, "Change the vehicle's reporting interval and exit.")
+
+	// If the server requires an auth token, we include this token in our requests.
+	var token string
+	flag.StringVar(&token, "token", "", "Auth token for server.")
+
+	// If set to true, we always track the fastest vehicle in the fleet.
+	var follow bool
+	flag.BoolVar(&follow, "follow", false, "Track the fastest vehicle.")
+
+	// In follow mode, we re-evaluate the fastest vehicle at this interval.
+	var followInterval time.Duration
+	flag.DurationVar(&followInterval, "follow-interval", 10*time.Second, "Follow re-evaluation interval.")
+
+	// If set, we subscribe over TLS and verify the server's certificate against this CA.
+	var tlsCA string
+	flag.StringVar(&tlsCA, "tls-ca", "", "CA certificate file for TLS.")
+
+	// If set, we append every datagram we receive to this file.
+	var capturePath string
+	flag.StringVar(&capturePath, "capture", "", "File to capture received packets to.")
+
+	// If non-zero, we print at most one update per vehicle in each interval.
+	var displayInterval time.Duration
+	flag.DurationVar(&displayInterval, "display-interval", 0, "Minimum interval between each vehicle's updates.")
+
+	// If set, we append every update to this file.
+	var logPath string
+	flag.StringVar(&logPath, "log-file", "", "File to log every update to.")
+
+	// If set to true, we print the effective settings on startup.
+	var showConfig bool
+	flag.BoolVar(&showConfig, "print-config", false, "Print the effective settings.")
+
 	flag.Usage = func() {
 		fmt.Print(helptext)
 	}
 
 	flag.Parse()
 
+	if !isValidProjection(projection) {
+		fmt.Fprintf(os.Stderr, "Error: invalid projection '%s'.\n", projection)
+		os.Exit(1)
+	}
+
+	layout, err := parseTimeFormat(timeFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid time format '%s'.\n  -->  %s\n", timeFormat, err.Error())
+		os.Exit(1)
+	}
+	timeLayout = layout
+
+	if speedLimit < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the speed limit must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if setRate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the reporting interval must be greater than zero.\n")
+		os.Exit(1)
+	}
+
+	if batch < 0 || batch > time.Minute {
+		fmt.Fprintf(os.Stderr, "Error: the batch interval must be in the range [0, 1m].\n")
+		os.Exit(1)
+	}
+
+	if displayInterval < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the display interval must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if displayInterval > 0 && showMap {
+		fmt.Fprintf(os.Stderr, "Error: --display-interval can't be used with --map.\n")
+		os.Exit(1)
+	}
+
+	if compress && (batch == 0 || tlsCA != "") {
+		fmt.Fprintf(os.Stderr, "Error: --compress requires --batch and can't be used with --tls-ca.\n")
+		os.Exit(1)
+	}
+
+	if format != "text" && format != "json" && format != "binary" {
+		fmt.Fprintf(os.Stderr, "Error: the format must be 'text', 'json', or 'binary'.\n")
+		os.Exit(1)
+	}
+
+	if format != "text" && (delta || bands) {
+		fmt.Fprintf(os.Stderr, "Error: --delta and --bands require the text format.\n")
+		os.Exit(1)
+	}
+
+	if format == "binary" && (batch > 0 || tlsCA != "") {
+		fmt.Fprintf(os.Stderr, "Error: the binary format can't be used with --batch or --tls-ca.\n")
+		os.Exit(1)
+	}
+
+	if lowBattery < 0 || lowBattery > 100 {
+		fmt.Fprintf(os.Stderr, "Error: the low battery threshold must be in the range [0, 100].\n")
+		os.Exit(1)
+	}
+
+	if backfill < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the backfill count must not be negative.\n")
+		os.Exit(1)
+	}
+
+	showVIN = vin == "*"
+
+	if snapshot && vin != "*" {
+		fmt.Fprintf(os.Stderr, "Error: --snapshot requires a wildcard subscription, i.e. --vin '*'.\n")
+		os.Exit(1)
+	}
+
+	if backfill > 0 && vin == "*" {
+		fmt.Fprintf(os.Stderr, "Error: --backfill can't be used with a wildcard subscription.\n")
+		os.Exit(1)
+	}
+
+	if listenRetries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the number of listen retries must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if subscribeRetries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the subscription retry count must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if subscribeRetryInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: the subscription retry interval must be greater than zero.\n")
+		os.Exit(1)
+	}
+
+	if followInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: the follow interval must be greater than zero.\n")
+		os.Exit(1)
+	}
+
+	if showMap {
+		if isTerminal(os.Stdout) {
+			mapView = newASCIIMap(false, 0, 0, 0, 0)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: stdout is not a terminal, ignoring the --map flag.\n")
+		}
+	}
+
+	if destinationArg != "" {
+		destination, err = parseDestination(destinationArg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid destination '%s'.\n  -->  %s\n", destinationArg, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	switch distanceMethod {
+	case "great-circle":
+		measureDistance = getDistance
+	case "rhumb":
+		measureDistance = rhumbDistance
+	default:
+		fmt.Fprintf(os.Stderr, "Error: the distance method must be 'great-circle' or 'rhumb'.\n")
+		os.Exit(1)
+	}
+
+	if mapView != nil && mapBounds != "" {
+		minLat, minLong, maxLat, maxLong, err := parseMapBounds(mapBounds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid map bounds '%s'.\n  -->  %s\n", mapBounds, err.Error())
+			os.Exit(1)
+		}
+		mapView = newASCIIMap(true, minLat, minLong, maxLat, maxLong)
+	}
+
 	// This is the local address of the client. The client will send its subscription request from
 	// this address and it will listen on this address for updates from the server.
 	localAddr, err := net.ResolveUDPAddr("udp", localHost+":"+localPort)
@@ -85,109 +552,710 @@ func main() {
 		os.Exit(1)
 	}
 
-	runClient(localAddr, remoteAddr, vin)
+	var tlsConfig *tls.Config
+	if tlsCA != "" {
+		tlsConfig, err = loadTLSConfig(tlsCA, remoteHost)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to load CA certificate.\n  -->  %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if outputPath != "" {
+		output, err = openOutputSocket(outputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to open output socket '%s'.\n  -->  %s\n", outputPath, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if logPath != "" {
+		logFile, err = os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to open log file '%s'.\n  -->  %s\n", logPath, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if capturePath != "" {
+		capturing, err = openCapture(capturePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to open capture file '%s'.\n  -->  %s\n", capturePath, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if displayInterval > 0 {
+		throttle = newDisplayThrottle(displayInterval)
+	}
+
+	// The fleet namespace and auth token are passed to the server as optional fields on every
+	// request.
+	requestFields := ""
+	if namespace != "" {
+		requestFields += " fleet=" + namespace
+	}
+	if token != "" {
+		requestFields += " token=" + token
+	}
+
+	// Only subscriptions use the delta, bands, batch, compress, format, status, and snapshot
+	// fields. The server ignores them on other requests.
+	if delta {
+		requestFields += " delta=true"
+	}
+	if bands {
+		requestFields += " bands=true"
+	}
+	if batch > 0 {
+		requestFields += " batch=" + batch.String()
+	}
+	if compress {
+		requestFields += " compress=true"
+	}
+	if format != "text" {
+		requestFields += " format=" + format
+	}
+	if statusFilter != "" {
+		requestFields += " status=" + statusFilter
+	}
+	if snapshot {
+		requestFields += " snapshot=true"
+	}
+
+	if showConfig {
+		printConfig()
+	}
+
+	if measureLatency {
+		latency = &latencyStats{}
+	}
+
+	if query {
+		source, reply := sendRequest(localAddr, remoteAddr, "SPEED "+vin+requestFields)
+		displayingStored = true
+		exitClient(handlePacket(source, reply))
+	} else if stats {
+		_, reply := sendRequest(localAddr, remoteAddr, "STATS "+vin+requestFields)
+		fmt.Println(reply)
+	} else if drops {
+		_, reply := sendRequest(localAddr, remoteAddr, "STATS"+requestFields)
+		fmt.Println(reply)
+	} else if fleetStats {
+		_, reply := sendRequest(localAddr, remoteAddr, "FLEETSTATS"+requestFields)
+		fmt.Println(reply)
+	} else if setRate > 0 {
+		_, reply := sendRequest(localAddr, remoteAddr, fmt.Sprintf("SETRATE %s %s%s", vin, setRate, requestFields))
+		fmt.Println(reply)
+	} else if follow {
+		// With --only-moving or --latency, we print the number of suppressed updates or the
+		// latency stats when the user hits Ctrl-C.
+		if onlyMoving || latency != nil {
+			go func() {
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+				<-signals
+				fmt.Println()
+				exitClient(nil)
+			}()
+		}
+		runFollowClient(localAddr, remoteAddr, requestFields, followInterval)
+	} else {
+		// Stop gracefully when the user hits Ctrl-C so we can print the summaries.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := runClient(ctx, localAddr, remoteAddr, vin, namespace, requestFields, tlsConfig)
+		if ctx.Err() != nil {
+			fmt.Println()
+		}
+		stop()
+		exitClient(err)
+	}
 }
 
-// The client sends a subscription request packet to the fleet state server, then listens for
-// incoming update packets from the server.
-func runClient(localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, vin string) {
-	fmt.Println("-------------------------")
-	fmt.Println("Running Subscriber Client")
-	fmt.Println("-------------------------")
-	fmt.Printf("Client: %s\n", localAddr)
-	fmt.Printf("Server: %s\n", remoteAddr)
-	fmt.Printf("VIN:    %s\n", vin)
-	fmt.Printf("Exit:   Ctrl-C\n")
-	fmt.Println("-------------------------")
+// This function exits the process once the client has stopped. An error exits with status code 1,
+// except for [errAlert] which exits with status code 2. Otherwise we print the --only-moving and
+// --latency summaries and exit with status code 0.
+func exitClient(err error) {
+	if output != nil {
+		output.close()
+	}
+	if throttle != nil {
+		throttle.flush(time.Now(), true)
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	if capturing != nil {
+		capturing.close()
+	}
 
-	// Send a SUBSCRIBE packet to the server.
-	message := fmt.Sprintf("SUBSCRIBE %s", vin)
+	if err != nil && !errors.Is(err, errAlert) && !errors.Is(err, errServerShutdown) {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	printSuppressedCount()
+	printLatencySummary()
+
+	if errors.Is(err, errAlert) {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
 
-	// This will fail if the local port is already being used by another client.
-	conn, err := net.DialUDP("udp", localAddr, remoteAddr)
+// This function sends a single request packet to the server and returns the server's reply along
+// with its source address. It exits with an error message if the server doesn't reply in time or
+// if the reply is an ERROR packet. This lets the user poll the server without subscribing to a
+// feed.
+func sendRequest(localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, message string) (*net.UDPAddr, string) {
+	listener, err := listenClientUDP(localAddr)
 	if err != nil {
 		fmt.Fprintf(
 			os.Stderr,
-			"Error: unable to connect to '%s' from '%s'.\n  -->  %s\n",
-			remoteAddr,
+			"Error: unable to initialize listener on address '%s'.\n  -->  %s\n",
 			localAddr,
 			err.Error())
 		os.Exit(1)
 	}
+	defer listener.Close()
 
-	_, err = conn.Write([]byte(message))
+	_, err = listener.WriteToUDP([]byte(message), remoteAddr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to send subscription packet.\n  -->  %s\n", err.Error())
+		fmt.Fprintf(os.Stderr, "Error: failed to send request.\n  -->  %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	conn.Close()
+	buffer := make([]byte, maxPacketSize)
+	listener.SetReadDeadline(time.Now().Add(queryTimeout))
 
-	// Listen for incoming update packets.
-	listener, err := net.ListenUDP("udp", localAddr)
+	n, source, err := listener.ReadFromUDP(buffer)
 	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Error: unable to initialize listener on address '%s'.\n  -->  %s\n",
-			localAddr,
-			err.Error())
+		fmt.Fprintf(os.Stderr, "Error: no reply from server '%s'.\n  -->  %s\n", remoteAddr, err.Error())
 		os.Exit(1)
 	}
-	defer listener.Close()
 
-	// This is the client's listening loop. It will continue listening for update packets until the
-	// user hits Ctrl-C.
+	reply := strings.TrimSpace(string(buffer[:n]))
+	if strings.HasPrefix(reply, "ERROR") {
+		fmt.Fprintf(os.Stderr, "Error: the server replied '%s'.\n", reply)
+		os.Exit(1)
+	}
+
+	return source, reply
+}
+
+// The client sends a subscription request packet to the fleet state server, then listens for
+// incoming update packets from the server. The requestFields string contains any optional fields to
+// append to the SUBSCRIBE packet. If tlsConfig is not nil, the client subscribes over TLS instead
+// of UDP.
+//
+// The function runs until the context is cancelled or the server shuts down, when it returns nil.
+// It returns an error if it fails to subscribe, if the server replies with an ERROR packet, or
+// [errAlert] if --exit-on-alert is set. It doesn't exit the process so it can be embedded, e.g. in
+// tests.
+func runClient(ctx context.Context, localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, vin string, namespace string, requestFields string, tlsConfig *tls.Config) error {
+	// Listen for incoming update packets. If the local port is already being used, e.g. by another
+	// client, we fall back to the next free port. We listen before printing the header so it
+	// reports the port actually used.
+	var listener *net.UDPConn
+	if tlsConfig == nil {
+		var err error
+		listener, err = listenClientUDP(localAddr)
+		if err != nil {
+			return fmt.Errorf("unable to initialize listener on address '%s': %w", localAddr, err)
+		}
+		defer listener.Close()
+	}
+
+	fmt.Println("-------------------------")
+	fmt.Println("Running Subscriber Client")
+	fmt.Println("-------------------------")
+	fmt.Printf("Client: %s\n", localAddr)
+	fmt.Printf("Server: %s\n", remoteAddr)
+	fmt.Printf("VIN:    %s\n", vin)
+	if namespace != "" {
+		fmt.Printf("Fleet:  %s\n", namespace)
+	}
+	if tlsConfig != nil {
+		fmt.Printf("TLS:    enabled\n")
+	}
+	fmt.Printf("Exit:   Ctrl-C\n")
+	fmt.Println("-------------------------")
+
+	// Send a SUBSCRIBE packet to the server.
+	subscription := fmt.Sprintf("SUBSCRIBE %s%s", vin, requestFields)
+	message := subscription
+
+	// If --backfill is set, we request the vehicle's recent history after subscribing. We
+	// subscribe first so no update can fall between the history and the live feed; any overlap is
+	// skipped as a duplicate.
+	if backfill > 0 {
+		message += "\n" + historyRequest(vin, backfill, requestFields)
+		backfilling = true
+	}
+
+	if tlsConfig != nil {
+		return runTLSSubscription(ctx, remoteAddr, message, tlsConfig)
+	}
+
+	// We send the subscription request from the listening socket so the server's reply address is
+	// the same address we're listening on and we can't miss an immediate ERROR reply.
+	_, err := listener.WriteTo([]byte(message), remoteAddr)
+	if err != nil {
+		return fmt.Errorf("failed to send subscription packet: %w", err)
+	}
+
+	// UDP packets can be lost, so we resend the request until the server replies.
+	if subscribeRetries > 0 {
+		go resendSubscription(listener, message, remoteAddr)
+	}
+
+	// If the listener fails we re-create it and resubscribe, without requesting the backfill
+	// again.
+	return listenWithReconnect(ctx, listener, localAddr, remoteAddr, subscription)
+}
+
+// This function closes the connection when the context is cancelled, unblocking any pending read.
+// The caller must call the returned function once it's finished with the connection so the
+// goroutine watching the context exits.
+func closeOnCancel(ctx context.Context, conn io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// This is the client's listening loop. It will continue listening for update packets until the
+// connection is closed or the server shuts down, when it returns nil. It returns an error if
+// handlePacket tells us to stop for any other reason, or an error wrapping [errListenerFailed] if
+// the connection fails with a read error it can't recover from. We back off after recoverable
+// read errors so a failing connection can't spin the CPU.
+func listen(conn packetConn, remoteAddr net.Addr) error {
+	buffer := make([]byte, maxPacketSize)
+	failures := 0
+
 	for {
-		buffer := make([]byte, 256)
+		n, source, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil && !isRecoverableReadError(err) {
+			return fmt.Errorf("%w: %v", errListenerFailed, err)
+		}
+		if err != nil {
+			failures++
+			fmt.Fprintf(os.Stderr, "Error: invalid read.\n  -->  %s\n", err.Error())
+			time.Sleep(readBackoff(failures))
+			continue
+		}
+		failures = 0
+		atomic.StoreInt32(&subscriptionConfirmed, 1)
+
+		// The server sends updates from the same address it listens on.
+		if showSource && source.String() != remoteAddr.String() {
+			fmt.Fprintf(
+				os.Stderr,
+				"Warning: update from unexpected address '%s', expected '%s'.\n",
+				source,
+				remoteAddr)
+		}
 
-		n, _, err := listener.ReadFromUDP(buffer)
+		payload := buffer[:n]
+		if capturing != nil {
+			capturing.record(time.Now(), source, payload)
+		}
+
+		payload, err = decodePayload(payload)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid read.\n.  -->  %s\n", err.Error())
+			fmt.Fprintf(os.Stderr, "Error: invalid packet.\n  -->  %s\n", err.Error())
 			continue
 		}
 
-		handlePacket(string(buffer[:n]))
+		for _, message := range splitMessages(payload) {
+			err := handleFeedPacket(source, message)
+			if errors.Is(err, errServerShutdown) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
 	}
 }
 
-// An update packet should have the format: [<timestamp> <vin> <latitude> <longitude> <speed>].
-func handlePacket(message string) {
-	elements := strings.Split(message, " ")
-	if len(elements) != 5 {
+// Packets can end with optional fields in the format [<key>=<value>]. This function splits a
+// packet into its positional fields and a map of its optional fields.
+func splitFields(message string) ([]string, map[string]string) {
+	var fields []string
+	options := make(map[string]string)
+
+	for _, element := range strings.Split(message, " ") {
+		if index := strings.Index(element, "="); index >= 0 {
+			options[element[:index]] = element[index+1:]
+		} else {
+			fields = append(fields, element)
+		}
+	}
+
+	return fields, options
+}
+
+// An update packet should have the format: [<timestamp> <vin> <latitude> <longitude> <speed>],
+// optionally followed by [<key>=<value>] fields. Unrecognised optional fields are ignored.
+//
+// Invalid packets are reported and skipped. The function only returns an error if the client
+// should stop: an ERROR reply from the server, [errServerShutdown], or [errAlert].
+func handlePacket(source net.Addr, message string) error {
+	if verbose {
+		fmt.Println(source, ">>", message)
+	}
+
+	// The server replies with an ERROR packet if it rejects our subscription, e.g. because we
+	// didn't supply the correct auth token.
+	if strings.HasPrefix(message, "ERROR") {
+		return fmt.Errorf("the server replied '%s'", message)
+	}
+
+	// The server sends a SHUTDOWN packet to its subscribers when it's shutting down gracefully.
+	if message == "SHUTDOWN" {
+		fmt.Println("The server is shutting down.")
+		return errServerShutdown
+	}
+
+	if strings.HasPrefix(message, "BAND ") {
+		handleBandPacket(message)
+		return nil
+	}
+
+	// Delta packets are reconstructed into full update packets using the previous update.
+	if strings.HasPrefix(message, "DELTA ") {
+		update, err := applyDelta(message)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			return nil
+		}
+		message = update
+	}
+
+	// The speed field is omitted if the server is running with --no-speed.
+	elements, options := splitFields(message)
+	if len(elements) != 4 && len(elements) != 5 {
 		fmt.Fprintf(os.Stderr, "Error: invalid update packet.\n")
-		return
+		return nil
 	}
 
 	timestamp, err := time.Parse(time.RFC3339Nano, elements[0])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: invalid timestamp.\n")
-		return
+		return nil
+	}
+
+	// The update's timestamp is the time the vehicle sent it, so the time since then is the
+	// latency of the whole pipeline, assuming the vehicle's clock is in sync with ours.
+	var observed time.Duration
+	measured := latency != nil && !displayingStored
+	if measured {
+		observed = time.Since(timestamp)
+		latency.record(observed)
+	}
+
+	// A vehicle with no GPS fix has no position to display.
+	if elements[2] == noFix && elements[3] == noFix {
+		displayNoFix(source, message, elements[1], timestamp, options)
+		return nil
 	}
 
 	latitude, err := strconv.ParseFloat(elements[2], 64)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: invalid latitude.\n")
-		return
+		return nil
 	}
 
 	longitude, err := strconv.ParseFloat(elements[3], 64)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: invalid longitude.\n")
+		return nil
+	}
+
+	hasSpeed := len(elements) == 5
+	speed := -1.0
+	if hasSpeed {
+		speed, err = strconv.ParseFloat(elements[4], 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid speed.\n")
+			return nil
+		}
+	}
+
+	recordDeltaBase(elements[1], timestamp, latitude, longitude)
+
+	// Live updates which overlap the backfill have already been displayed.
+	if !timestamp.After(backfillCutoff) {
+		return nil
+	}
+
+	// Duplicates can arrive due to retransmits or duplicate subscriptions. A stationary vehicle
+	// still sends updates with advancing timestamps so these are never treated as duplicates.
+	if dedup {
+		key := strings.Join(elements[:4], " ")
+		if key == lastDisplayed {
+			return nil
+		}
+		lastDisplayed = key
+	}
+
+	// Local consumers get a copy of the raw update packet, after any delta has been applied.
+	if output != nil {
+		output.write(message)
+	}
+
+	// A speed value of -1.0 means the speed is not available, so the vehicle may not be moving.
+	if onlyMoving && speed <= 0 {
+		atomic.AddInt64(&suppressedUpdates, 1)
+		return nil
+	}
+
+	timeString := formatTimestamp(timestamp)
+	position := formatPosition(latitude, longitude, projection)
+
+	// A speed value of -1.0 means the speed is not available.
+	var line string
+	if !hasSpeed {
+		line = fmt.Sprintf("[%s]  %s", timeString, position)
+	} else if speed == -1.0 {
+		line = fmt.Sprintf("[%s]  %s  N/A", timeString, position)
+	} else {
+		line = fmt.Sprintf("[%s]  %s  %5.2f m/s", timeString, position, speed)
+	}
+
+	if showVIN {
+		line = elements[1] + "  " + line
+	}
+
+	// If the server includes the vehicle's odometer reading, it's the total distance in meters.
+	if value, found := options["odometer"]; found {
+		odometer, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid odometer.\n")
+			return nil
+		}
+		line += fmt.Sprintf("  %8.3f km", odometer/1000)
+	}
+
+	// If the vehicle reports its ignition state, it's either "on" or "off".
+	if ignition, found := options["ignition"]; found {
+		line += "  ignition " + ignition
+	}
+
+	// If the vehicle reports its battery level, it's a percentage.
+	battery := -1.0
+	if value, found := options["battery"]; found {
+		battery, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid battery level.\n")
+			return nil
+		}
+		line += fmt.Sprintf("  battery %5.1f%%", battery)
+	}
+
+	if destination != nil {
+		line += "  " + formatETA(latitude, longitude, speed)
+	}
+
+	// If the vehicle reports a status or alarm code, it applies to this update only.
+	if status, found := options["status"]; found {
+		line += "  status " + status
+	}
+
+	// If the server has a --server-id, it's the ID of the server which first received the update.
+	if origin, found := options["origin"]; found {
+		line += "  via " + origin
+	}
+
+	if measured {
+		line += fmt.Sprintf("  latency %s (%s)", formatLatency(observed), latency)
+	}
+
+	if showSource {
+		line += fmt.Sprintf("  [from %s]", source)
+	}
+
+	// There's no alert if the speed isn't available.
+	var alerts []string
+	if speedLimit > 0 && hasSpeed && speed != -1.0 && speed > speedLimit {
+		alerts = append(alerts, fmt.Sprintf(
+			"*** SPEEDING: %s at %.2f m/s exceeds the limit of %.2f m/s ***",
+			elements[1],
+			speed,
+			speedLimit))
+	}
+
+	// The server flags violations if it was started with --speed-limit-zones.
+	if options["violation"] == "true" {
+		alerts = append(alerts, fmt.Sprintf(
+			"*** ZONE VIOLATION: %s at %.2f m/s exceeds the zone's speed limit ***",
+			elements[1],
+			speed))
+	}
+
+	// We only alert when the battery level first drops below the threshold, not on every update
+	// while it's low.
+	if lowBattery > 0 && battery != -1.0 {
+		if battery < lowBattery && !lowBatteryAlerted {
+			alerts = append(alerts, fmt.Sprintf(
+				"*** LOW BATTERY: %s at %.1f%% is below %.1f%% ***",
+				elements[1],
+				battery,
+				lowBattery))
+		}
+		lowBatteryAlerted = battery < lowBattery
+	}
+
+	// Alerts are never held back by --display-interval.
+	if mapView != nil {
+		logLine(line)
+		for _, alert := range alerts {
+			logLine(alert)
+			line += "\n" + alert
+		}
+		mapView.update(latitude, longitude, line)
+	} else {
+		displayLine(elements[1], line)
+		for _, alert := range alerts {
+			logLine(alert)
+			fmt.Println(alert)
+		}
+	}
+
+	if len(alerts) > 0 && exitOnAlert {
+		return errAlert
+	}
+	return nil
+}
+
+// This function displays an update from a vehicle with no GPS fix. The vehicle's last position is
+// left on the map.
+func displayNoFix(source net.Addr, message string, vin string, timestamp time.Time, options map[string]string) {
+	if !timestamp.After(backfillCutoff) {
 		return
 	}
 
-	speed, err := strconv.ParseFloat(elements[4], 64)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: invalid speed.\n")
+	if output != nil {
+		output.write(message)
+	}
+
+	// Without a fix there's no speed, so we can't tell if the vehicle is moving.
+	if onlyMoving {
+		atomic.AddInt64(&suppressedUpdates, 1)
 		return
 	}
 
-	timeString := timestamp.Format(time.RFC3339)
+	timeString := formatTimestamp(timestamp)
+	line := fmt.Sprintf("[%s]  no fix", timeString)
+	if showVIN {
+		line = vin + "  " + line
+	}
+	if status, found := options["status"]; found {
+		line += "  status " + status
+	}
 
-	// A speed value of -1.0 means the speed is not available.
-	if speed == -1.0 {
-		fmt.Printf("[%s]  (%.6f, %.6f)  N/A\n", timeString, latitude, longitude)
+	if showSource {
+		line += fmt.Sprintf("  [from %s]", source)
+	}
+
+	if mapView != nil {
+		logLine(line)
+		mapView.draw(line)
 	} else {
-		fmt.Printf("[%s]  (%.6f, %.6f)  %5.2f m/s\n", timeString, latitude, longitude, speed)
+		displayLine(vin, line)
+	}
+}
+
+// This function prints the number of updates suppressed by --only-moving, if it's set.
+func printSuppressedCount() {
+	if onlyMoving {
+		fmt.Printf("Suppressed %d updates from vehicles which weren't moving.\n", atomic.LoadInt64(&suppressedUpdates))
+	}
+}
+
+// This function formats an update's timestamp for display, either relative to now if --human-time
+// is set, or using the --time-format layout.
+func formatTimestamp(timestamp time.Time) string {
+	if humanTime {
+		return formatRelativeTime(timestamp, time.Now())
+	}
+	return timestamp.Format(timeLayout)
+}
+
+// This function returns the Go time layout for a --time-format value, which can be 'rfc3339',
+// 'rfc3339nano', or a custom layout like "15:04:05.000". A custom layout must contain at least one
+// time element and must be able to parse the timestamps it formats.
+func parseTimeFormat(format string) (string, error) {
+	switch format {
+	case "rfc3339":
+		return time.RFC3339, nil
+	case "rfc3339nano":
+		return time.RFC3339Nano, nil
 	}
+
+	reference := time.Date(2006, time.January, 2, 15, 4, 5, 123456789, time.UTC)
+	formatted := reference.Format(format)
+	if formatted == format {
+		return "", fmt.Errorf("the layout contains no time elements")
+	}
+
+	_, err := time.Parse(format, formatted)
+	if err != nil {
+		return "", err
+	}
+
+	return format, nil
+}
+
+// This function formats the timestamp relative to now, e.g. "3s ago" or "2m15s ago". The server's
+// clock may be slightly ahead of ours so timestamps up to a second in the future are shown as
+// "just now" rather than as a negative age. Timestamps further in the future indicate real clock
+// skew and are shown as e.g. "5s ahead".
+func formatRelativeTime(timestamp time.Time, now time.Time) string {
+	age := now.Sub(timestamp)
+	if age > -time.Second && age < time.Second {
+		return "just now"
+	}
+
+	age = age.Round(time.Second)
+
+	if age < 0 {
+		return (-age).String() + " ahead"
+	}
+
+	// Seconds aren't interesting once the update is more than an hour old.
+	if age >= time.Hour {
+		return strings.TrimSuffix(age.Round(time.Minute).String(), "0s") + " ago"
+	}
+
+	return age.String() + " ago"
+}
+
+// This function prints the effective value of every command line option, including defaults and
+// any values resolved during validation. It's useful for debugging misconfiguration. The auth token
+// is redacted so the output can be shared safely.
+func printConfig() {
+	fmt.Println("-------------------------")
+	fmt.Println("Configuration")
+	fmt.Println("-------------------------")
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == "" {
+			value = `""`
+		}
+		if f.Name == "token" && f.Value.String() != "" {
+			value = "<redacted>"
+		}
+		fmt.Printf("%-28s%s\n", "--"+f.Name, value)
+	})
+	fmt.Println("-------------------------")
 }
@@ -0,0 +1,131 @@
+package main
+
+import "errors"
+import "io"
+import "net"
+import "os"
+import "strings"
+import "sync/atomic"
+import "testing"
+
+// A scriptedConn is a packetConn which replays a fixed sequence of reads, for testing the
+// listening loop. Once the script runs out, reads fail with net.ErrClosed as if the connection had
+// been closed.
+type scriptedConn struct {
+	reads []scriptedRead
+}
+
+// A single read from a scriptedConn, either a packet or an error.
+type scriptedRead struct {
+	message string
+	err     error
+}
+
+// The address scripted packets come from.
+var testServerAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}
+
+func (conn *scriptedConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	if len(conn.reads) == 0 {
+		return 0, nil, net.ErrClosed
+	}
+
+	read := conn.reads[0]
+	conn.reads = conn.reads[1:]
+	if read.err != nil {
+		return 0, nil, read.err
+	}
+	return copy(buffer, read.message), testServerAddr, nil
+}
+
+func (conn *scriptedConn) WriteTo(message []byte, addr net.Addr) (int, error) {
+	return len(message), nil
+}
+
+func (conn *scriptedConn) Close() error {
+	return nil
+}
+
+// This function runs the callback and returns everything it printed to stdout.
+func captureStdout(t *testing.T, callback func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	callback()
+	writer.Close()
+	return <-output
+}
+
+func TestListenHandlesUpdatesUntilClosed(t *testing.T) {
+	atomic.StoreInt32(&subscriptionConfirmed, 0)
+
+	conn := &scriptedConn{reads: []scriptedRead{
+		{message: "2024-03-01T12:00:00Z VIN1 53.000000 -6.000000 0.000000"},
+		{err: os.ErrDeadlineExceeded},
+		{message: "2024-03-01T12:00:01Z VIN2 53.000100 -6.000000 11.100000"},
+	}}
+
+	var err error
+	output := captureStdout(t, func() {
+		err = listen(conn, testServerAddr)
+	})
+
+	if err != nil {
+		t.Fatalf("expected the loop to stop cleanly when the connection closed, found %v", err)
+	}
+	if !strings.Contains(output, "53.000000") || !strings.Contains(output, "53.000100") {
+		t.Errorf("expected both updates to be displayed after a recoverable error, found:\n%s", output)
+	}
+	if atomic.LoadInt32(&subscriptionConfirmed) != 1 {
+		t.Errorf("expected the subscription to be confirmed")
+	}
+}
+
+func TestListenFailsOnFatalReadError(t *testing.T) {
+	conn := &scriptedConn{reads: []scriptedRead{
+		{err: errors.New("socket failed")},
+		{message: "2024-03-01T12:00:00Z VIN1 53.000000 -6.000000 0.000000"},
+	}}
+
+	err := listen(conn, testServerAddr)
+	if !errors.Is(err, errListenerFailed) {
+		t.Fatalf("expected errListenerFailed, found %v", err)
+	}
+	if len(conn.reads) != 1 {
+		t.Errorf("expected the loop to stop reading after a fatal error")
+	}
+}
+
+func TestListenStopsOnShutdown(t *testing.T) {
+	conn := &scriptedConn{reads: []scriptedRead{
+		{message: "SHUTDOWN"},
+		{message: "2024-03-01T12:00:00Z VIN1 53.000000 -6.000000 0.000000"},
+	}}
+
+	var err error
+	captureStdout(t, func() {
+		err = listen(conn, testServerAddr)
+	})
+
+	if err != nil {
+		t.Fatalf("expected a server shutdown to stop the loop cleanly, found %v", err)
+	}
+	if len(conn.reads) != 1 {
+		t.Errorf("expected the loop to stop reading after a SHUTDOWN packet")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import "fmt"
+import "os"
+import "strings"
+
+// Dimensions of the ASCII map in character cells.
+const mapWidth = 60
+const mapHeight = 20
+
+// When the map bounds are derived automatically we pad them so that a vehicle which hasn't moved
+// much yet doesn't fill the entire grid. 0.001 degrees is approximately 111 meters of latitude.
+const mapMinSpan = 0.001
+
+// The map only draws the vehicle's most recent positions so a long-running client doesn't keep its
+// whole track in memory or redraw it on every update.
+const mapTrackLength = 1000
+
+// This type renders a vehicle's position as a moving dot on a fixed-size ASCII grid. If the bounds
+// are fixed (i.e. supplied on the command line) positions outside them are clamped to the edge of
+// the grid; otherwise the bounds grow to include every position seen so far.
+//
+// The track is a ring buffer of the last [mapTrackLength] positions. Once it's full, next is the
+// index of the oldest position, which the next update overwrites.
+type asciiMap struct {
+	fixed   bool
+	empty   bool
+	minLat  float64
+	minLong float64
+	maxLat  float64
+	maxLong float64
+	track   [][2]float64
+	next    int
+}
+
+// This function returns a new map. If fixed is false the bounds arguments are ignored and the
+// bounds are derived from the incoming updates.
+func newASCIIMap(fixed bool, minLat, minLong, maxLat, maxLong float64) *asciiMap {
+	return &asciiMap{
+		fixed:   fixed,
+		empty:   !fixed,
+		minLat:  minLat,
+		minLong: minLong,
+		maxLat:  maxLat,
+		maxLong: maxLong,
+	}
+}
+
+// This function parses a bounds string with the format: [<lat1>,<long1>,<lat2>,<long2>]. The two
+// points are opposite corners of the bounding box and can be given in either order.
+func parseMapBounds(bounds string) (float64, float64, float64, float64, error) {
+	var lat1, long1, lat2, long2 float64
+	_, err := fmt.Sscanf(bounds, "%f,%f,%f,%f", &lat1, &long1, &lat2, &long2)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	if lat1 == lat2 || long1 == long2 {
+		return 0, 0, 0, 0, fmt.Errorf("bounding box has zero area")
+	}
+
+	if lat1 > lat2 {
+		lat1, lat2 = lat2, lat1
+	}
+
+	if long1 > long2 {
+		long1, long2 = long2, long1
+	}
+
+	return lat1, long1, lat2, long2, nil
+}
+
+// This function adds a new position to the map's track, dropping the oldest position if the track
+// is full, and redraws the map. The status line is printed below the grid.
+func (m *asciiMap) update(latitude, longitude float64, status string) {
+	point := [2]float64{latitude, longitude}
+	if len(m.track) < mapTrackLength {
+		m.track = append(m.track, point)
+	} else {
+		m.track[m.next] = point
+	}
+	m.next = (m.next + 1) % mapTrackLength
+	if !m.fixed {
+		m.expand(latitude, longitude)
+	}
+	m.draw(status)
+}
+
+// This function grows the map's bounds to include the specified position.
+func (m *asciiMap) expand(latitude, longitude float64) {
+	if m.empty {
+		m.minLat, m.maxLat = latitude-mapMinSpan/2, latitude+mapMinSpan/2
+		m.minLong, m.maxLong = longitude-mapMinSpan/2, longitude+mapMinSpan/2
+		m.empty = false
+		return
+	}
+
+	if latitude < m.minLat {
+		m.minLat = latitude
+	} else if latitude > m.maxLat {
+		m.maxLat = latitude
+	}
+
+	if longitude < m.minLong {
+		m.minLong = longitude
+	} else if longitude > m.maxLong {
+		m.maxLong = longitude
+	}
+}
+
+// This function converts a position into a (row, column) grid cell. Row 0 is the northern edge of
+// the map. Positions outside the bounds are clamped to the nearest edge.
+func (m *asciiMap) cell(latitude, longitude float64) (int, int) {
+	row := int((m.maxLat - latitude) / (m.maxLat - m.minLat) * float64(mapHeight-1))
+	col := int((longitude - m.minLong) / (m.maxLong - m.minLong) * float64(mapWidth-1))
+
+	if row < 0 {
+		row = 0
+	} else if row > mapHeight-1 {
+		row = mapHeight - 1
+	}
+
+	if col < 0 {
+		col = 0
+	} else if col > mapWidth-1 {
+		col = mapWidth - 1
+	}
+
+	return row, col
+}
+
+// This function clears the terminal and redraws the map. Previous positions in the track are
+// drawn as '.' characters, the current position as '@'.
+func (m *asciiMap) draw(status string) {
+	grid := make([][]byte, mapHeight)
+	for i := range grid {
+		grid[i] = []byte(strings.Repeat(" ", mapWidth))
+	}
+
+	for _, point := range m.track {
+		row, col := m.cell(point[0], point[1])
+		grid[row][col] = '.'
+	}
+
+	if len(m.track) > 0 {
+		current := m.track[(m.next+len(m.track)-1)%len(m.track)]
+		row, col := m.cell(current[0], current[1])
+		grid[row][col] = '@'
+	}
+
+	var builder strings.Builder
+
+	// Move the cursor to the top-left corner and clear the screen.
+	builder.WriteString("\033[H\033[2J")
+
+	border := "+" + strings.Repeat("-", mapWidth) + "+\n"
+	builder.WriteString(fmt.Sprintf("N: %.6f\n", m.maxLat))
+	builder.WriteString(border)
+	for _, line := range grid {
+		builder.WriteString("|" + string(line) + "|\n")
+	}
+	builder.WriteString(border)
+	builder.WriteString(fmt.Sprintf("S: %.6f    W: %.6f    E: %.6f\n", m.minLat, m.minLong, m.maxLong))
+	builder.WriteString(status + "\n")
+
+	fmt.Print(builder.String())
+}
+
+// This function returns true if the file is attached to a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
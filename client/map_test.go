@@ -0,0 +1,32 @@
+package main
+
+import "strings"
+import "testing"
+
+func TestASCIIMapTrackIsCapped(t *testing.T) {
+	m := newASCIIMap(true, 53, -6, 54, -5)
+
+	// The vehicle drives north across the map, then back to its starting position.
+	var output string
+	for i := 0; i <= mapTrackLength; i++ {
+		latitude := 53 + float64(i%mapTrackLength)/mapTrackLength
+		output = captureStdout(t, func() {
+			m.update(latitude, -5.5, "status")
+		})
+	}
+
+	if len(m.track) != mapTrackLength {
+		t.Fatalf("expected the track to be capped at %d positions, found %d", mapTrackLength, len(m.track))
+	}
+
+	// The current position has overwritten the oldest in the ring. It's back at the bottom of the
+	// grid while the position before it in the track is at the top.
+	lines := strings.Split(output, "\n")
+	bottom := lines[2+mapHeight-1]
+	if !strings.Contains(bottom, "@") {
+		t.Errorf("expected the current position on the bottom row, found '%s'", bottom)
+	}
+	if strings.Count(output, "@") != 1 {
+		t.Errorf("expected exactly one current position in:\n%s", output)
+	}
+}
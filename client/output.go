@@ -0,0 +1,93 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "sync"
+import "time"
+
+// If a consumer doesn't accept a write within this time we assume it's stuck and disconnect it
+// rather than stall the client.
+const outputWriteTimeout = time.Second
+
+// This type is a Unix domain socket which local consumers, e.g. a dashboard, can connect to for a
+// copy of the update feed. Each update is written to every connected consumer as a single line.
+// Consumers can connect and disconnect at any time.
+type outputSocket struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+}
+
+// This function creates a Unix domain socket at the specified path and starts accepting consumers.
+// A stale socket file left behind by a previous run is removed; any other file at the path is an
+// error.
+func openOutputSocket(path string) (*outputSocket, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and isn't a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &outputSocket{listener: listener}
+	go output.accept()
+
+	return output, nil
+}
+
+// This function accepts new consumers until the socket is closed.
+func (o *outputSocket) accept() {
+	for {
+		conn, err := o.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to accept output socket consumer.\n  -->  %s\n", err.Error())
+			continue
+		}
+
+		o.mutex.Lock()
+		o.conns = append(o.conns, conn)
+		o.mutex.Unlock()
+	}
+}
+
+// This function writes a line to every connected consumer. Consumers which fail to accept the
+// write are disconnected; they can simply reconnect.
+func (o *outputSocket) write(line string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var remaining []net.Conn
+	for _, conn := range o.conns {
+		conn.SetWriteDeadline(time.Now().Add(outputWriteTimeout))
+		_, err := conn.Write([]byte(line + "\n"))
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		remaining = append(remaining, conn)
+	}
+	o.conns = remaining
+}
+
+// This function closes the socket and disconnects every consumer. Closing the listener removes
+// the socket file.
+func (o *outputSocket) close() {
+	o.listener.Close()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, conn := range o.conns {
+		conn.Close()
+	}
+	o.conns = nil
+}
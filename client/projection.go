@@ -0,0 +1,106 @@
+package main
+
+import "fmt"
+import "math"
+
+// Parameters of the WGS84 ellipsoid.
+const wgs84SemiMajorAxis = 6378137.0
+const wgs84Flattening = 1 / 298.257223563
+
+// This function formats a position for display using the specified projection: "none" for raw
+// latitude/longitude, "webmercator" for Web Mercator (EPSG:3857) x/y coordinates in meters, or
+// "utm" for UTM easting/northing in meters with the zone number and hemisphere.
+func formatPosition(latitude, longitude float64, projection string) string {
+	switch projection {
+	case "webmercator":
+		x, y := toWebMercator(latitude, longitude)
+		return fmt.Sprintf("(%.2f, %.2f)", x, y)
+	case "utm":
+		easting, northing, zone, hemisphere := toUTM(latitude, longitude)
+		return fmt.Sprintf("(%.2f, %.2f %d%s)", easting, northing, zone, hemisphere)
+	default:
+		return fmt.Sprintf("(%.6f, %.6f)", latitude, longitude)
+	}
+}
+
+// This function returns true if the projection name is valid.
+func isValidProjection(projection string) bool {
+	return projection == "none" || projection == "webmercator" || projection == "utm"
+}
+
+// This function converts latitude and longitude in degrees to Web Mercator x and y coordinates in
+// meters. Web Mercator treats the earth as a sphere and can't represent the poles so latitudes are
+// clamped to the usual limit of approx +/- 85.05 degrees.
+// Ref: https://epsg.io/3857
+func toWebMercator(latitude, longitude float64) (float64, float64) {
+	const maxLatitude = 85.05112878
+
+	if latitude > maxLatitude {
+		latitude = maxLatitude
+	} else if latitude < -maxLatitude {
+		latitude = -maxLatitude
+	}
+
+	phi := latitude * math.Pi / 180.0
+	lambda := longitude * math.Pi / 180.0
+
+	x := wgs84SemiMajorAxis * lambda
+	y := wgs84SemiMajorAxis * math.Log(math.Tan(math.Pi/4+phi/2))
+
+	return x, y
+}
+
+// This function converts latitude and longitude in degrees to UTM coordinates on the WGS84
+// ellipsoid. It returns the easting and northing in meters, the zone number, and the hemisphere
+// ("N" or "S"). We use the standard 6-degree zones and ignore the special cases around Norway and
+// Svalbard. The series expansion is accurate to within a millimeter or so inside the zone.
+// Ref: Snyder, Map Projections -- A Working Manual, USGS Professional Paper 1395, pp. 61-64.
+func toUTM(latitude, longitude float64) (float64, float64, int, string) {
+	const k0 = 0.9996
+
+	zone := int(math.Floor((longitude+180)/6)) + 1
+	if zone > 60 {
+		zone = 60
+	}
+
+	// The central meridian of the zone.
+	lambda0 := float64((zone-1)*6-180+3) * math.Pi / 180.0
+
+	phi := latitude * math.Pi / 180.0
+	lambda := longitude * math.Pi / 180.0
+
+	e2 := wgs84Flattening * (2 - wgs84Flattening)
+	e4 := e2 * e2
+	e6 := e4 * e2
+	ep2 := e2 / (1 - e2)
+
+	sinPhi := math.Sin(phi)
+	cosPhi := math.Cos(phi)
+	tanPhi := math.Tan(phi)
+
+	n := wgs84SemiMajorAxis / math.Sqrt(1-e2*sinPhi*sinPhi)
+	t := tanPhi * tanPhi
+	c := ep2 * cosPhi * cosPhi
+	a := cosPhi * (lambda - lambda0)
+
+	// The true distance along the central meridian from the equator.
+	m := wgs84SemiMajorAxis * ((1-e2/4-3*e4/64-5*e6/256)*phi -
+		(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*phi) +
+		(15*e4/256+45*e6/1024)*math.Sin(4*phi) -
+		(35*e6/3072)*math.Sin(6*phi))
+
+	easting := k0*n*(a+(1-t+c)*math.Pow(a, 3)/6+
+		(5-18*t+t*t+72*c-58*ep2)*math.Pow(a, 5)/120) + 500000
+
+	northing := k0 * (m + n*tanPhi*(a*a/2+
+		(5-t+9*c+4*c*c)*math.Pow(a, 4)/24+
+		(61-58*t+t*t+600*c-330*ep2)*math.Pow(a, 6)/720))
+
+	hemisphere := "N"
+	if latitude < 0 {
+		northing += 10000000
+		hemisphere = "S"
+	}
+
+	return easting, northing, zone, hemisphere
+}
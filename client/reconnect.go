@@ -0,0 +1,148 @@
+package main
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "runtime"
+import "sync/atomic"
+import "syscall"
+import "time"
+
+// If the listening socket fails with a fatal read error, we re-create it and resubscribe up to
+// this many times in a row before giving up. The count resets once a packet arrives on the new
+// socket. Set by --listen-retries.
+var listenRetries int
+
+// The error returned by the listening loop when the socket fails and can't be read from again.
+var errListenerFailed = errors.New("listener failed")
+
+// Windows reports an ICMP port unreachable message from an earlier send as WSAECONNRESET on the
+// next read from a UDP socket. The syscall package doesn't define it so we hardcode the value
+// from the system headers.
+const wsaeconnreset = syscall.Errno(10054)
+
+// This function returns true if a read error only affects the current read, so the socket can be
+// read from again, e.g. a timeout or an ICMP error from an earlier send to a server that wasn't
+// running. Any other error means the socket itself has failed. We check for the specific errors
+// rather than using net.Error's Temporary() method as it's deprecated and unreliable.
+func isRecoverableReadError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ENOBUFS) {
+		return true
+	}
+
+	return runtime.GOOS == "windows" && errors.Is(err, wsaeconnreset)
+}
+
+// This function returns how long to wait before reading again after the specified number of
+// consecutive recoverable read errors, so a socket which keeps failing can't spin the CPU. The
+// delay starts at 10ms and doubles with each failure up to a maximum of 1s.
+func readBackoff(failures int) time.Duration {
+	delay := 10 * time.Millisecond
+	for i := 1; i < failures && delay < time.Second; i++ {
+		delay *= 2
+	}
+	if delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// This function returns how long to wait before the specified reconnect attempt. The delay starts
+// at 1s and doubles with each attempt up to a maximum of 30s.
+func reconnectDelay(attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < 30*time.Second; i++ {
+		delay *= 2
+	}
+	if delay > 30*time.Second {
+		delay = 30 * time.Second
+	}
+	return delay
+}
+
+// This function runs the listening loop on the listener. If the listener fails, it re-creates it
+// on the same local address, falling back to the next free port as on startup, and resends the
+// subscription message so the server sends updates to the new socket. It gives up after
+// [listenRetries] failed attempts in a row. The function takes ownership of the listener and
+// closes it, and any replacement, before returning.
+func listenWithReconnect(ctx context.Context, listener *net.UDPConn, localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, subscription string) error {
+	attempt := 0
+
+	for {
+		// Closing the listener when the context is cancelled unblocks the listening loop.
+		stop := closeOnCancel(ctx, listener)
+		err := listen(listener, remoteAddr)
+		stop()
+		listener.Close()
+
+		if ctx.Err() != nil || !errors.Is(err, errListenerFailed) {
+			return err
+		}
+
+		// The listener received packets before it failed so this is a new run of failures.
+		if atomic.SwapInt32(&subscriptionConfirmed, 0) == 1 {
+			attempt = 0
+		}
+
+		listener, err = reconnect(ctx, localAddr, remoteAddr, subscription, err, &attempt)
+		if listener == nil {
+			return err
+		}
+
+		if subscribeRetries > 0 {
+			go resendSubscription(listener, subscription, remoteAddr)
+		}
+	}
+}
+
+// This function re-creates the listener and resends the subscription message, backing off between
+// attempts. The cause is the error which made the previous listener fail. It returns a nil
+// listener and the last error once the attempts are used up, or a nil listener and a nil error if
+// the context is cancelled.
+func reconnect(ctx context.Context, localAddr *net.UDPAddr, remoteAddr *net.UDPAddr, subscription string, cause error, attempt *int) (*net.UDPConn, error) {
+	for {
+		*attempt++
+		if *attempt > listenRetries {
+			return nil, cause
+		}
+
+		delay := reconnectDelay(*attempt)
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", cause.Error())
+		fmt.Printf("Reconnect: re-creating the listener in %s (attempt %d/%d).\n", delay, *attempt, listenRetries)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil
+		case <-timer.C:
+		}
+
+		listener, err := listenClientUDP(localAddr)
+		if err != nil {
+			cause = fmt.Errorf("unable to re-create listener on address '%s': %w", localAddr, err)
+			continue
+		}
+
+		_, err = listener.WriteTo([]byte(subscription), remoteAddr)
+		if err != nil {
+			listener.Close()
+			cause = fmt.Errorf("failed to resend subscription packet: %w", err)
+			continue
+		}
+
+		fmt.Printf("Reconnect: listening on %s.\n", localAddr)
+		return listener, nil
+	}
+}
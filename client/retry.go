@@ -0,0 +1,33 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "sync/atomic"
+import "time"
+
+// Set to 1 by the listening loop when the first packet arrives from the server. We use an atomic
+// here as the flag is read by the retry goroutine.
+var subscriptionConfirmed int32
+
+// This function resends the subscription message every [subscribeRetryInterval] until the first
+// packet arrives from the server or we've made [subscribeRetries] attempts. The server replaces an
+// existing subscription from the same address so a resent packet can't double up updates.
+func resendSubscription(conn packetConn, message string, remoteAddr net.Addr) {
+	for attempt := 1; attempt <= subscribeRetries; attempt++ {
+		time.Sleep(subscribeRetryInterval)
+		if atomic.LoadInt32(&subscriptionConfirmed) == 1 {
+			return
+		}
+
+		fmt.Printf("Retry: resending subscription (attempt %d/%d).\n", attempt, subscribeRetries)
+		_, err := conn.WriteTo([]byte(message), remoteAddr)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to resend subscription packet.\n  -->  %s\n", err.Error())
+		}
+	}
+}
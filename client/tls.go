@@ -0,0 +1,78 @@
+package main
+
+import "bufio"
+import "context"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "time"
+
+// This function loads a PEM-encoded CA certificate file and returns a TLS configuration which only
+// trusts certificates signed by that CA. The server's certificate must be valid for serverName.
+func loadTLSConfig(caFile string, serverName string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in '%s'", caFile)
+	}
+
+	config := &tls.Config{
+		RootCAs:    pool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return config, nil
+}
+
+// The client connects to the server over TLS, sends a SUBSCRIBE packet, then reads update packets
+// from the connection. Packets are newline-delimited but otherwise have the same format as our UDP
+// packets. Like runClient, the function returns nil when the context is cancelled or the server
+// shuts down. The server closing the connection is an error.
+func runTLSSubscription(ctx context.Context, remoteAddr *net.UDPAddr, subscription string, config *tls.Config) error {
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", remoteAddr.String())
+	if err != nil {
+		return fmt.Errorf("unable to establish TLS connection to '%s': %w", remoteAddr, err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(subscription + "\n"))
+	if err != nil {
+		return fmt.Errorf("failed to send subscription packet: %w", err)
+	}
+
+	// Closing the connection when the context is cancelled unblocks the scanner.
+	stop := closeOnCancel(ctx, conn)
+	defer stop()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if capturing != nil {
+			capturing.record(time.Now(), conn.RemoteAddr(), scanner.Bytes())
+		}
+
+		err := handleFeedPacket(conn.RemoteAddr(), scanner.Text())
+		if errors.Is(err, errServerShutdown) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("TLS connection failed: %w", err)
+	}
+	return errors.New("the server closed the TLS connection")
+}
@@ -0,0 +1,68 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "runtime"
+import "syscall"
+
+// A packetConn sends and receives packets. This is the subset of the net.PacketConn interface we
+// actually use, which lets us swap the real UDP transport for an in-memory transport in tests.
+type packetConn interface {
+	ReadFrom(buffer []byte) (int, net.Addr, error)
+	WriteTo(message []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+// If the client's port is already in use, e.g. by another client, we try up to this many of the
+// following port numbers before giving up.
+const maxPortFallbacks = 10
+
+// Windows reports a port in use as WSAEADDRINUSE rather than EADDRINUSE. The syscall package
+// doesn't define it so we hardcode the value from the system headers.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// This function returns true if the error is the result of trying to listen on an address that's
+// already in use.
+func isAddrInUse(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true
+	}
+	return runtime.GOOS == "windows" && errors.Is(err, wsaeaddrinuse)
+}
+
+// This function listens for UDP packets on the client's address. If the port is already in use it
+// falls back to the next free port number and updates the address in place so the caller reports
+// the port actually used.
+func listenClientUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	requested := addr.Port
+
+	for i := 0; i <= maxPortFallbacks; i++ {
+		candidate := *addr
+		candidate.Port = requested + i
+		if candidate.Port > 65535 {
+			break
+		}
+
+		conn, err := net.ListenUDP("udp", &candidate)
+		if isAddrInUse(err) && requested != 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if candidate.Port != requested {
+			fmt.Fprintf(os.Stderr, "Port %d already in use; listening on port %d instead.\n", requested, candidate.Port)
+		}
+		addr.Port = candidate.Port
+		return conn, nil
+	}
+
+	last := requested + maxPortFallbacks
+	if last > 65535 {
+		last = 65535
+	}
+	return nil, fmt.Errorf("ports %d-%d already in use; are other clients running? try --client-port", requested, last)
+}
@@ -0,0 +1,100 @@
+package main
+
+import "compress/gzip"
+import "encoding/csv"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "time"
+
+// This type is a location waiting to be written to the archive.
+type archiveEntry struct {
+	key      vehicleKey
+	location location
+}
+
+// This function writes the store's pending archive entries to disk every interval until the done
+// channel is closed, then writes any remaining entries and returns.
+func runArchiver(store *fleetStore, dir string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			flushArchive(store, dir)
+		case <-done:
+			flushArchive(store, dir)
+			return
+		}
+	}
+}
+
+// This function writes the store's pending archive entries to a new gzip-compressed CSV file in
+// the archive directory. We only hold the store's lock while we take the pending entries so
+// writing to disk doesn't block packet handling.
+func flushArchive(store *fleetStore, dir string) {
+	store.mutex.Lock()
+	entries := store.archive
+	store.archive = nil
+	store.mutex.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	path, err := writeArchive(dir, entries, store.clock().UTC())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write archive.\n  -->  %s\n", err.Error())
+		return
+	}
+
+	if loadSettings().verbose {
+		fmt.Printf("Archived %d locations to %s.\n", len(entries), path)
+	}
+}
+
+// This function writes the entries to a file named for the flush time. Each file is a gzipped CSV
+// file with the columns: timestamp, fleet, vin, latitude, longitude. We write to a temporary file
+// and rename it so a reader never sees a partially written archive.
+func writeArchive(dir string, entries []archiveEntry, now time.Time) (string, error) {
+	name := "fleet-" + now.Format("20060102T150405.000000000Z") + ".csv.gz"
+	path := filepath.Join(dir, name)
+
+	file, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	defer os.Remove(file.Name())
+
+	compressor := gzip.NewWriter(file)
+	writer := csv.NewWriter(compressor)
+
+	writer.Write([]string{"timestamp", "fleet", "vin", "latitude", "longitude"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			entry.location.timestamp.Format(time.RFC3339Nano),
+			entry.key.namespace,
+			entry.key.vin,
+			strconv.FormatFloat(entry.location.latitude, 'f', 6, 64),
+			strconv.FormatFloat(entry.location.longitude, 'f', 6, 64),
+		})
+	}
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(file.Name(), path)
+}
@@ -0,0 +1,91 @@
+package main
+
+import "fmt"
+import "strconv"
+import "strings"
+import "time"
+
+// A speed band is a named range of speeds. Each band starts at its minimum speed in meters per
+// second and runs up to the next band's minimum.
+type speedBand struct {
+	name string
+	min  float64
+}
+
+// This function parses a speed bands string with the format: [<name>:<min>,<name>:<min>,...].
+// The bands must be listed in increasing order of speed and the first band must start at zero.
+func parseSpeedBands(arg string) ([]speedBand, error) {
+	var bands []speedBand
+	for _, element := range strings.Split(arg, ",") {
+		index := strings.Index(element, ":")
+		if index < 1 {
+			return nil, fmt.Errorf("invalid band '%s', expected '<name>:<min>'", element)
+		}
+
+		min, err := strconv.ParseFloat(element[index+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid band '%s': %w", element, err)
+		}
+
+		if len(bands) == 0 && min != 0 {
+			return nil, fmt.Errorf("the first band must start at 0")
+		}
+		if len(bands) > 0 && min <= bands[len(bands)-1].min {
+			return nil, fmt.Errorf("bands must be listed in increasing order of speed")
+		}
+
+		bands = append(bands, speedBand{name: element[:index], min: min})
+	}
+
+	return bands, nil
+}
+
+// This function returns the name of the --speed-bands band containing the specified speed.
+func bandFor(speed float64) string {
+	bands := loadSettings().speedBands
+
+	name := bands[0].name
+	for _, band := range bands {
+		if speed >= band.min {
+			name = band.name
+		}
+	}
+	return name
+}
+
+// This function returns a band update packet for a subscriber which only wants to hear about
+// changes in the vehicle's speed band. The packet has the format: [BAND <timestamp> <vin> <from>
+// <to> <speed> [fleet=<name>]], where from is [none] for the subscriber's first band update. The
+// function also returns the vehicle's current band, and false if the band hasn't changed since the
+// subscriber's last update or the vehicle's speed is unknown, in which case nothing should be sent.
+func formatBandUpdate(store *fleetStore, key vehicleKey, sub *subscriber) (string, string, bool) {
+	entries := store.fleet[key]
+	speed := computeSpeed(entries.LastN(2))
+	if speed < 0 {
+		return "", "", false
+	}
+
+	band := bandFor(speed)
+	if band == sub.band {
+		return "", band, false
+	}
+
+	from := sub.band
+	if from == "" {
+		from = "none"
+	}
+
+	message := fmt.Sprintf(
+		"BAND %s %s %s %s %.*f",
+		entries.Last().timestamp.Format(time.RFC3339Nano),
+		key.vin,
+		from,
+		band,
+		loadSettings().speedPrecision,
+		speed)
+	if key.namespace != "" {
+		message += " fleet=" + key.namespace
+	}
+
+	return message, band, true
+}
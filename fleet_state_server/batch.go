@@ -0,0 +1,133 @@
+package main
+
+import "context"
+import "fmt"
+import "os"
+import "strings"
+import "time"
+
+// How often we check for batches which are due to be flushed. This limits the precision of the
+// batch interval.
+const batchTick = 100 * time.Millisecond
+
+// The longest batch interval a subscriber can request.
+const maxBatchInterval = time.Minute
+
+// This function flushes subscribers' batched updates every [batchTick] until ctx is cancelled.
+func runBatchFlusher(ctx context.Context, store *fleetStore) {
+	ticker := time.NewTicker(batchTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			store.mutex.Lock()
+			flushBatches(store, store.clock(), false)
+			store.mutex.Unlock()
+		}
+	}
+}
+
+// A batchedUpdate is an update held for a batching subscriber. We keep the vehicle's key so the
+// delivery statistics are credited to the vehicle, even for wildcard subscribers.
+type batchedUpdate struct {
+	key     vehicleKey
+	message string
+}
+
+// A batchPacket is a packet of newline-delimited batched updates, with the keys of the vehicles
+// the updates describe.
+type batchPacket struct {
+	text string
+	keys []vehicleKey
+}
+
+// This function sends each batching subscriber the updates it has accumulated, if its batch
+// interval has elapsed or force is true. The updates are newline-delimited and packed into as few
+// packets as possible. Packets larger than [compressThreshold] are compressed if the subscriber
+// has requested compression. Each update counts as a send in its vehicle's delivery statistics,
+// just as if it had been sent on its own. The caller must hold the store's mutex.
+func flushBatches(store *fleetStore, now time.Time, force bool) {
+	settings := loadSettings()
+
+	for key, subs := range store.subscribers {
+		var remaining []*subscriber
+		for _, sub := range subs {
+			if sub.batch == 0 || len(sub.pending) == 0 || (!force && now.Sub(sub.batchStart) < sub.batch) {
+				remaining = append(remaining, sub)
+				continue
+			}
+
+			for _, packet := range packBatch(sub.pending) {
+				text := packet.text
+				if sub.compress && len(text) > compressThreshold {
+					compressed, err := compressPacket(text)
+					if err == nil && len(compressed) < len(text) {
+						text = compressed
+					}
+				}
+
+				err := sub.peer.send(text)
+				for _, updateKey := range packet.keys {
+					stats := store.deliveryStatsFor(updateKey)
+					stats.total++
+					if err != nil {
+						stats.failed++
+					} else {
+						stats.lastSent = now
+					}
+				}
+				if err != nil {
+					sub.failures++
+					fmt.Fprintf(os.Stderr, "Error: failed to send batched updates.\n  -->  %s\n", err.Error())
+				} else {
+					sub.failures = 0
+				}
+			}
+			sub.pending = nil
+
+			if settings.maxSendFailures > 0 && sub.failures >= settings.maxSendFailures {
+				fmt.Fprintf(
+					os.Stderr,
+					"Evicted subscriber '%s' from %s after %d failed sends.\n",
+					sub.peer,
+					key,
+					sub.failures)
+				continue
+			}
+
+			remaining = append(remaining, sub)
+		}
+
+		store.setSubscribers(key, remaining)
+	}
+}
+
+// This function packs a list of updates into newline-delimited packets no larger than
+// [maxPacketSize].
+func packBatch(updates []batchedUpdate) []batchPacket {
+	var packets []batchPacket
+	var builder strings.Builder
+	var keys []vehicleKey
+
+	for _, update := range updates {
+		if builder.Len() > 0 && builder.Len()+1+len(update.message) > maxPacketSize {
+			packets = append(packets, batchPacket{text: builder.String(), keys: keys})
+			builder.Reset()
+			keys = nil
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(update.message)
+		keys = append(keys, update.key)
+	}
+
+	if builder.Len() > 0 {
+		packets = append(packets, batchPacket{text: builder.String(), keys: keys})
+	}
+
+	return packets
+}
@@ -0,0 +1,56 @@
+package main
+
+import "strings"
+import "testing"
+import "time"
+
+func TestFlushBatchesCreditsEachVehicle(t *testing.T) {
+	store := newTestStore(t)
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+	vehicle := packetPeer{conn: server, addr: memoryAddr("vehicle")}
+
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE * batch=5s", store)
+
+	handlePacket(vehicle, testPacket("VIN1", -time.Second, "53.000000", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN1", 0, "53.000100", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN2", 0, "54.000000", "-6.000000"), store)
+	flushBatches(store, testNow, true)
+
+	packets := watcher.pending()
+	if len(packets) != 1 || len(strings.Split(packets[0], "\n")) != 3 {
+		t.Fatalf("expected a single packet of 3 updates, found %q", packets)
+	}
+
+	// The updates are credited to the vehicles they describe, as if sent unbatched.
+	for vin, expected := range map[string]int{"VIN1": 2, "VIN2": 1} {
+		stats := store.stats[vehicleKey{vin: vin}]
+		if stats == nil || stats.total != expected || stats.failed != 0 || !stats.lastSent.Equal(testNow) {
+			t.Errorf("expected %d sends to %s, found %+v", expected, vin, stats)
+		}
+	}
+	if stats, found := store.stats[wildcardKey("")]; found {
+		t.Errorf("expected no statistics for the wildcard key, found %+v", stats)
+	}
+}
+
+func TestPackBatchSplitsAtMaxPacketSize(t *testing.T) {
+	line := strings.Repeat("x", maxPacketSize/2+1)
+	updates := []batchedUpdate{
+		{key: vehicleKey{vin: "VIN1"}, message: line},
+		{key: vehicleKey{vin: "VIN2"}, message: line},
+		{key: vehicleKey{vin: "VIN3"}, message: "short"},
+	}
+
+	packets := packBatch(updates)
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, found %d", len(packets))
+	}
+	if packets[0].text != line || len(packets[0].keys) != 1 || packets[0].keys[0].vin != "VIN1" {
+		t.Errorf("unexpected first packet with keys %v", packets[0].keys)
+	}
+	if packets[1].text != line+"\nshort" || len(packets[1].keys) != 2 || packets[1].keys[1].vin != "VIN3" {
+		t.Errorf("unexpected second packet with keys %v", packets[1].keys)
+	}
+}
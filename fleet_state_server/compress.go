@@ -0,0 +1,27 @@
+package main
+
+import "bytes"
+import "compress/gzip"
+
+// Batch packets larger than this many bytes are gzip-compressed for subscribers which request
+// compression. A packet this size fits in a single Ethernet frame without IP fragmentation.
+const compressThreshold = 1200
+
+// This function gzip-compresses a packet's payload. Clients recognise a compressed packet by the
+// gzip magic number, [0x1f 0x8b], which can never begin a text packet.
+func compressPacket(packet string) (string, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+
+	_, err := writer.Write([]byte(packet))
+	if err != nil {
+		return "", err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import "bufio"
+import "context"
+import "flag"
+import "fmt"
+import "os"
+import "os/signal"
+import "strings"
+import "sync/atomic"
+import "syscall"
+import "time"
+
+// These options can be changed at runtime by editing the --config file and sending the server a
+// SIGHUP signal. Every other option requires a restart, e.g. the listen address, the TLS
+// certificate, or the history size.
+var reloadableOptions = map[string]bool{
+	"include-odometer":      true,
+	"max-bandwidth":         true,
+	"max-clock-skew":        true,
+	"max-packet-age":        true,
+	"max-send-failures":     true,
+	"max-total-subscribers": true,
+	"no-speed":              true,
+	"precision":             true,
+	"server-timestamps":     true,
+	"speed-bands":           true,
+	"speed-deadband":        true,
+	"speed-precision":       true,
+	"strict":                true,
+	"verbose":               true,
+}
+
+// The options set explicitly on the command line. These take precedence over the config file,
+// both on startup and on reload.
+var commandLineOptions = map[string]bool{}
+
+// The settings which can be reloaded at runtime. Packet handlers, the HTTP API, and the TLS
+// writers all read the settings concurrently with a reload so they never read these fields
+// directly. Instead, each reload builds a complete new set of settings and publishes it with a
+// single atomic store, and readers call loadSettings() to get the current set. A reader which needs
+// more than one setting should call loadSettings() once so it sees a consistent set.
+type serverSettings struct {
+	// If set to true the server prints a log of all incoming packets.
+	verbose bool
+
+	// If set to true, the server replies to packets with an unknown command word with an
+	// [ERROR unknown-command] packet instead of dropping them silently.
+	strict bool
+
+	// Vehicle packets with timestamps further than this in the future are rejected. A wildly
+	// future timestamp would break the speed calculation for every subsequent update as newer
+	// packets would be discarded as out-of-order. A value of zero means no limit.
+	maxClockSkew time.Duration
+
+	// Vehicle packets with timestamps older than this are dropped as stale, e.g. a backlog flushed
+	// by a vehicle reconnecting after a long offline period. A value of zero means no limit.
+	maxPacketAge time.Duration
+
+	// If set to true, we include each vehicle's odometer reading in subscriber updates.
+	includeOdometer bool
+
+	// We remove a subscriber after this many consecutive failed sends. Zero means never.
+	maxSendFailures int
+
+	// The maximum number of subscriptions across all vehicles. This protects the server's memory
+	// and limits the cost of fanning out updates. Zero means no limit.
+	maxTotalSubscribers int
+
+	// The maximum bandwidth in bytes per second for each subscriber. Zero means no limit.
+	maxBandwidth int
+
+	// If set to true, we timestamp vehicle packets on arrival rather than trusting the vehicle's
+	// clock.
+	serverTimestamps bool
+
+	// If set to true, we skip the speed calculation and omit the speed field from update packets.
+	noSpeed bool
+
+	// Calculated speeds below this value in m/s are reported as exactly zero. GPS noise gives a
+	// stationary vehicle small nonzero speeds which would otherwise flap around zero.
+	speedDeadband float64
+
+	// The speed bands for subscribers which only want to hear about band changes, parsed from the
+	// --speed-bands argument.
+	bandsArg   string
+	speedBands []speedBand
+
+	// The number of decimal places for coordinates and speeds in update packets. Six decimal
+	// places of latitude/longitude gives us accuracy to within about 11cm.
+	coordinatePrecision int
+	speedPrecision      int
+}
+
+// The flag package writes the reloadable options into this struct. Only main() and the config
+// reloader touch it; everything else reads the published copy.
+var flagSettings serverSettings
+
+// The current settings, a *serverSettings.
+var currentSettings atomic.Value
+
+// This function returns the current settings. The caller must not modify them.
+func loadSettings() *serverSettings {
+	return currentSettings.Load().(*serverSettings)
+}
+
+// This function checks the reloadable options in [flagSettings] and, if they're valid, publishes
+// a copy as the current settings. It's used both on startup and on reload so the two can't
+// disagree about what's valid.
+func publishSettings() error {
+	settings := flagSettings
+
+	if settings.coordinatePrecision < 0 || settings.coordinatePrecision > 9 ||
+		settings.speedPrecision < 0 || settings.speedPrecision > 9 {
+		return fmt.Errorf("the precision must be in the range [0, 9]")
+	}
+
+	if settings.maxClockSkew < 0 || settings.maxPacketAge < 0 {
+		return fmt.Errorf("the maximum clock skew and packet age must not be negative")
+	}
+
+	if settings.maxSendFailures < 0 {
+		return fmt.Errorf("the maximum number of send failures must not be negative")
+	}
+
+	if settings.maxTotalSubscribers < 0 {
+		return fmt.Errorf("the maximum number of subscribers must not be negative")
+	}
+
+	if settings.maxBandwidth < 0 {
+		return fmt.Errorf("the maximum bandwidth must not be negative")
+	}
+
+	if settings.speedDeadband < 0 {
+		return fmt.Errorf("the speed deadband must not be negative")
+	}
+
+	bands, err := parseSpeedBands(settings.bandsArg)
+	if err != nil {
+		return fmt.Errorf("invalid speed bands '%s': %w", settings.bandsArg, err)
+	}
+	settings.speedBands = bands
+
+	currentSettings.Store(&settings)
+	return nil
+}
+
+// A single option from the config file.
+type configEntry struct {
+	line  int
+	name  string
+	value string
+}
+
+// This function reads a config file. The file contains one option per line in the format:
+// [<name> <value>], where name is the option's name without the leading dashes, e.g.
+// [max-bandwidth 10000]. A flag can be listed on its own to turn it on. Blank lines and lines
+// beginning with '#' are ignored.
+func readConfigFile(path string) ([]configEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []configEntry
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := line, "true"
+		if index := strings.IndexAny(line, " \t"); index >= 0 {
+			name, value = line[:index], strings.TrimSpace(line[index:])
+		}
+
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("line %d: unknown option '%s'", lineNumber, name)
+		}
+
+		entries = append(entries, configEntry{lineNumber, name, value})
+	}
+
+	return entries, scanner.Err()
+}
+
+// This function applies the options in the config file on startup. Options set on the command line
+// take precedence.
+func applyConfigFile(path string) error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineOptions[f.Name] = true
+	})
+
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if commandLineOptions[entry.name] {
+			continue
+		}
+		err := flag.Set(entry.name, entry.value)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid value for '%s': %w", entry.line, entry.name, err)
+		}
+	}
+
+	return nil
+}
+
+// This function re-reads the config file and applies any changes to the reloadable options. Each
+// reloadable option which isn't set on the command line is first reset to its default, so removing
+// an option from the file has the same effect as it would on a restart. The new settings are
+// published in a single step so readers never see a half-applied config. If the new config is
+// invalid, we keep the previous settings and return an error. Only one reload runs at a time.
+func reloadConfigFile(path string) error {
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	previous := flagSettings
+
+	for name := range reloadableOptions {
+		if commandLineOptions[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		err := f.Value.Set(f.DefValue)
+		if err != nil {
+			flagSettings = previous
+			return fmt.Errorf("unable to reset '%s' to its default: %w", name, err)
+		}
+	}
+
+	for _, entry := range entries {
+		if commandLineOptions[entry.name] {
+			continue
+		}
+
+		if !reloadableOptions[entry.name] {
+			changed, err := requiresRestart(flag.Lookup(entry.name), entry.value)
+			if err != nil {
+				flagSettings = previous
+				return fmt.Errorf("line %d: invalid value for '%s': %w", entry.line, entry.name, err)
+			}
+			if changed {
+				fmt.Fprintf(os.Stderr, "Warning: changing '%s' requires a restart.\n", entry.name)
+			}
+			continue
+		}
+
+		err := flag.Set(entry.name, entry.value)
+		if err != nil {
+			flagSettings = previous
+			return fmt.Errorf("line %d: invalid value for '%s': %w", entry.line, entry.name, err)
+		}
+	}
+
+	err = publishSettings()
+	if err != nil {
+		flagSettings = previous
+		return err
+	}
+
+	return nil
+}
+
+// This function returns true if value differs from the flag's current value. The same value can be
+// written in more than one way, e.g. a duration of "10m" is printed as "10m0s", so we parse value
+// into a fresh flag of the same type and compare the two values in their canonical form.
+func requiresRestart(f *flag.Flag, value string) (bool, error) {
+	scratch := flag.NewFlagSet(f.Name, flag.ContinueOnError)
+
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		scratch.Bool(f.Name, false, "")
+	case int:
+		scratch.Int(f.Name, 0, "")
+	case float64:
+		scratch.Float64(f.Name, 0, "")
+	case time.Duration:
+		scratch.Duration(f.Name, 0, "")
+	default:
+		scratch.String(f.Name, "", "")
+	}
+
+	err := scratch.Set(f.Name, value)
+	if err != nil {
+		return false, err
+	}
+
+	return scratch.Lookup(f.Name).Value.String() != f.Value.String(), nil
+}
+
+// This function reloads the config file each time the server receives a SIGHUP signal until ctx is
+// cancelled.
+func runConfigReloader(ctx context.Context, path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			err := reloadConfigFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: unable to reload config file '%s'.\n  -->  %s\n", path, err.Error())
+				continue
+			}
+			fmt.Printf("Reloaded config file '%s'.\n", path)
+		}
+	}
+}
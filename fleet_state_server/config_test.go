@@ -0,0 +1,133 @@
+package main
+
+import "flag"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+import "time"
+
+var defineTestFlagsOnce sync.Once
+
+// The config file tests need the server's flags, which main() normally defines. This function
+// defines the reloadable flags with the same defaults, plus --history-window as an example of an
+// option which requires a restart.
+func defineTestFlags() {
+	defineTestFlagsOnce.Do(func() {
+		flag.BoolVar(&flagSettings.verbose, "verbose", false, "")
+		flag.BoolVar(&flagSettings.strict, "strict", false, "")
+		flag.DurationVar(&flagSettings.maxClockSkew, "max-clock-skew", 0, "")
+		flag.DurationVar(&flagSettings.maxPacketAge, "max-packet-age", 0, "")
+		flag.BoolVar(&flagSettings.includeOdometer, "include-odometer", false, "")
+		flag.IntVar(&flagSettings.maxSendFailures, "max-send-failures", 5, "")
+		flag.IntVar(&flagSettings.maxTotalSubscribers, "max-total-subscribers", 0, "")
+		flag.IntVar(&flagSettings.maxBandwidth, "max-bandwidth", 0, "")
+		flag.BoolVar(&flagSettings.serverTimestamps, "server-timestamps", false, "")
+		flag.BoolVar(&flagSettings.noSpeed, "no-speed", false, "")
+		flag.Float64Var(&flagSettings.speedDeadband, "speed-deadband", 0, "")
+		flag.IntVar(&flagSettings.coordinatePrecision, "precision", 6, "")
+		flag.IntVar(&flagSettings.speedPrecision, "speed-precision", 6, "")
+		flag.StringVar(&flagSettings.bandsArg, "speed-bands", "stopped:0,slow:1,fast:10", "")
+		flag.DurationVar(&historyWindow, "history-window", 0, "")
+	})
+}
+
+// This function writes the lines to the config file.
+func writeConfigFile(t *testing.T, path string, lines string) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(lines), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequiresRestartComparesCanonicalValues(t *testing.T) {
+	defineTestFlags()
+	f := flag.Lookup("history-window")
+
+	previous := historyWindow
+	historyWindow = 10 * time.Minute
+	t.Cleanup(func() {
+		historyWindow = previous
+	})
+
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"10m", false},
+		{"600s", false},
+		{"10m0s", false},
+		{"15m", true},
+		{"0", true},
+	}
+
+	for _, test := range tests {
+		changed, err := requiresRestart(f, test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if changed != test.expected {
+			t.Errorf("%s: expected %v, found %v", test.value, test.expected, changed)
+		}
+	}
+
+	if _, err := requiresRestart(f, "soon"); err == nil {
+		t.Errorf("expected an invalid duration to be an error")
+	}
+}
+
+func TestReloadConfigFileResetsRemovedOptions(t *testing.T) {
+	defineTestFlags()
+	useTestSettings(t, nil)
+	path := filepath.Join(t.TempDir(), "server.conf")
+
+	// The clock skew is set on the command line so the file can't change it.
+	commandLineOptions["max-clock-skew"] = true
+	flagSettings.maxClockSkew = 5 * time.Second
+	t.Cleanup(func() {
+		delete(commandLineOptions, "max-clock-skew")
+	})
+
+	writeConfigFile(t, path, "max-bandwidth 1000\nmax-clock-skew 1m\nno-speed\n")
+	err := reloadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := loadSettings()
+	if settings.maxBandwidth != 1000 || !settings.noSpeed || settings.maxClockSkew != 5*time.Second {
+		t.Fatalf("unexpected settings after the first reload: %+v", settings)
+	}
+
+	// Removing an option from the file resets it to its default.
+	writeConfigFile(t, path, "no-speed\n")
+	err = reloadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings = loadSettings()
+	if settings.maxBandwidth != 0 {
+		t.Errorf("expected the bandwidth limit to be reset, found %d", settings.maxBandwidth)
+	}
+	if !settings.noSpeed {
+		t.Errorf("expected no-speed to still be set")
+	}
+	if settings.maxClockSkew != 5*time.Second {
+		t.Errorf("expected the command-line clock skew to be kept, found %s", settings.maxClockSkew)
+	}
+	if settings.maxSendFailures != 5 || settings.coordinatePrecision != 6 {
+		t.Errorf("expected options missing from the file to have their defaults, found %+v", settings)
+	}
+
+	// An invalid file leaves the previous settings in place.
+	writeConfigFile(t, path, "max-bandwidth -1\n")
+	err = reloadConfigFile(path)
+	if err == nil {
+		t.Fatalf("expected a negative bandwidth to be rejected")
+	}
+	if loadSettings() != settings || flagSettings.maxBandwidth != 0 || !flagSettings.noSpeed {
+		t.Errorf("expected a failed reload to keep the previous settings")
+	}
+}
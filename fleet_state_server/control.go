@@ -0,0 +1,85 @@
+package main
+
+import "fmt"
+import "net"
+import "os"
+import "time"
+
+// The limits for a vehicle's reporting interval in a SETRATE command.
+const minReportInterval = 100 * time.Millisecond
+const maxReportInterval = time.Hour
+
+// Vehicles which accept commands include a [control=<port>] field in their update packets. This is
+// the UDP port the vehicle listens on for commands, at the same IP address it sends its updates
+// from. This function records the vehicle's control address so we can relay commands to it. Only
+// vehicles reporting over UDP can be controlled.
+func (store *fleetStore) recordControlAddr(key vehicleKey, source peer, port int) {
+	udpSource, isUDP := source.(packetPeer)
+	if !isUDP {
+		return
+	}
+
+	addr, isUDPAddr := udpSource.addr.(*net.UDPAddr)
+	if !isUDPAddr {
+		return
+	}
+
+	store.controlPeers[key] = packetPeer{
+		conn: udpSource.conn,
+		addr: &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone},
+	}
+}
+
+// This function handles incoming SETRATE packets from clients. A SETRATE request packet is assumed
+// to have the format: [SETRATE <vin> <interval> [fleet=<name>] [token=<secret>]], where the
+// interval is a duration like "500ms" or "5s". We relay the command to the vehicle's control
+// address as [SETRATE <vin> <interval>] and reply to the sender with [SETRATE-OK <vin> <interval>].
+// We reply with [ERROR unknown-vehicle] if the vehicle hasn't sent us a control address and with
+// [ERROR invalid-interval] if the interval isn't in the range [minReportInterval,
+// maxReportInterval].
+//
+// The relayed command is a single UDP packet so it can be lost. The sender can check the
+// vehicle's update timestamps and resend the command if necessary.
+func handleSetRatePacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 3 {
+		fmt.Fprintf(os.Stderr, "Error: invalid setrate packet.\n")
+		store.recordDrop(dropInvalidPacket)
+		return
+	}
+
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
+		return
+	}
+
+	interval, err := time.ParseDuration(elements[2])
+	if err != nil || interval < minReportInterval || interval > maxReportInterval {
+		replyError(source, "invalid-interval")
+		return
+	}
+
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
+	vehicle, found := store.controlPeers[key]
+	if !found {
+		replyError(source, "unknown-vehicle")
+		return
+	}
+
+	err = vehicle.send(fmt.Sprintf("SETRATE %s %s", key.vin, interval))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to relay command to %s.\n  -->  %s\n", key, err.Error())
+		replyError(source, "relay-failed")
+		return
+	}
+
+	if loadSettings().verbose {
+		fmt.Printf("Relayed SETRATE %s to %s at %s.\n", interval, key, vehicle)
+	}
+
+	err = source.send(fmt.Sprintf("SETRATE-OK %s %s", key.vin, interval))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to send setrate reply.\n  -->  %s\n", err.Error())
+	}
+}
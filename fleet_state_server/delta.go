@@ -0,0 +1,79 @@
+package main
+
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+import "time"
+
+// Subscribers which include a [delta=true] field in their SUBSCRIBE packet receive positions as
+// deltas to save bandwidth. The first update is a full update packet -- a keyframe -- and each
+// subsequent update is a delta packet with the format:
+//
+//	DELTA <vin> <milliseconds> <latitude-delta> <longitude-delta> [<speed>] [<key>=<value>]
+//
+// The time delta is in milliseconds and the coordinate deltas are in millionths of a degree, all
+// relative to the previous update. We send a fresh keyframe after every keyframeInterval updates
+// so a client can resync if a packet is lost.
+const keyframeInterval = 10
+
+// This type tracks the last position sent to a delta subscriber. The coordinates are in
+// millionths of a degree exactly as the client will have reconstructed them so rounding errors
+// don't accumulate.
+type deltaState struct {
+	started   bool
+	count     int
+	timestamp time.Time
+	latitude  int64
+	longitude int64
+}
+
+// This function returns the update packet to send to a delta subscriber and the subscriber's new
+// state, which the caller should only store if the packet is sent successfully. The full argument
+// is the vehicle's full update packet as returned by [formatUpdate].
+func formatDeltaUpdate(store *fleetStore, key vehicleKey, full string, state deltaState) (string, deltaState) {
+	last := store.fleet[key].Last()
+	latitude := sentMicrodegrees(last.latitude)
+	longitude := sentMicrodegrees(last.longitude)
+
+	if !state.started || state.count+1 >= keyframeInterval {
+		next := deltaState{
+			started:   true,
+			timestamp: last.timestamp,
+			latitude:  latitude,
+			longitude: longitude,
+		}
+		return full, next
+	}
+
+	elapsed := last.timestamp.Sub(state.timestamp).Round(time.Millisecond)
+	next := deltaState{
+		started:   true,
+		count:     state.count + 1,
+		timestamp: state.timestamp.Add(elapsed),
+		latitude:  latitude,
+		longitude: longitude,
+	}
+
+	message := fmt.Sprintf(
+		"DELTA %s %d %d %d",
+		key.vin,
+		elapsed.Milliseconds(),
+		latitude-state.latitude,
+		longitude-state.longitude)
+
+	// The speed field (if any) and any optional fields follow the position in the full update.
+	fields := strings.Split(full, " ")
+	if len(fields) > 4 {
+		message += " " + strings.Join(fields[4:], " ")
+	}
+
+	return message, next
+}
+
+// This function returns a coordinate in millionths of a degree as the client will parse it from
+// a keyframe, i.e. after it's been formatted to --precision decimal places.
+func sentMicrodegrees(value float64) int64 {
+	sent, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'f', loadSettings().coordinatePrecision, 64), 64)
+	return int64(math.Round(sent * 1e6))
+}
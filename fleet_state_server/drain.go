@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// While draining, we stop as soon as the socket has been idle for drainIdle, or after drainLimit
+// in total in case vehicles are sending fast enough that the socket is never idle.
+const drainIdle = 5 * time.Millisecond
+const drainLimit = 250 * time.Millisecond
+
+// This function reads and discards any packets already queued on the connection, e.g. from
+// vehicles which started before the server, and returns the number of packets discarded. It's a
+// no-op for connections which don't support read deadlines.
+func drainPackets(conn packetConn) int {
+	deadliner, ok := conn.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return 0
+	}
+	defer deadliner.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, maxPacketSize)
+	limit := time.Now().Add(drainLimit)
+	count := 0
+
+	for time.Now().Before(limit) {
+		deadliner.SetReadDeadline(time.Now().Add(drainIdle))
+		_, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		count++
+	}
+
+	return count
+}
@@ -0,0 +1,89 @@
+package main
+
+import "errors"
+import "fmt"
+import "strings"
+
+// This type enumerates the reasons the server drops an incoming packet.
+type dropReason int
+
+const (
+	dropInvalidPacket dropReason = iota
+	dropInvalidTimestamp
+	dropInvalidCoord
+	dropInvalidSequence
+	dropInvalidIgnition
+	dropInvalidBattery
+	dropInvalidStatus
+	dropClockSkew
+	dropStale
+	dropOutOfOrder
+	dropUnauthorized
+	dropTLSRequired
+	dropCapacity
+	dropUnknownCommand
+
+	// This isn't a reason; it's the number of reasons.
+	numDropReasons
+)
+
+// The names of the drop reasons as reported in the server's STATS reply.
+var dropReasonNames = [numDropReasons]string{
+	dropInvalidPacket:    "invalid-packet",
+	dropInvalidTimestamp: "invalid-timestamp",
+	dropInvalidCoord:     "invalid-coord",
+	dropInvalidSequence:  "invalid-sequence",
+	dropInvalidIgnition:  "invalid-ignition",
+	dropInvalidBattery:   "invalid-battery",
+	dropInvalidStatus:    "invalid-status",
+	dropClockSkew:        "clock-skew",
+	dropStale:            "stale",
+	dropOutOfOrder:       "out-of-order",
+	dropUnauthorized:     "unauthorized",
+	dropTLSRequired:      "tls-required",
+	dropCapacity:         "capacity",
+	dropUnknownCommand:   "unknown-command",
+}
+
+func (reason dropReason) String() string {
+	return dropReasonNames[reason]
+}
+
+// This function increments the drop counter for the specified reason. The caller must hold the
+// store's mutex.
+func (store *fleetStore) recordDrop(reason dropReason) {
+	store.drops[reason]++
+}
+
+// This function returns the drop reason for an error returned by [parseVehiclePacket].
+func dropReasonFor(err error) dropReason {
+	switch {
+	case errors.Is(err, errInvalidTimestamp):
+		return dropInvalidTimestamp
+	case errors.Is(err, errInvalidCoord):
+		return dropInvalidCoord
+	case errors.Is(err, errInvalidSequence):
+		return dropInvalidSequence
+	case errors.Is(err, errInvalidIgnition):
+		return dropInvalidIgnition
+	case errors.Is(err, errInvalidBattery):
+		return dropInvalidBattery
+	case errors.Is(err, errInvalidStatus):
+		return dropInvalidStatus
+	default:
+		return dropInvalidPacket
+	}
+}
+
+// This function returns the drop counters in the format: [dropped=<total> <reason>=<n> ...]. Every
+// reason is listed, in a fixed order, even if its count is zero.
+func formatDrops(store *fleetStore) string {
+	total := uint64(0)
+	fields := make([]string, 0, numDropReasons)
+	for reason := dropReason(0); reason < numDropReasons; reason++ {
+		total += store.drops[reason]
+		fields = append(fields, fmt.Sprintf("%s=%d", reason, store.drops[reason]))
+	}
+
+	return fmt.Sprintf("dropped=%d %s", total, strings.Join(fields, " "))
+}
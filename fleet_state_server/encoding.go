@@ -0,0 +1,173 @@
+package main
+
+import "encoding/binary"
+import "encoding/json"
+import "math"
+import "strconv"
+import "strings"
+import "time"
+
+// This type is the signature shared by the encoders in [updateEncoders]. An encoder takes a
+// subscriber update in the standard text format and returns it in the subscriber's format.
+type updateEncoder func(update string) string
+
+// Subscribers choose the format of their update packets with a [format=<name>] field in their
+// SUBSCRIBE packet. This map holds the encoder for each format. Only update packets are encoded;
+// replies like SNAPSHOT and SHUTDOWN are always text.
+var updateEncoders = map[string]updateEncoder{
+	"text":   encodeText,
+	"json":   encodeJSON,
+	"binary": encodeBinary,
+}
+
+// The first byte of a binary update packet. A text packet never begins with this byte.
+const binaryUpdateMarker = 0x01
+
+// The JSON representation of a subscriber update. A speed of -1 means the speed isn't available,
+// as in the text format, and the speed is omitted if the server is running with --no-speed. The
+// coordinates are null if the vehicle has no GPS fix.
+type updateJSON struct {
+	Timestamp string   `json:"timestamp"`
+	VIN       string   `json:"vin"`
+	Fleet     string   `json:"fleet,omitempty"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Speed     *float64 `json:"speed,omitempty"`
+	NoFix     bool     `json:"no_fix"`
+	Odometer  *float64 `json:"odometer,omitempty"`
+	Ignition  string   `json:"ignition,omitempty"`
+	Battery   *float64 `json:"battery,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Violation *bool    `json:"violation,omitempty"`
+	Origin    string   `json:"origin,omitempty"`
+}
+
+// This function splits a text update into its positional fields and its optional [<key>=<value>]
+// fields, keeping the optional fields in their original order.
+func splitUpdate(update string) ([]string, []string) {
+	var positional, optional []string
+	for _, element := range strings.Split(update, " ") {
+		if strings.Contains(element, "=") {
+			optional = append(optional, element)
+		} else {
+			positional = append(positional, element)
+		}
+	}
+	return positional, optional
+}
+
+// This function returns the update unchanged.
+func encodeText(update string) string {
+	return update
+}
+
+// This function encodes an update as a single-line JSON object. The optional fields we recognise
+// become typed JSON fields; any others are dropped. The update is one we formatted ourselves, so
+// it can't fail to parse, but if it did we'd send it unchanged rather than lose it.
+func encodeJSON(update string) string {
+	positional, optional := splitUpdate(update)
+	if len(positional) != 4 && len(positional) != 5 {
+		return update
+	}
+
+	output := updateJSON{Timestamp: positional[0], VIN: positional[1]}
+
+	if positional[2] == noFix {
+		output.NoFix = true
+	} else {
+		output.Latitude = parseOptionalFloat(positional[2])
+		output.Longitude = parseOptionalFloat(positional[3])
+	}
+
+	if len(positional) == 5 {
+		output.Speed = parseOptionalFloat(positional[4])
+	}
+
+	for _, field := range optional {
+		index := strings.Index(field, "=")
+		key, value := field[:index], field[index+1:]
+		switch key {
+		case "fleet":
+			output.Fleet = value
+		case "odometer":
+			output.Odometer = parseOptionalFloat(value)
+		case "ignition":
+			output.Ignition = value
+		case "battery":
+			output.Battery = parseOptionalFloat(value)
+		case "status":
+			output.Status = value
+		case "violation":
+			violation := value == "true"
+			output.Violation = &violation
+		case "origin":
+			output.Origin = value
+		}
+	}
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return update
+	}
+	return string(data)
+}
+
+// This function returns a pointer to the parsed value, or nil if it isn't a valid number.
+func parseOptionalFloat(value string) *float64 {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &number
+}
+
+// This function encodes an update as a compact binary packet. All numbers are big-endian:
+//
+//	byte  0       -- binaryUpdateMarker
+//	bytes 1-8     -- timestamp as a signed count of nanoseconds since the Unix epoch
+//	byte  9       -- flags: bit 0 is set if the vehicle has no GPS fix, bit 1 if there's a speed
+//	bytes 10-17   -- latitude as an IEEE 754 float64, zero if there's no fix
+//	bytes 18-25   -- longitude, as above
+//	bytes 26-33   -- speed in m/s, -1 if it isn't available, zero if there's no speed field
+//	byte  34      -- length of the VIN, n
+//	bytes 35-     -- the VIN, followed by the update's optional fields as space-separated text
+//
+// Binary packets can't be batched or sent over TLS as they may contain newlines. As with JSON,
+// an update which fails to parse is sent unchanged.
+func encodeBinary(update string) string {
+	positional, optional := splitUpdate(update)
+	if len(positional) != 4 && len(positional) != 5 {
+		return update
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, positional[0])
+	if err != nil || len(positional[1]) > 255 {
+		return update
+	}
+
+	var flags byte
+	var latitude, longitude, speed float64
+	if positional[2] == noFix {
+		flags |= 1
+	} else {
+		latitude, _ = strconv.ParseFloat(positional[2], 64)
+		longitude, _ = strconv.ParseFloat(positional[3], 64)
+	}
+	if len(positional) == 5 {
+		flags |= 2
+		speed, _ = strconv.ParseFloat(positional[4], 64)
+	}
+
+	packet := make([]byte, 35, 35+len(positional[1])+len(update))
+	packet[0] = binaryUpdateMarker
+	binary.BigEndian.PutUint64(packet[1:], uint64(timestamp.UnixNano()))
+	packet[9] = flags
+	binary.BigEndian.PutUint64(packet[10:], math.Float64bits(latitude))
+	binary.BigEndian.PutUint64(packet[18:], math.Float64bits(longitude))
+	binary.BigEndian.PutUint64(packet[26:], math.Float64bits(speed))
+	packet[34] = byte(len(positional[1]))
+	packet = append(packet, positional[1]...)
+	packet = append(packet, strings.Join(optional, " ")...)
+
+	return string(packet)
+}
@@ -0,0 +1,75 @@
+package main
+
+import "encoding/binary"
+import "encoding/json"
+import "math"
+import "strings"
+import "testing"
+import "time"
+
+func TestMixedFormatSubscribers(t *testing.T) {
+	store := newTestStore(t)
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	vehicle := packetPeer{conn: server, addr: memoryAddr("vehicle")}
+
+	subscribers := map[string]*memoryConn{}
+	for _, format := range []string{"text", "json", "binary"} {
+		subscribers[format] = network.listen(format)
+		source := packetPeer{conn: server, addr: memoryAddr(format)}
+		handlePacket(source, "SUBSCRIBE VIN1 format="+format, store)
+	}
+
+	handlePacket(vehicle, testPacket("VIN1", -time.Second, "53.000000", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN1", 0, "53.000100", "-6.000000"), store)
+
+	updates := map[string][]string{}
+	for format, conn := range subscribers {
+		updates[format] = conn.pending()
+		if len(updates[format]) != 2 {
+			t.Fatalf("expected 2 %s updates, found %d: %q", format, len(updates[format]), updates[format])
+		}
+	}
+
+	text := updates["text"][1]
+	fields := strings.Fields(text)
+	if len(fields) != 5 || fields[1] != "VIN1" || fields[2] != "53.000100" || fields[3] != "-6.000000" {
+		t.Fatalf("unexpected text update '%s'", text)
+	}
+
+	var decoded updateJSON
+	err := json.Unmarshal([]byte(updates["json"][1]), &decoded)
+	if err != nil {
+		t.Fatalf("invalid JSON update '%s': %v", updates["json"][1], err)
+	}
+	if decoded.VIN != "VIN1" || decoded.Timestamp != fields[0] || decoded.NoFix {
+		t.Errorf("unexpected JSON update '%s'", updates["json"][1])
+	}
+	if decoded.Latitude == nil || *decoded.Latitude != 53.0001 || decoded.Longitude == nil || *decoded.Longitude != -6 {
+		t.Errorf("unexpected JSON coordinates in '%s'", updates["json"][1])
+	}
+	if decoded.Speed == nil || math.Abs(*decoded.Speed-11.12) > 0.01 {
+		t.Errorf("unexpected JSON speed in '%s'", updates["json"][1])
+	}
+
+	packet := []byte(updates["binary"][1])
+	if len(packet) != 35+len("VIN1") || packet[0] != binaryUpdateMarker {
+		t.Fatalf("unexpected binary update %x", packet)
+	}
+	nanoseconds := int64(binary.BigEndian.Uint64(packet[1:]))
+	if !time.Unix(0, nanoseconds).Equal(testNow) {
+		t.Errorf("expected binary timestamp %s, found %s", testNow, time.Unix(0, nanoseconds).UTC())
+	}
+	if packet[9] != 2 {
+		t.Errorf("expected the speed flag only, found flags %08b", packet[9])
+	}
+	latitude := math.Float64frombits(binary.BigEndian.Uint64(packet[10:]))
+	longitude := math.Float64frombits(binary.BigEndian.Uint64(packet[18:]))
+	speed := math.Float64frombits(binary.BigEndian.Uint64(packet[26:]))
+	if latitude != 53.0001 || longitude != -6 || math.Abs(speed-*decoded.Speed) > 1e-6 {
+		t.Errorf("unexpected binary values %v, %v, %v", latitude, longitude, speed)
+	}
+	if int(packet[34]) != len("VIN1") || string(packet[35:]) != "VIN1" {
+		t.Errorf("unexpected binary VIN '%s'", packet[35:])
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "fmt"
+import "strings"
+
+// The names of a vehicle packet's positional fields for --field-order, in the default order.
+var defaultFieldOrder = []string{"timestamp", "vin", "lat", "long"}
+
+// If not nil, vehicle packets list their positional fields in a non-default order, e.g. for a
+// third-party device which sends [<vin> <timestamp> <lat> <long>]. The i-th entry is the position
+// in the incoming packet of the i-th field in [defaultFieldOrder]. Set by --field-order.
+var fieldOrder []int
+
+// This function parses a --field-order spec, a comma-separated list of the names in
+// [defaultFieldOrder], e.g. "vin,timestamp,lat,long". Every field must appear exactly once. It
+// returns nil if the spec is the default order.
+func parseFieldOrder(spec string) ([]int, error) {
+	names := strings.Split(spec, ",")
+	positions := make(map[string]int)
+
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if !isFieldName(name) {
+			return nil, fmt.Errorf("unknown field '%s', expected one of '%s'", name, strings.Join(defaultFieldOrder, "', '"))
+		}
+		if _, found := positions[name]; found {
+			return nil, fmt.Errorf("duplicate field '%s'", name)
+		}
+		positions[name] = i
+	}
+
+	var order []int
+	isDefault := true
+	for i, name := range defaultFieldOrder {
+		position, found := positions[name]
+		if !found {
+			return nil, fmt.Errorf("missing field '%s'", name)
+		}
+		order = append(order, position)
+		isDefault = isDefault && position == i
+	}
+
+	if isDefault {
+		return nil, nil
+	}
+	return order, nil
+}
+
+// This function returns true if the name is one of the names in [defaultFieldOrder].
+func isFieldName(name string) bool {
+	for _, field := range defaultFieldOrder {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// This function rewrites a vehicle packet received in the --field-order into the default order so
+// the rest of the server, including any --forward-to server, sees a standard packet. Optional
+// [<key>=<value>] fields are kept in place at the end. A packet with the wrong number of positional
+// fields is returned unchanged for the parser to reject.
+func reorderFields(message string) string {
+	if fieldOrder == nil {
+		return message
+	}
+
+	var positional, optional []string
+	for _, element := range strings.Split(message, " ") {
+		if strings.Contains(element, "=") {
+			optional = append(optional, element)
+		} else {
+			positional = append(positional, element)
+		}
+	}
+
+	if len(positional) != len(fieldOrder) {
+		return message
+	}
+
+	reordered := make([]string, 0, len(positional)+len(optional))
+	for _, position := range fieldOrder {
+		reordered = append(reordered, positional[position])
+	}
+	reordered = append(reordered, optional...)
+
+	return strings.Join(reordered, " ")
+}
+
+// This function returns true if a vehicle packet in the --field-order begins with the VIN. A VIN
+// can consist entirely of capital letters so it could be mistaken for a command word.
+func vinFirst() bool {
+	return fieldOrder != nil && fieldOrder[1] == 0
+}
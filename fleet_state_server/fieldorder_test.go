@@ -0,0 +1,88 @@
+package main
+
+import "reflect"
+import "testing"
+import "time"
+
+// This function sets the --field-order for the duration of the test.
+func useFieldOrder(t *testing.T, spec string) {
+	t.Helper()
+
+	order, err := parseFieldOrder(spec)
+	if err != nil {
+		t.Fatalf("invalid field order '%s': %v", spec, err)
+	}
+
+	previous := fieldOrder
+	fieldOrder = order
+	t.Cleanup(func() {
+		fieldOrder = previous
+	})
+}
+
+func TestParseFieldOrder(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected []int
+	}{
+		{"timestamp,vin,lat,long", nil},
+		{"vin,timestamp,lat,long", []int{1, 0, 2, 3}},
+		{"lat, long, vin, timestamp", []int{3, 2, 0, 1}},
+	}
+
+	for _, test := range tests {
+		order, err := parseFieldOrder(test.spec)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(order, test.expected) {
+			t.Errorf("'%s': expected %v, found %v", test.spec, test.expected, order)
+		}
+	}
+
+	for _, spec := range []string{"", "vin,timestamp,lat", "vin,vin,lat,long", "vin,timestamp,lat,lng", "vin,timestamp,lat,long,speed"} {
+		if _, err := parseFieldOrder(spec); err == nil {
+			t.Errorf("'%s': expected an error", spec)
+		}
+	}
+}
+
+func TestReorderFields(t *testing.T) {
+	tests := []struct {
+		spec     string
+		message  string
+		expected string
+	}{
+		{"vin,timestamp,lat,long", "VIN1 1709294400 53.1 -6.2", "1709294400 VIN1 53.1 -6.2"},
+		{"vin,timestamp,lat,long", "VIN1 1709294400 53.1 -6.2 seq=4 fleet=a", "1709294400 VIN1 53.1 -6.2 seq=4 fleet=a"},
+		{"lat,long,vin,timestamp", "53.1 -6.2 VIN1 1709294400", "1709294400 VIN1 53.1 -6.2"},
+		{"lat,long,vin,timestamp", "53.1 -6.2 VIN1", "53.1 -6.2 VIN1"},
+		{"timestamp,vin,lat,long", "1709294400 VIN1 53.1 -6.2", "1709294400 VIN1 53.1 -6.2"},
+	}
+
+	for _, test := range tests {
+		useFieldOrder(t, test.spec)
+		if result := reorderFields(test.message); result != test.expected {
+			t.Errorf("%s: '%s': expected '%s', found '%s'", test.spec, test.message, test.expected, result)
+		}
+	}
+}
+
+func TestFieldOrderVINFirst(t *testing.T) {
+	store := newTestStore(t)
+	useFieldOrder(t, "vin,timestamp,lat,long")
+	server := newMemoryNetwork().listen("server")
+
+	// A VIN of capital letters looks like a command word but must be read as a VIN.
+	timestamp := testNow.Format(time.RFC3339Nano)
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, "ABCDEFGH "+timestamp+" 53.1 -6.2", store)
+
+	entries, found := store.fleet[vehicleKey{vin: "ABCDEFGH"}]
+	if !found || entries.Len() != 1 {
+		t.Fatalf("expected the packet to be stored")
+	}
+	if last := entries.Last(); last.latitude != 53.1 || last.longitude != -6.2 || !last.timestamp.Equal(testNow) {
+		t.Errorf("unexpected stored location %+v", last)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import "fmt"
+import "math"
+import "os"
+
+// Vehicles moving slower than this speed in meters per second are counted as stationary. GPS
+// jitter means a parked vehicle rarely reports a speed of exactly zero.
+const stationarySpeed = 0.5
+
+// This function handles incoming FLEETSTATS packets from clients. A FLEETSTATS request packet is
+// assumed to have the format: [FLEETSTATS [fleet=<name>] [token=<secret>]]. The server replies with
+// aggregate statistics for every vehicle in the namespace in the format:
+//
+//	[FLEETSTATS vehicles=<n> moving=<n> stationary=<n> avg-speed=<m/s> bbox=<lat1,long1,lat2,long2>
+//	span=<meters>]
+//
+// The average speed is calculated over moving vehicles only. Vehicles whose speed is unknown are
+// counted in the total but not as moving or stationary. If the --no-speed flag is set, the speed
+// fields are omitted. If the namespace has no vehicles, the bbox and span fields are omitted.
+func handleFleetStatsPacket(source peer, message string, store *fleetStore) {
+	settings := loadSettings()
+
+	elements, options := splitFields(message)
+	if len(elements) != 1 {
+		fmt.Fprintf(os.Stderr, "Error: invalid fleetstats packet.\n")
+		store.recordDrop(dropInvalidPacket)
+		return
+	}
+
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
+		return
+	}
+
+	vehicles := 0
+	moving := 0
+	stationary := 0
+	totalSpeed := 0.0
+
+	minLatitude, minLongitude := math.Inf(1), math.Inf(1)
+	maxLatitude, maxLongitude := math.Inf(-1), math.Inf(-1)
+
+	for key, entries := range store.fleet {
+		if key.namespace != options["fleet"] {
+			continue
+		}
+		vehicles++
+
+		last := entries.Last()
+		minLatitude = math.Min(minLatitude, last.latitude)
+		minLongitude = math.Min(minLongitude, last.longitude)
+		maxLatitude = math.Max(maxLatitude, last.latitude)
+		maxLongitude = math.Max(maxLongitude, last.longitude)
+
+		if settings.noSpeed {
+			continue
+		}
+
+		speed := computeSpeed(entries.LastN(2))
+		if speed < 0 {
+			continue
+		}
+		if speed < stationarySpeed {
+			stationary++
+		} else {
+			moving++
+			totalSpeed += speed
+		}
+	}
+
+	reply := fmt.Sprintf("FLEETSTATS vehicles=%d", vehicles)
+	if !settings.noSpeed {
+		averageSpeed := 0.0
+		if moving > 0 {
+			averageSpeed = totalSpeed / float64(moving)
+		}
+		reply += fmt.Sprintf(
+			" moving=%d stationary=%d avg-speed=%.*f",
+			moving,
+			stationary,
+			settings.speedPrecision,
+			averageSpeed)
+	}
+	if vehicles > 0 {
+		reply += fmt.Sprintf(
+			" bbox=%.*f,%.*f,%.*f,%.*f span=%.1f",
+			settings.coordinatePrecision,
+			minLatitude,
+			settings.coordinatePrecision,
+			minLongitude,
+			settings.coordinatePrecision,
+			maxLatitude,
+			settings.coordinatePrecision,
+			maxLongitude,
+			getDistance(minLatitude, minLongitude, maxLatitude, maxLongitude))
+	}
+
+	err := source.send(reply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to send fleetstats reply.\n  -->  %s\n", err.Error())
+	}
+}
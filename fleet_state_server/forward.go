@@ -0,0 +1,62 @@
+package main
+
+import "fmt"
+import "net"
+import "os"
+import "strings"
+import "time"
+
+// If not nil, we relay every vehicle packet we accept to the fleet state server at this address.
+// Servers can be chained this way, e.g. regional servers forwarding to a central server.
+var forwardAddr *net.UDPAddr
+
+// This function relays an accepted vehicle packet to the --forward-to server. The fields are the
+// packet's space-separated fields. We drop any control field as the upstream server can't relay
+// commands to the vehicle through us. Forwarding is best-effort: a failure never affects local
+// delivery, and we only report the first failure in a run so an unreachable upstream server
+// doesn't flood the terminal.
+func (store *fleetStore) forward(fields []string) {
+	if store.upstream == nil {
+		return
+	}
+
+	var kept []string
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "control=") {
+			kept = append(kept, field)
+		}
+	}
+
+	err := store.upstream.send(strings.Join(kept, " "))
+	if err != nil {
+		if !store.forwardFailing {
+			fmt.Fprintf(os.Stderr, "Error: failed to forward packet to '%s'.\n  -->  %s\n", store.upstream, err.Error())
+		}
+		store.forwardFailing = true
+		return
+	}
+
+	if store.forwardFailing {
+		fmt.Printf("Resumed forwarding packets to '%s'.\n", store.upstream)
+		store.forwardFailing = false
+	}
+}
+
+// This function returns the fields of a vehicle packet for forwarding, where index is the position
+// of the timestamp among the packet's positional fields. We replace the vehicle's timestamp with
+// the timestamp we accepted, in RFC3339 format, so a packet timestamped by --server-timestamps is
+// forwarded with a valid timestamp.
+func forwardedFields(message string, index int, timestamp time.Time) []string {
+	fields := strings.Split(message, " ")
+	for i, field := range fields {
+		if strings.Contains(field, "=") {
+			continue
+		}
+		if index == 0 {
+			fields[i] = timestamp.Format(time.RFC3339Nano)
+			break
+		}
+		index--
+	}
+	return fields
+}
@@ -0,0 +1,59 @@
+package main
+
+import "reflect"
+import "strings"
+import "testing"
+
+func TestSplitMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected []string
+	}{
+		{"empty", "", nil},
+		{"single message", "PING", []string{"PING"}},
+		{"trailing newline", "PING\n", []string{"PING"}},
+		{"several messages", "A 1\nB 2\nC 3", []string{"A 1", "B 2", "C 3"}},
+		{"empty lines", "\n\nA 1\n\n\nB 2\n\n", []string{"A 1", "B 2"}},
+		{"only newlines", "\n\n\n", nil},
+		{"crlf", "A 1\r\nB 2\r\n", []string{"A 1", "B 2"}},
+		{"crlf without final newline", "A 1\r\nB 2", []string{"A 1", "B 2"}},
+		{"blank crlf lines", "\r\n\r\nA 1\r\n", []string{"A 1"}},
+		{"inner carriage return kept", "A\r1\n", []string{"A\r1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := splitMessages([]byte(test.payload))
+			if !reflect.DeepEqual(messages, test.expected) {
+				t.Errorf("expected %q, found %q", test.expected, messages)
+			}
+		})
+	}
+}
+
+func TestSplitMessagesMaxPacketSize(t *testing.T) {
+	// A single message filling the whole packet.
+	single := strings.Repeat("x", maxPacketSize)
+	messages := splitMessages([]byte(single))
+	if len(messages) != 1 || messages[0] != single {
+		t.Fatalf("expected one message of %d bytes", maxPacketSize)
+	}
+
+	// A batch of 100-byte lines with a final unterminated message filling the packet exactly.
+	line := strings.Repeat("y", 99) + "\n"
+	count := maxPacketSize / len(line)
+	last := strings.Repeat("z", maxPacketSize-count*len(line))
+	payload := strings.Repeat(line, count) + last
+	if len(payload) != maxPacketSize {
+		t.Fatalf("expected a payload of %d bytes, found %d", maxPacketSize, len(payload))
+	}
+
+	messages = splitMessages([]byte(payload))
+	if len(messages) != count+1 {
+		t.Fatalf("expected %d messages, found %d", count+1, len(messages))
+	}
+	if messages[count] != last {
+		t.Errorf("expected the final message to be %d bytes, found %d", len(last), len(messages[count]))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "os"
+import "sort"
+import "strings"
+import "time"
+
+// A GeoJSON feature representing a vehicle's track. The geometry is a LineString, or a Point if we
+// only have a single location for the vehicle. GeoJSON has no standard way to attach a timestamp
+// to each coordinate so we follow the common convention of a parallel array in the properties.
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONGeometry   `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+// A GeoJSON geometry. The coordinates are either a single [longitude, latitude] position or an
+// array of positions.
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// The properties of a vehicle's track. Timestamps[i] is the time of the i-th coordinate.
+type geoJSONProperties struct {
+	VIN        string      `json:"vin"`
+	Fleet      string      `json:"fleet,omitempty"`
+	Timestamps []time.Time `json:"timestamps"`
+}
+
+// This function returns a GeoJSON feature for the locations, which must not be empty. Note that
+// GeoJSON positions are [longitude, latitude], the reverse of the usual order.
+func newGeoJSONFeature(key vehicleKey, locations []location) geoJSONFeature {
+	positions := make([][2]float64, 0, len(locations))
+	timestamps := make([]time.Time, 0, len(locations))
+	for _, loc := range locations {
+		positions = append(positions, [2]float64{loc.longitude, loc.latitude})
+		timestamps = append(timestamps, loc.timestamp)
+	}
+
+	geometry := geoJSONGeometry{Type: "LineString", Coordinates: positions}
+	if len(positions) == 1 {
+		geometry = geoJSONGeometry{Type: "Point", Coordinates: positions[0]}
+	}
+
+	return geoJSONFeature{
+		Type:     "Feature",
+		Geometry: geometry,
+		Properties: geoJSONProperties{
+			VIN:        key.vin,
+			Fleet:      key.namespace,
+			Timestamps: timestamps,
+		},
+	}
+}
+
+// This function returns a copy of the vehicle's stored history, or nil if the vehicle is unknown.
+func (store *fleetStore) historyOf(key vehicleKey) []location {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entries, found := store.fleet[key]
+	if !found {
+		return nil
+	}
+	return entries.LastN(entries.Len())
+}
+
+// This function handles a [GET /geojson/<vin>] request. It replies with the vehicle's track as a
+// single GeoJSON feature.
+func handleGeoJSONVehicleRequest(w http.ResponseWriter, r *http.Request, store *fleetStore, vin string) {
+	key := vehicleKey{namespace: r.URL.Query().Get("fleet"), vin: vin}
+
+	locations := store.historyOf(key)
+	if len(locations) == 0 {
+		http.Error(w, "unknown vehicle", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	err := json.NewEncoder(w).Encode(newGeoJSONFeature(key, locations))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write HTTP response.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function handles a [GET /geojson] request. It replies with a GeoJSON feature collection
+// containing the track of every vehicle in the fleet, sorted by VIN.
+//
+// A large fleet with long histories can produce a large response so we stream it one feature at a
+// time. We only hold the store's lock while we copy each vehicle's history, not while we write, so
+// a slow client doesn't block the server.
+func handleGeoJSONRequest(w http.ResponseWriter, r *http.Request, store *fleetStore) {
+	namespace := r.URL.Query().Get("fleet")
+
+	store.mutex.Lock()
+	var keys []vehicleKey
+	for key := range store.fleet {
+		if key.namespace == namespace {
+			keys = append(keys, key)
+		}
+	}
+	store.mutex.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].vin < keys[j].vin
+	})
+
+	w.Header().Set("Content-Type", "application/geo+json")
+
+	var builder strings.Builder
+	builder.WriteString(`{"type":"FeatureCollection","features":[`)
+
+	count := 0
+	for _, key := range keys {
+		// The vehicle's history may have been trimmed to nothing since we listed the keys.
+		locations := store.historyOf(key)
+		if len(locations) == 0 {
+			continue
+		}
+
+		feature, err := json.Marshal(newGeoJSONFeature(key, locations))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to encode GeoJSON feature.\n  -->  %s\n", err.Error())
+			return
+		}
+
+		if count > 0 {
+			builder.WriteString(",")
+		}
+		builder.Write(feature)
+		count++
+
+		_, err = w.Write([]byte(builder.String()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to write HTTP response.\n  -->  %s\n", err.Error())
+			return
+		}
+		builder.Reset()
+	}
+
+	builder.WriteString("]}\n")
+	_, err := w.Write([]byte(builder.String()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write HTTP response.\n  -->  %s\n", err.Error())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+
+// If set to true, we accept vehicle packets in GeoJSON format alongside text packets. Set by
+// --format geojson.
+var acceptGeoJSON bool
+
+// A vehicle packet in GeoJSON format, a Feature with a Point geometry, e.g. from the simulator's
+// --format geojson. A null geometry means the vehicle has no GPS fix. Note that GeoJSON positions
+// are [longitude, latitude].
+// Ref: https://datatracker.ietf.org/doc/html/rfc7946
+type vehicleFeature struct {
+	Type     string `json:"type"`
+	Geometry *struct {
+		Type        string        `json:"type"`
+		Coordinates []json.Number `json:"coordinates"`
+	} `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// This function returns true if the packet looks like a GeoJSON vehicle packet, i.e. a JSON
+// object, and --format geojson is set.
+func isGeoJSONPacket(message string) bool {
+	return acceptGeoJSON && strings.HasPrefix(message, "{")
+}
+
+// This function converts a GeoJSON vehicle packet into a text vehicle packet in the default field
+// order so the rest of the server, including any --forward-to server, sees a standard packet. The
+// feature must have [timestamp] and [vin] properties. Any other scalar properties become optional
+// [<key>=<value>] fields in alphabetical order, except [speed] as we calculate speeds ourselves.
+// Properties which are objects, arrays, or null are ignored, like unknown fields in text packets.
+func parseGeoJSONPacket(message string) (string, error) {
+	var feature vehicleFeature
+	decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+	decoder.UseNumber()
+	err := decoder.Decode(&feature)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid GeoJSON: %s", errInvalidPacket, err.Error())
+	}
+
+	if feature.Type != "Feature" {
+		return "", fmt.Errorf("%w: expected a GeoJSON Feature, found '%s'", errInvalidPacket, feature.Type)
+	}
+
+	timestamp, ok := geoJSONProperty(feature.Properties["timestamp"])
+	if !ok || timestamp == "" {
+		return "", fmt.Errorf("%w: missing or invalid timestamp property", errInvalidPacket)
+	}
+
+	vin, ok := geoJSONProperty(feature.Properties["vin"])
+	if !ok || vin == "" {
+		return "", fmt.Errorf("%w: missing or invalid vin property", errInvalidPacket)
+	}
+
+	latitude, longitude := noFix, noFix
+	if feature.Geometry != nil {
+		if feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) < 2 {
+			return "", fmt.Errorf("%w: expected a Point geometry", errInvalidPacket)
+		}
+		longitude = feature.Geometry.Coordinates[0].String()
+		latitude = feature.Geometry.Coordinates[1].String()
+	}
+
+	elements := []string{timestamp, vin, latitude, longitude}
+
+	var keys []string
+	for key := range feature.Properties {
+		if key != "timestamp" && key != "vin" && key != "speed" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, ok := geoJSONProperty(feature.Properties[key])
+		if !ok {
+			continue
+		}
+		if strings.ContainsAny(key, " =") || strings.Contains(value, " ") {
+			return "", fmt.Errorf("%w: the property '%s' can't contain spaces", errInvalidPacket, key)
+		}
+		elements = append(elements, key+"="+value)
+	}
+
+	return strings.Join(elements, " "), nil
+}
+
+// This function returns a scalar property's value as text. It returns false if the property is
+// missing, null, an object, or an array.
+func geoJSONProperty(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
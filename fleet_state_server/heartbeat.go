@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+import "os"
+
+// This function handles incoming HEARTBEAT packets from vehicles. A heartbeat packet is assumed to
+// have the format: [HEARTBEAT <vin> <timestamp> [fleet=<name>]], with the timestamp in the same
+// formats as an update packet. A vehicle sends a heartbeat instead of an update when it hasn't
+// moved since its last update.
+//
+// We update the vehicle's last-seen time without storing a new location, so a stationary vehicle
+// doesn't look offline but doesn't fill its history with identical positions either. Heartbeats
+// aren't forwarded to subscribers as there's nothing new to report.
+func handleHeartbeatPacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 3 || elements[1] == wildcardVIN {
+		fmt.Fprintf(os.Stderr, "Error: invalid heartbeat packet.\n")
+		store.recordDrop(dropInvalidPacket)
+		return
+	}
+
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
+
+	// If --server-timestamps is set, the vehicle's timestamp is ignored so it can be invalid.
+	timestamp, err := parseTimestamp(elements[2])
+	if err != nil && !loadSettings().serverTimestamps {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		store.recordDrop(dropInvalidTimestamp)
+		return
+	}
+
+	timestamp, ok := checkTimestamp(store, key, timestamp)
+	if !ok {
+		return
+	}
+
+	// Heartbeats share the out-of-order check with update packets.
+	if lastSeen, found := store.lastSeen[key]; found && !timestamp.After(lastSeen) {
+		store.recordDrop(dropOutOfOrder)
+		return
+	}
+	store.lastSeen[key] = timestamp
+
+	// The upstream server needs our heartbeats too or it would think the vehicle is offline. As
+	// with updates, we tag the heartbeat with our --server-id if we're the first server to see it.
+	fields := forwardedFields(message, 2, timestamp)
+	if _, found := options["origin"]; !found && serverID != "" {
+		fields = append(fields, "origin="+serverID)
+	}
+	store.forward(fields)
+}
@@ -0,0 +1,90 @@
+package main
+
+import "time"
+
+// We use this type to store a vehicle's location history. It's a ring buffer with a fixed maximum
+// capacity -- once the buffer is full, each new entry overwrites the oldest entry. The underlying
+// slice grows on demand up to the capacity so vehicles with short histories don't pay for the full
+// capacity up front.
+//
+// Entries are appended in timestamp order so the oldest entries are always at the front. This lets
+// us trim entries outside the --history-window by advancing the start index.
+type history struct {
+	entries  []location
+	capacity int
+
+	// The index of the oldest entry.
+	start int
+
+	// The number of entries in the buffer. This can be less than len(entries) after a trim.
+	count int
+}
+
+// This function returns a new empty history that will hold at most capacity entries. The capacity
+// must be at least 1.
+func newHistory(capacity int) *history {
+	return &history{capacity: capacity}
+}
+
+// This function adds a new entry to the history, overwriting the oldest entry if the history is
+// already full.
+func (h *history) Append(entry location) {
+	// If entries have been trimmed, the next slot is free.
+	if h.count < len(h.entries) {
+		h.entries[(h.start+h.count)%len(h.entries)] = entry
+		h.count++
+		return
+	}
+
+	// If the slice can still grow, we unwrap it first so the new entry goes at the end. The slice
+	// can only be wrapped here if entries have been trimmed and the slots refilled.
+	if len(h.entries) < h.capacity {
+		if h.start != 0 {
+			unwrapped := make([]location, 0, len(h.entries)+1)
+			unwrapped = append(unwrapped, h.entries[h.start:]...)
+			unwrapped = append(unwrapped, h.entries[:h.start]...)
+			h.entries = unwrapped
+			h.start = 0
+		}
+		h.entries = append(h.entries, entry)
+		h.count++
+		return
+	}
+
+	h.entries[h.start] = entry
+	h.start = (h.start + 1) % h.capacity
+}
+
+// This function removes entries with timestamps before the cutoff from the front of the history.
+func (h *history) TrimBefore(cutoff time.Time) {
+	for h.count > 0 && h.entries[h.start].timestamp.Before(cutoff) {
+		h.start = (h.start + 1) % len(h.entries)
+		h.count--
+	}
+}
+
+// This function returns the number of entries in the history.
+func (h *history) Len() int {
+	return h.count
+}
+
+// This function returns the newest entry in the history. It panics if the history is empty.
+func (h *history) Last() location {
+	return h.entries[(h.start+h.count-1)%len(h.entries)]
+}
+
+// This function returns a new slice containing the newest n entries in the history in
+// chronological order. If the history contains fewer than n entries, it returns all of them.
+func (h *history) LastN(n int) []location {
+	if n > h.count {
+		n = h.count
+	}
+
+	result := make([]location, n)
+	first := h.start + h.count - n
+	for i := 0; i < n; i++ {
+		result[i] = h.entries[(first+i)%len(h.entries)]
+	}
+
+	return result
+}
@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+import "time"
+
+// This function returns a location with a timestamp the specified number of seconds after
+// [testNow]. The latitude is also set to the number of seconds so entries are easy to identify.
+func testLocation(seconds int) location {
+	return location{
+		timestamp: testNow.Add(time.Duration(seconds) * time.Second),
+		latitude:  float64(seconds),
+	}
+}
+
+// This function checks that the entries are the locations with the specified seconds, in order.
+func checkLocations(t *testing.T, entries []location, expected ...int) {
+	t.Helper()
+
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, found %d", len(expected), len(entries))
+	}
+	for i, seconds := range expected {
+		if entries[i] != testLocation(seconds) {
+			t.Errorf("entry %d: expected location %d, found latitude %v", i, seconds, entries[i].latitude)
+		}
+	}
+}
+
+func TestHistoryFill(t *testing.T) {
+	h := newHistory(4)
+	if h.Len() != 0 {
+		t.Fatalf("expected an empty history, found %d entries", h.Len())
+	}
+
+	for i := 1; i <= 4; i++ {
+		h.Append(testLocation(i))
+		if h.Len() != i {
+			t.Fatalf("expected %d entries, found %d", i, h.Len())
+		}
+		if h.Last() != testLocation(i) {
+			t.Fatalf("expected the last entry to be location %d", i)
+		}
+	}
+
+	checkLocations(t, h.LastN(4), 1, 2, 3, 4)
+	checkLocations(t, h.LastN(2), 3, 4)
+	checkLocations(t, h.LastN(10), 1, 2, 3, 4)
+}
+
+func TestHistoryOverwritesOldest(t *testing.T) {
+	h := newHistory(3)
+	for i := 1; i <= 5; i++ {
+		h.Append(testLocation(i))
+	}
+
+	if h.Len() != 3 {
+		t.Fatalf("expected the history to be capped at 3 entries, found %d", h.Len())
+	}
+	if h.Last() != testLocation(5) {
+		t.Errorf("expected the last entry to be location 5")
+	}
+	checkLocations(t, h.LastN(3), 3, 4, 5)
+}
+
+func TestHistoryOrderAfterWrapAround(t *testing.T) {
+	h := newHistory(3)
+
+	// Every position in the ring is the start at some point.
+	for i := 1; i <= 9; i++ {
+		h.Append(testLocation(i))
+		if i >= 3 {
+			checkLocations(t, h.LastN(3), i-2, i-1, i)
+			checkLocations(t, h.LastN(2), i-1, i)
+			checkLocations(t, h.LastN(1), i)
+		}
+	}
+}
+
+func TestHistoryAppendAfterTrim(t *testing.T) {
+	h := newHistory(5)
+	for i := 1; i <= 3; i++ {
+		h.Append(testLocation(i))
+	}
+
+	// Trimming the front leaves free slots which are refilled before the slice grows, so the
+	// slice has to be unwrapped when it does grow.
+	h.TrimBefore(testLocation(3).timestamp)
+	checkLocations(t, h.LastN(5), 3)
+
+	for i := 4; i <= 8; i++ {
+		h.Append(testLocation(i))
+	}
+	checkLocations(t, h.LastN(5), 4, 5, 6, 7, 8)
+}
@@ -0,0 +1,240 @@
+package main
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "os"
+import "sort"
+import "strings"
+import "time"
+
+// The JSON representation of a vehicle's latest state. A null speed means we don't have enough
+// information to calculate the speed.
+type vehicleJSON struct {
+	VIN       string    `json:"vin"`
+	Fleet     string    `json:"fleet,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Speed     *float64  `json:"speed"`
+	Odometer  float64   `json:"odometer"`
+	Ignition  string    `json:"ignition,omitempty"`
+	Battery   *float64  `json:"battery,omitempty"`
+	LastSeen  time.Time `json:"last_seen"`
+	NoFix     bool      `json:"no_fix"`
+	Origin    string    `json:"origin,omitempty"`
+
+	// The vehicle's most recent status code and the time it was reported.
+	Status     string     `json:"status,omitempty"`
+	StatusTime *time.Time `json:"status_time,omitempty"`
+}
+
+// The JSON representation of a single stored location.
+type locationJSON struct {
+	Timestamp time.Time `json:"timestamp"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+}
+
+// The JSON representation of a vehicle's stored history, oldest location first.
+type historyJSON struct {
+	VIN       string         `json:"vin"`
+	Fleet     string         `json:"fleet,omitempty"`
+	Locations []locationJSON `json:"locations"`
+}
+
+// This function serves the HTTP API until the listener is closed.
+func runHTTPServer(listener net.Listener, store *fleetStore) {
+	server := &http.Server{
+		Handler:           newHTTPHandler(store),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(os.Stderr, "Error: HTTP server failed.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function returns the handler for the read-only HTTP API. The API has four endpoints:
+//
+//	GET /vehicles         -- the latest state of every vehicle in the fleet
+//	GET /vehicles/<vin>   -- the stored location history for a single vehicle
+//	GET /geojson          -- the track of every vehicle as a GeoJSON feature collection
+//	GET /geojson/<vin>    -- the track of a single vehicle as a GeoJSON feature
+//
+// If --metrics is set, [GET /metrics] serves the server's performance metrics.
+//
+// All endpoints accept an optional [?fleet=<name>] query parameter to select a namespace. If the
+// server has an auth token, requests must include it in an [Authorization: Bearer <token>] header.
+func newHTTPHandler(store *fleetStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/vehicles", func(w http.ResponseWriter, r *http.Request) {
+		if !checkHTTPRequest(w, r) {
+			return
+		}
+		handleVehiclesRequest(w, r, store)
+	})
+
+	mux.HandleFunc("/vehicles/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkHTTPRequest(w, r) {
+			return
+		}
+		vin := strings.TrimPrefix(r.URL.Path, "/vehicles/")
+		if vin == "" || strings.Contains(vin, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		handleVehicleRequest(w, r, store, vin)
+	})
+
+	mux.HandleFunc("/geojson", func(w http.ResponseWriter, r *http.Request) {
+		if !checkHTTPRequest(w, r) {
+			return
+		}
+		handleGeoJSONRequest(w, r, store)
+	})
+
+	mux.HandleFunc("/geojson/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkHTTPRequest(w, r) {
+			return
+		}
+		vin := strings.TrimPrefix(r.URL.Path, "/geojson/")
+		if vin == "" || strings.Contains(vin, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		handleGeoJSONVehicleRequest(w, r, store, vin)
+	})
+
+	if fanoutMetrics != nil {
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			if !checkHTTPRequest(w, r) {
+				return
+			}
+			handleMetricsRequest(w, r)
+		})
+	}
+
+	return mux
+}
+
+// This function checks the request's method and auth token. If the request is invalid it writes an
+// error response and returns false.
+func checkHTTPRequest(w http.ResponseWriter, r *http.Request) bool {
+	if loadSettings().verbose {
+		fmt.Println("HTTP", r.RemoteAddr, r.Method, r.URL)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !isAuthorized(map[string]string{"token": token}) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// This function handles a [GET /vehicles] request. Vehicles are sorted by VIN.
+func handleVehiclesRequest(w http.ResponseWriter, r *http.Request, store *fleetStore) {
+	namespace := r.URL.Query().Get("fleet")
+
+	store.mutex.Lock()
+	vehicles := []vehicleJSON{}
+	for key, entries := range store.fleet {
+		if key.namespace != namespace {
+			continue
+		}
+
+		last := entries.Last()
+		vehicle := vehicleJSON{
+			VIN:       key.vin,
+			Fleet:     key.namespace,
+			Timestamp: last.timestamp,
+			Latitude:  last.latitude,
+			Longitude: last.longitude,
+			Odometer:  store.odometers[key],
+			Ignition:  store.ignition[key],
+			LastSeen:  store.lastSeen[key],
+			NoFix:     store.fixLost[key],
+			Origin:    store.origins[key],
+		}
+
+		if battery, found := store.battery[key]; found {
+			vehicle.Battery = &battery
+		}
+
+		if status, found := store.status[key]; found {
+			vehicle.Status = status.code
+			vehicle.StatusTime = &status.timestamp
+		}
+
+		// A speed value of -1.0 means the speed is not available.
+		if !loadSettings().noSpeed {
+			speed := computeSpeed(entries.LastN(2))
+			if speed != -1.0 {
+				vehicle.Speed = &speed
+			}
+		}
+
+		vehicles = append(vehicles, vehicle)
+	}
+	store.mutex.Unlock()
+
+	sort.Slice(vehicles, func(i, j int) bool {
+		return vehicles[i].VIN < vehicles[j].VIN
+	})
+
+	writeJSON(w, vehicles)
+}
+
+// This function handles a [GET /vehicles/<vin>] request.
+func handleVehicleRequest(w http.ResponseWriter, r *http.Request, store *fleetStore, vin string) {
+	key := vehicleKey{namespace: r.URL.Query().Get("fleet"), vin: vin}
+
+	store.mutex.Lock()
+	entries, found := store.fleet[key]
+	var locations []location
+	if found {
+		locations = entries.LastN(entries.Len())
+	}
+	store.mutex.Unlock()
+
+	if !found {
+		http.Error(w, "unknown vehicle", http.StatusNotFound)
+		return
+	}
+
+	output := historyJSON{
+		VIN:       key.vin,
+		Fleet:     key.namespace,
+		Locations: make([]locationJSON, 0, len(locations)),
+	}
+	for _, loc := range locations {
+		output.Locations = append(output.Locations, locationJSON{
+			Timestamp: loc.timestamp,
+			Latitude:  loc.latitude,
+			Longitude: loc.longitude,
+		})
+	}
+
+	writeJSON(w, output)
+}
+
+// This function writes the value to the response as JSON.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write HTTP response.\n  -->  %s\n", err.Error())
+	}
+}
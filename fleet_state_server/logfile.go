@@ -0,0 +1,19 @@
+package main
+
+import "os"
+
+// This function redirects the server's output, i.e. its log of events and errors, to the file at
+// path, creating it if necessary. The file is opened in append mode so it can be rotated externally
+// with a copy-and-truncate strategy, e.g. logrotate's copytruncate option, without the server
+// writing past the end of the truncated file. We replace the standard streams rather than passing
+// a writer around as every log line is written to os.Stdout or os.Stderr.
+func redirectOutput(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	os.Stdout = file
+	os.Stderr = file
+	return nil
+}
@@ -1,8 +1,15 @@
 package main
 
+import "context"
+import "crypto/subtle"
+import "crypto/tls"
+import "errors"
 import "fmt"
 import "net"
 import "os"
+import "os/signal"
+import "sync"
+import "syscall"
 import "flag"
 import "time"
 import "strings"
@@ -16,29 +23,188 @@ var helptext = `Usage: fleet_state_server
   updates about a specific vehicle.
 
 Options:
+  --archive-dir <dir>       Directory for archiving every stored location to
+                            gzip-compressed CSV files.
+                            Default: no archive.
+  --archive-interval <duration>
+                            How often to write archived locations to disk.
+                            Default: "1m".
+  --auth-token <string>     Shared secret that clients must include in their
+                            requests as a [token=<secret>] field. If set,
+                            requests without the correct token are rejected.
+  --config <file>           File of options to load on startup, one per line
+                            in the format 'name value'. Command line options
+                            take precedence. Some options can be reloaded
+                            from the file by sending the server SIGHUP.
+  --field-order <string>    Order of the positional fields in vehicle packets,
+                            e.g. 'vin,timestamp,lat,long' for devices which
+                            send the VIN first.
+                            Default: 'timestamp,vin,lat,long'.
+  --format <string>         Format of vehicle packets: 'text', or 'geojson' to
+                            also accept GeoJSON Point features.
+                            Default: "text".
+  --forward-to <host:port>  Relay every accepted vehicle packet to the fleet
+                            state server at this address, e.g. to aggregate
+                            several servers.
+  --history-size <int>      Number of locations to store for each vehicle.
+                            Older locations are discarded.
+                            Default: 3600.
+  --history-window <duration>
+                            Discard locations older than this relative to
+                            the vehicle's latest location, e.g. "10m". Applies
+                            alongside --history-size.
+                            Default: no limit.
   --host <string>           IP address the server will listen on.
                             Default: "localhost".
+  --http-port <int>         Port number for the read-only HTTP JSON API.
+                            Default: disabled.
+  --log-file <path>         Append the server's output to this file instead of
+                            printing it, e.g. when running as a service.
+                            Rotate the file with copy-and-truncate.
+                            Default: print to stdout and stderr.
+  --max-bandwidth <int>     Maximum bandwidth in bytes per second for each
+                            subscriber. Updates that would exceed the limit
+                            are skipped. Zero means no limit.
+                            Default: 0.
+  --max-clock-skew <duration>
+                            Reject vehicle packets with timestamps further
+                            than this in the future, e.g. "5s".
+                            Default: no limit.
+  --max-packet-age <duration>
+                            Drop vehicle packets with timestamps older than
+                            this, e.g. "1m".
+                            Default: no limit.
+  --max-runtime <duration>  Shut down gracefully after this length of time,
+                            e.g. "10m". Useful for automated tests.
+                            Default: run until stopped.
+  --max-send-failures <int> Remove a subscriber after this many consecutive
+                            failed sends. Zero means never remove.
+                            Default: 5.
+  --max-total-subscribers <int>
+                            Maximum number of subscriptions across all
+                            vehicles. New subscriptions beyond the limit are
+                            rejected. Zero means no limit.
+                            Default: 0.
   --port <int>              Port number the server will listen on.
                             Default: 8000.
+  --precision <int>         Number of decimal places for latitude and
+                            longitude in subscriber updates, in the range
+                            [0, 9].
+                            Default: 6.
+  --readers <int>           Number of UDP sockets reading packets in
+                            parallel. Values above 1 use SO_REUSEPORT and
+                            aren't supported on all platforms.
+                            Default: 1.
+  --server-id <string>      ID of this server, e.g. its hostname. Updates from
+                            vehicles are tagged with the ID of the first
+                            server to receive them as an [origin=<id>] field.
+                            Default: no ID.
+  --smooth-measurement-noise <float>
+                            Standard deviation in meters of the position
+                            errors, for --smooth.
+                            Default: 5.0.
+  --smooth-process-noise <float>
+                            Variance of the vehicles' random accelerations
+                            in (m/s^2)^2, for --smooth.
+                            Default: 1.0.
+  --speed-bands <string>    Speed bands for band subscriptions in the format
+                            'name:min,name:min,...' with minimum speeds in
+                            m/s in increasing order, starting at 0.
+                            Default: "stopped:0,slow:1,fast:10".
+  --speed-deadband <float>  Report calculated speeds below this value in m/s
+                            as zero, to stop GPS noise giving stationary
+                            vehicles small nonzero speeds.
+                            Default: 0.
+  --speed-limit-zones <file>
+                            File of circular speed limit zones, one per line
+                            in the format '<lat>,<long> <radius> <limit>',
+                            with the radius in meters and the limit in m/s.
+                            Updates from vehicles inside a zone carry a
+                            'violation=true|false' option.
+  --speed-precision <int>   Number of decimal places for speed in subscriber
+                            updates, in the range [0, 9].
+                            Default: 6.
+  --storage <string>        Storage mode: 'history' keeps up to --history-size
+                            locations per vehicle, 'latest' keeps only the
+                            two newest locations, enough to calculate speeds.
+                            Default: "history".
+  --tls-cert <file>         Certificate file for TLS subscriptions. If set
+                            along with --tls-key, the server accepts
+                            subscriptions over TLS on the TCP port with the
+                            same number and rejects UDP subscriptions.
+                            Requires TLS 1.2 or later with Go's default
+                            cipher suites. TLS runs over TCP as Go has no
+                            DTLS implementation.
+  --tls-key <file>          Private key file for TLS subscriptions.
 
 Flags:
   -h, --help                Print this help text and exit.
+  --drain-on-start          Discard any packets already queued on the socket
+                            when the server starts, e.g. from vehicles which
+                            started first.
+  --include-odometer        Include each vehicle's cumulative distance in
+                            meters in subscriber updates.
+  --metrics                 Time each subscriber fan-out and serve a histogram
+                            of the durations at GET /metrics on the HTTP API.
+                            Requires --http-port.
+  --no-speed                Don't calculate speeds. Subscriber updates omit
+                            the speed field.
+  --print-config            Print the effective value of every option on
+                            startup.
+  --server-timestamps       Ignore the timestamps in vehicle packets and use
+                            the time each packet arrives instead.
+  --smooth                  Smooth each vehicle's positions with a Kalman
+                            filter before storing them.
+  --strict                  Reply to packets with an unknown command word with
+                            'ERROR unknown-command' instead of dropping them
+                            silently. Run with --verbose to log them instead.
   --verbose                 Print a log of all incoming packets.
 `
 
-// This command line flag turns on verbose output -- if set to true the server will print a log of
-// all incoming packets. I'm cheating here and using a global variable to avoid cluttering up the
-// code by passing the value around all the functions. In production code, we might want to pass
-// this value as an argument.
-var verbose bool
-
-// We use this type to store location updates from individual vehicles in the fleet. For each
-// vehicle, we store a list of all previous [location] updates.
-type location struct {
-	timestamp time.Time
-	latitude  float64
-	longitude float64
-}
+// If set to true, the server only accepts subscriptions over TLS.
+var tlsRequired bool
+
+// If not empty, clients must include this shared secret in their requests.
+var authToken string
+
+// The maximum number of locations we store for each vehicle.
+var historySize int
+
+// If non-zero, we only store locations within this window of each vehicle's latest location.
+var historyWindow time.Duration
+
+// The storage mode. In "history" mode we keep up to --history-size locations for each vehicle. In
+// "latest" mode we only keep the newest [latestStorageSize] locations, which saves memory for
+// deployments which never query history.
+var storageMode string
+
+const (
+	storageHistory = "history"
+	storageLatest  = "latest"
+)
+
+// The number of locations we keep for each vehicle in latest-only storage mode. This is the
+// minimum we need to calculate the vehicle's speed.
+const latestStorageSize = 2
+
+// If set to true, we smooth each vehicle's positions with a Kalman filter before storing them. The
+// process noise is the variance of the vehicle's random accelerations in (m/s^2)^2 and the
+// measurement noise is the standard deviation of the position errors in meters.
+var smooth bool
+var smoothProcessNoise float64
+var smoothMeasurementNoise float64
+
+// The number of UDP sockets reading packets in parallel.
+var readers int
+
+// If not empty, we archive every stored location to gzip-compressed files in this directory.
+var archiveDir string
+
+// If not empty, we load options from this file on startup and reload them on SIGHUP.
+var configFile string
+
+// If set to true, we discard any packets already queued on the socket when the server starts.
+var drainOnStart bool
 
 func main() {
 	// This is the IP address the server will listen on.
@@ -50,159 +216,1421 @@ func main() {
 	flag.StringVar(&port, "port", "8000", "Port number for server.")
 
 	// If set to true, we print a log of all incoming packets.
-	flag.BoolVar(&verbose, "verbose", false, "Turn on verbose output.")
+	flag.BoolVar(&flagSettings.verbose, "verbose", false, "Turn on verbose output.")
+
+	// If set to true, we reply to packets with an unknown command word.
+	flag.BoolVar(&flagSettings.strict, "strict", false, "Reply to unknown commands with an error.")
+
+	// If non-zero, we reject vehicle packets with timestamps too far in the future.
+	flag.DurationVar(&flagSettings.maxClockSkew, "max-clock-skew", 0, "Maximum clock skew for vehicles.")
+
+	// If non-zero, we drop vehicle packets with stale timestamps.
+	flag.DurationVar(&flagSettings.maxPacketAge, "max-packet-age", 0, "Maximum age of vehicle packets.")
+
+	// If non-zero, the server shuts itself down after this length of time.
+	var maxRuntime time.Duration
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "Maximum runtime for server.")
+
+	// If set, clients must include this token in their requests.
+	flag.StringVar(&authToken, "auth-token", "", "Shared secret for client requests.")
+
+	// The maximum number of locations we store for each vehicle.
+	flag.IntVar(&historySize, "history-size", 3600, "Number of locations to store per vehicle.")
+
+	flag.DurationVar(&historyWindow, "history-window", 0, "Maximum age of stored locations.")
+	flag.StringVar(&storageMode, "storage", storageHistory, "Storage mode: history or latest.")
+
+	flag.BoolVar(&smooth, "smooth", false, "Smooth positions with a Kalman filter.")
+	flag.Float64Var(&smoothProcessNoise, "smooth-process-noise", 1.0, "Kalman filter process noise.")
+	flag.Float64Var(&smoothMeasurementNoise, "smooth-measurement-noise", 5.0, "Kalman filter measurement noise.")
+
+	// If set to true, we include odometer readings in subscriber updates.
+	flag.BoolVar(&flagSettings.includeOdometer, "include-odometer", false, "Include odometer readings.")
+
+	// We remove a subscriber after this many consecutive failed sends.
+	flag.IntVar(&flagSettings.maxSendFailures, "max-send-failures", 5, "Failed sends before removing subscriber.")
+
+	// If non-zero, we limit the total number of subscriptions.
+	flag.IntVar(&flagSettings.maxTotalSubscribers, "max-total-subscribers", 0, "Maximum number of subscriptions.")
+
+	// If non-zero, we limit each subscriber's bandwidth.
+	flag.IntVar(&flagSettings.maxBandwidth, "max-bandwidth", 0, "Maximum bytes per second per subscriber.")
+
+	// If set to true, we ignore vehicle timestamps.
+	flag.BoolVar(&flagSettings.serverTimestamps, "server-timestamps", false, "Timestamp packets on arrival.")
+
+	// If set, we archive locations to disk.
+	flag.StringVar(&archiveDir, "archive-dir", "", "Directory for archived locations.")
+
+	var archiveInterval time.Duration
+	flag.DurationVar(&archiveInterval, "archive-interval", time.Minute, "How often to archive locations.")
+
+	// If set, we relay accepted vehicle packets to this upstream server.
+	var forwardTo string
+	flag.StringVar(&forwardTo, "forward-to", "", "Address of an upstream server.")
+
+	// If greater than 1, we read packets from several sockets in parallel.
+	flag.IntVar(&readers, "readers", 1, "Number of UDP reader sockets.")
+
+	// If set to true, we don't calculate speeds.
+	flag.BoolVar(&flagSettings.noSpeed, "no-speed", false, "Omit speeds from updates.")
+
+	// Speeds below the deadband are reported as zero.
+	flag.Float64Var(&flagSettings.speedDeadband, "speed-deadband", 0, "Report speeds below this as zero.")
+
+	// The number of decimal places in update packets.
+	flag.IntVar(&flagSettings.coordinatePrecision, "precision", 6, "Decimal places for coordinates.")
+	flag.IntVar(&flagSettings.speedPrecision, "speed-precision", 6, "Decimal places for speed.")
+
+	flag.StringVar(&flagSettings.bandsArg, "speed-bands", "stopped:0,slow:1,fast:10", "Speed bands.")
+
+	// If set, we serve the read-only HTTP API on this port.
+	var httpPort string
+	flag.StringVar(&httpPort, "http-port", "", "Port number for HTTP API.")
+
+	// The order of the positional fields in vehicle packets.
+	var format string
+	flag.StringVar(&format, "format", "text", "Format of vehicle packets.")
+
+	var fieldOrderSpec string
+	flag.StringVar(&fieldOrderSpec, "field-order", "timestamp,vin,lat,long", "Order of vehicle packet fields.")
+
+	// If set to true, we record subscriber fan-out metrics for the HTTP API.
+	var metrics bool
+	flag.BoolVar(&metrics, "metrics", false, "Serve fan-out metrics on the HTTP API.")
+
+	// If set, we flag updates from vehicles breaking the speed limit of a zone.
+	var zonesFile string
+	flag.StringVar(&zonesFile, "speed-limit-zones", "", "File of speed limit zones.")
+
+	// The certificate and private key files for TLS subscriptions.
+	var tlsCert, tlsKey string
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file for TLS.")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file for TLS.")
+
+	// If set to true, we discard packets queued before the server is ready.
+	flag.BoolVar(&drainOnStart, "drain-on-start", false, "Discard queued packets on startup.")
+
+	// If set, we load options from this file and reload them on SIGHUP.
+	flag.StringVar(&configFile, "config", "", "Config file.")
+
+	// If set, we append our output to this file instead of printing it.
+	var logPath string
+	flag.StringVar(&logPath, "log-file", "", "Log file.")
+
+	// If set, we tag vehicle packets we receive directly with this ID.
+	flag.StringVar(&serverID, "server-id", "", "ID of this server.")
+
+	// If set to true, we print the effective settings on startup.
+	var showConfig bool
+	flag.BoolVar(&showConfig, "print-config", false, "Print the effective settings.")
 
 	flag.Usage = func() {
 		fmt.Print(helptext)
 	}
 
 	flag.Parse()
-	runServer(host, port)
-}
 
-func runServer(host string, port string) {
-	serverAddr, err := net.ResolveUDPAddr("udp", host+":"+port)
+	// Options set on the command line take precedence over the config file.
+	if configFile != "" {
+		err := applyConfigFile(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to load config file '%s'.\n  -->  %s\n", configFile, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// In latest-only mode the history size is fixed so the history options make no sense.
+	historySet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "history-size" || f.Name == "history-window" {
+			historySet = true
+		}
+	})
+
+	size, err := storageCapacity(storageMode, historySize, historySet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		os.Exit(1)
+	}
+	historySize = size
+
+	// We need at least two locations to calculate a vehicle's speed.
+	if historySize < 2 {
+		fmt.Fprintf(os.Stderr, "Error: the history size must be at least 2.\n")
+		os.Exit(1)
+	}
+
+	if smoothProcessNoise <= 0 || smoothMeasurementNoise <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: the smoothing noise values must be greater than zero.\n")
+		os.Exit(1)
+	}
+
+	// Vehicles send an update every second so a shorter window could leave too few locations.
+	if historyWindow < 0 || (historyWindow > 0 && historyWindow < 2*time.Second) {
+		fmt.Fprintf(os.Stderr, "Error: the history window must be at least 2s.\n")
+		os.Exit(1)
+	}
+
+	err = publishSettings()
 	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Error: unable to resolve server address '%s:%s'.\n  -->  %s\n",
-			host,
-			port,
-			err.Error())
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	if archiveDir != "" {
+		if archiveInterval < time.Second {
+			fmt.Fprintf(os.Stderr, "Error: the archive interval must be at least 1s.\n")
+			os.Exit(1)
+		}
+
+		info, err := os.Stat(archiveDir)
+		if err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "Error: the archive directory '%s' does not exist.\n", archiveDir)
+			os.Exit(1)
+		}
+	}
+
+	if readers < 1 {
+		fmt.Fprintf(os.Stderr, "Error: the number of readers must be at least 1.\n")
+		os.Exit(1)
+	}
+
+	if forwardTo != "" {
+		addr, err := net.ResolveUDPAddr("udp", forwardTo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to resolve upstream address '%s'.\n  -->  %s\n", forwardTo, err.Error())
+			os.Exit(1)
+		}
+		forwardAddr = addr
+	}
+
+	if metrics {
+		if httpPort == "" {
+			fmt.Fprintf(os.Stderr, "Error: --metrics requires --http-port.\n")
+			os.Exit(1)
+		}
+		fanoutMetrics = newFanoutHistogram()
+	}
+
+	if serverID != "" && !isValidServerID(serverID) {
+		fmt.Fprintf(os.Stderr, "Error: invalid server ID '%s'. Use 1-64 letters, digits, '-', '_', or '.'.\n", serverID)
+		os.Exit(1)
+	}
+
+	if format != "text" && format != "geojson" {
+		fmt.Fprintf(os.Stderr, "Error: the format must be 'text' or 'geojson'.\n")
 		os.Exit(1)
 	}
+	acceptGeoJSON = format == "geojson"
 
-	listener, err := net.ListenUDP("udp", serverAddr)
+	fieldOrder, err = parseFieldOrder(fieldOrderSpec)
 	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Error: unable to initialize listener on '%s'.\n  -->  %s\n",
-			serverAddr,
-			err.Error())
+		fmt.Fprintf(os.Stderr, "Error: invalid field order '%s'.\n  -->  %s\n", fieldOrderSpec, err.Error())
 		os.Exit(1)
 	}
-	defer listener.Close()
+
+	if zonesFile != "" {
+		zones, err := loadSpeedZones(zonesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to load speed limit zones.\n  -->  %s\n", err.Error())
+			os.Exit(1)
+		}
+		speedZones = zones
+	}
+
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			fmt.Fprintf(os.Stderr, "Error: --tls-cert and --tls-key must be used together.\n")
+			os.Exit(1)
+		}
+
+		config, err := loadTLSConfig(tlsCert, tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to load TLS certificate.\n  -->  %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		tlsConfig = config
+		tlsRequired = true
+	}
+
+	// Errors in the options above are printed to the terminal. From here on everything goes to the
+	// log file, including errors starting the server.
+	if logPath != "" {
+		err := redirectOutput(logPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to open log file '%s'.\n  -->  %s\n", logPath, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if showConfig {
+		printConfig()
+	}
+
+	// Shut down gracefully when we receive a signal or the maximum runtime elapses.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+
+	err = runServer(ctx, host, port, httpPort, archiveInterval, tlsConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to run server.\n  -->  %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// This function runs the server until the context is cancelled, then shuts down gracefully. If
+// the context has a deadline, e.g. from --max-runtime, the server shuts down when it expires. If
+// tlsConfig is not nil the server also accepts subscriptions over TLS. If httpPort is not empty the
+// server also serves the read-only HTTP API on that port. If --archive-dir is set the server writes
+// new locations to the archive every archiveInterval.
+//
+// The function returns an error if the server fails to start. It doesn't exit the process so it
+// can be embedded in a larger program.
+func runServer(ctx context.Context, host string, port string, httpPort string, archiveInterval time.Duration, tlsConfig *tls.Config) error {
+	serverAddr, err := net.ResolveUDPAddr("udp", host+":"+port)
+	if err != nil {
+		return fmt.Errorf("unable to resolve server address '%s:%s': %w", host, port, err)
+	}
+
+	listeners, err := listenReaders(serverAddr)
+	if isAddrInUse(err) {
+		return portInUseError(port, "--port")
+	}
+	if err != nil {
+		return fmt.Errorf("unable to initialize listener on '%s': %w", serverAddr, err)
+	}
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
+
+	// If TLS is enabled, we also listen for TLS subscriptions on the TCP port with the same number.
+	var tlsListener net.Listener
+	if tlsConfig != nil {
+		tlsListener, err = tls.Listen("tcp", serverAddr.String(), tlsConfig)
+		if isAddrInUse(err) {
+			return portInUseError(port, "--port")
+		}
+		if err != nil {
+			return fmt.Errorf("unable to initialize TLS listener on '%s': %w", serverAddr, err)
+		}
+		defer tlsListener.Close()
+	}
+
+	var httpListener net.Listener
+	if httpPort != "" {
+		httpAddr := net.JoinHostPort(host, httpPort)
+		httpListener, err = net.Listen("tcp", httpAddr)
+		if isAddrInUse(err) {
+			return portInUseError(httpPort, "--http-port")
+		}
+		if err != nil {
+			return fmt.Errorf("unable to initialize HTTP listener on '%s': %w", httpAddr, err)
+		}
+		defer httpListener.Close()
+	}
 
 	fmt.Println("--------------------------")
 	fmt.Println("Running Fleet State Server")
 	fmt.Println("--------------------------")
 	fmt.Printf("Host: %s\n", host)
 	fmt.Printf("Port: %s\n", port)
+	if tlsConfig != nil {
+		fmt.Printf("TLS:  enabled\n")
+	}
+	if httpListener != nil {
+		fmt.Printf("HTTP: %s\n", httpPort)
+	}
 	fmt.Printf("Exit: Ctrl-C\n")
 	fmt.Println("--------------------------")
 
-	// This is the server's primary data store. Each key is a VIN string. Each value is a list of
-	// timestamped [location] structs for that vehicle.
-	fleet := make(map[string][]location)
+	store := newFleetStore()
 
-	// This is the server's subscriber store. Each key is a VIN string. Each value is a list of
-	// subscriber client addresses for that VIN.
-	subscribers := make(map[string][]*net.UDPAddr)
+	// We forward packets from the first listening socket so the upstream server sees a single
+	// source address.
+	if forwardAddr != nil {
+		store.upstream = packetPeer{conn: listeners[0], addr: forwardAddr}
+	}
 
-	// This is the server loop -- it will continue to listen for incoming UDP packets until the
-	// user terminates the server with Ctrl-C.
-	for {
-		buffer := make([]byte, 256)
+	// Shut down gracefully when the context is cancelled. We notify subscribers before closing the
+	// listener as UDP subscribers receive their updates from the listening socket. Closing the
+	// listener unblocks the server loop below.
+	go func() {
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			fmt.Println("\nMaximum runtime elapsed.")
+		}
+		broadcastShutdown(store)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		if tlsListener != nil {
+			tlsListener.Close()
+		}
+		if httpListener != nil {
+			httpListener.Close()
+		}
+	}()
+
+	if tlsListener != nil {
+		go runTLSListener(tlsListener, store)
+	}
 
-		n, addr, err := listener.ReadFromUDP(buffer)
+	if httpListener != nil {
+		go runHTTPServer(httpListener, store)
+	}
+
+	if configFile != "" {
+		go runConfigReloader(ctx, configFile)
+	}
+
+	go runBatchFlusher(ctx, store)
+
+	var archiverDone chan struct{}
+	var archiverStopped chan struct{}
+	if archiveDir != "" {
+		archiverDone = make(chan struct{})
+		archiverStopped = make(chan struct{})
+		go func() {
+			runArchiver(store, archiveDir, archiveInterval, archiverDone)
+			close(archiverStopped)
+		}()
+	}
+
+	// Each listener is read by its own goroutine. The store's mutex serializes the packet handling.
+	// If --drain-on-start is set, we discard any packets which queued up before we were ready so
+	// stale data doesn't skew the first speed calculations.
+	if drainOnStart {
+		drained := 0
+		for _, listener := range listeners {
+			drained += drainPackets(listener)
+		}
+		fmt.Printf("Drained %d queued packets.\n", drained)
+	}
+
+	var group sync.WaitGroup
+	for _, listener := range listeners {
+		group.Add(1)
+		go func(listener packetConn) {
+			defer group.Done()
+			serve(listener, store)
+		}(listener)
+	}
+	group.Wait()
+
+	// Deliver the SHUTDOWN notices and flushed batches still queued for TLS subscribers.
+	closeTLSPeers(store)
+
+	// Write any remaining locations to the archive before we exit.
+	if archiverDone != nil {
+		close(archiverDone)
+		<-archiverStopped
+	}
+
+	fmt.Println("\n--------------------------")
+	fmt.Println("Shutting down.")
+	fmt.Println("--------------------------")
+
+	return nil
+}
+
+// This function returns the listeners for the server's UDP port. If --readers is greater than 1 we
+// bind that many sockets to the same address using SO_REUSEPORT. If the port number is 0, the
+// first socket picks a port and the others bind to the same one.
+func listenReaders(addr *net.UDPAddr) ([]packetConn, error) {
+	if readers == 1 {
+		listener, err := listenUDP(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []packetConn{listener}, nil
+	}
+
+	var listeners []packetConn
+	for i := 0; i < readers; i++ {
+		listener, err := listenUDPReusePort(addr)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		addr = listener.LocalAddr().(*net.UDPAddr)
+	}
+
+	return listeners, nil
+}
+
+// This function sends a [SHUTDOWN] packet to every current subscriber so clients know the server
+// is going away rather than just going silent. A client subscribed to several vehicles receives a
+// single packet.
+func broadcastShutdown(store *fleetStore) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Send any batched updates first so subscribers don't lose them.
+	flushBatches(store, store.clock(), true)
+
+	notified := make(map[string]bool)
+	for _, subscribers := range store.subscribers {
+		for _, sub := range subscribers {
+			if notified[sub.peer.String()] {
+				continue
+			}
+			notified[sub.peer.String()] = true
+
+			err := sub.peer.send("SHUTDOWN")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to send shutdown notice.\n  -->  %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// This is the server loop -- it will continue to listen for incoming packets on the connection until
+// the connection is closed. Replies and subscriber updates for peers that contact us on this
+// connection are sent from the same connection.
+func serve(conn packetConn, store *fleetStore) {
+	buffer := make([]byte, maxPacketSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: invalid read.\n.  -->  %s\n", err.Error())
 			continue
 		}
 
-		handlePacket(addr, string(buffer[:n]), fleet, subscribers)
+		source := packetPeer{conn: conn, addr: addr}
+		for _, message := range splitMessages(buffer[:n]) {
+			handlePacket(source, message, store)
+		}
+	}
+}
+
+// This type is the signature shared by the handlers in [commandHandlers].
+type packetHandler func(source peer, message string, store *fleetStore)
+
+// Request packets from clients and HEARTBEAT packets from vehicles begin with a command word. This
+// map dispatches each packet to the handler for its command word.
+var commandHandlers = map[string]packetHandler{
+	"SUBSCRIBE":   handleSubscriberPacket,
+	"UNSUBSCRIBE": handleUnsubscribePacket,
+	"SPEED":       handleSpeedPacket,
+	"STATS":       handleStatsPacket,
+	"SNAPSHOT":    handleSnapshotPacket,
+	"HISTORY":     handleHistoryPacket,
+	"FLEETSTATS":  handleFleetStatsPacket,
+	"SETRATE":     handleSetRatePacket,
+	"HEARTBEAT":   handleHeartbeatPacket,
+}
+
+// This function returns the number of locations to store for each vehicle in the storage mode.
+// In "history" mode this is the --history-size. In "latest" mode it's [latestStorageSize], so
+// historySet, which is true if --history-size or --history-window was set, is an error.
+func storageCapacity(mode string, historySize int, historySet bool) (int, error) {
+	switch mode {
+	case storageHistory:
+		return historySize, nil
+	case storageLatest:
+		if historySet {
+			return 0, fmt.Errorf("--storage latest can't be used with --history-size or --history-window")
+		}
+		return latestStorageSize, nil
+	default:
+		return 0, fmt.Errorf("invalid storage mode '%s'", mode)
 	}
 }
 
-// This function handles incoming UDP packets. It assumes that packets are either SUBSCRIBE requests
-// from clients or update packets from vehicles.
-func handlePacket(source *net.UDPAddr, message string, fleet map[string][]location, subscribers map[string][]*net.UDPAddr) {
-	if verbose {
+// This function handles incoming packets. Packets beginning with a command word in
+// [commandHandlers] are dispatched to its handler. Update packets from vehicles begin with a
+// timestamp rather than a command word, or with the VIN if the --field-order puts it first.
+// Anything else is an unknown command.
+func handlePacket(source peer, message string, store *fleetStore) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if loadSettings().verbose {
 		fmt.Println(source, ">>", message)
 	}
 
-	if strings.HasPrefix(message, "SUBSCRIBE") {
-		handleSubscriberPacket(source, message, subscribers)
+	command := message
+	if index := strings.Index(message, " "); index >= 0 {
+		command = message[:index]
+	}
+
+	if handler, found := commandHandlers[command]; found {
+		handler(source, message, store)
+	} else if isCommandWord(command) && !vinFirst() {
+		handleUnknownCommand(source, command, store)
 	} else {
-		handleVehiclePacket(message, fleet, subscribers)
+		handleVehiclePacket(source, message, store)
 	}
 }
 
-// This function handles incoming SUBSCRIBE packets from clients. A SUBSCRIBE request packet is
-// assumed to have the format: [SUBSCRIBE <vin>]. The subscriber's address is added to the list
-// of subscribers for that VIN.
-func handleSubscriberPacket(source *net.UDPAddr, message string, subscribers map[string][]*net.UDPAddr) {
-	elements := strings.Split(message, " ")
+// This function returns true if the word looks like a command word, i.e. it consists of uppercase
+// letters and hyphens. A timestamp can't look like a command word so update packets are never
+// mistaken for commands.
+func isCommandWord(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, char := range word {
+		if (char < 'A' || char > 'Z') && char != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// This function handles a packet with an unknown command word, e.g. from a newer client or a
+// misrouted packet. We drop it silently unless --verbose is set, in which case we log it, or
+// --strict is set, in which case we reply with [ERROR unknown-command].
+func handleUnknownCommand(source peer, command string, store *fleetStore) {
+	settings := loadSettings()
+
+	store.recordDrop(dropUnknownCommand)
+
+	if settings.verbose {
+		fmt.Fprintf(os.Stderr, "Warning: unknown command '%s' from %s.\n", command, source)
+	}
+
+	if settings.strict {
+		replyError(source, "unknown-command")
+	}
+}
+
+// Packets can end with optional fields in the format [<key>=<value>]. This function splits a
+// packet into its positional fields and a map of its optional fields. Unrecognised optional fields
+// are ignored by the handlers so older servers can accept packets from newer senders.
+func splitFields(message string) ([]string, map[string]string) {
+	var fields []string
+	options := make(map[string]string)
+
+	for _, element := range strings.Split(message, " ") {
+		if index := strings.Index(element, "="); index >= 0 {
+			options[element[:index]] = element[index+1:]
+		} else {
+			fields = append(fields, element)
+		}
+	}
+
+	return fields, options
+}
+
+// This function returns true if the request's options include the correct auth token or if no
+// auth token is configured. We use a constant-time comparison to avoid leaking the token through
+// response timing.
+func isAuthorized(options map[string]string) bool {
+	if authToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(options["token"]), []byte(authToken)) == 1
+}
+
+// This function sends an error reply in the format [ERROR <code>] to the source of a request.
+func replyError(source peer, code string) {
+	err := source.send("ERROR " + code)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to send error reply.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function handles incoming SPEED packets from clients. A SPEED request packet is assumed to
+// have the format: [SPEED <vin> [fleet=<name>] [token=<secret>]]. The server replies once to the sender with an
+// update packet for the vehicle, or with [ERROR unknown-vehicle] if it has no data for that VIN.
+// This is a lightweight alternative to a subscription for clients that just want to poll.
+func handleSpeedPacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
 	if len(elements) != 2 {
-		fmt.Fprintf(os.Stderr, "Error: invalid subscriber packet.\n")
+		fmt.Fprintf(os.Stderr, "Error: invalid speed packet.\n")
+		store.recordDrop(dropInvalidPacket)
+		return
+	}
+
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
 		return
 	}
 
-	vin := elements[1]
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
 
-	if _, ok := subscribers[vin]; ok {
-		subscribers[vin] = append(subscribers[vin], source)
-	} else {
-		subscribers[vin] = []*net.UDPAddr{source}
+	reply := "ERROR unknown-vehicle"
+	if _, found := store.fleet[key]; found {
+		reply = formatUpdate(store, key)
+	}
+
+	err := source.send(reply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to send speed reply.\n  -->  %s\n", err.Error())
 	}
 }
 
-// This function handles incoming update packets from vehicles. An update packet is assumed to have
-// the format: [<timestamp> <vin> <latitude> <longitude>].
-func handleVehiclePacket(message string, fleet map[string][]location, subscribers map[string][]*net.UDPAddr) {
-	elements := strings.Split(message, " ")
-	if len(elements) != 4 {
-		fmt.Fprintf(os.Stderr, "Error: invalid vehicle packet.\n")
+// This function handles incoming STATS packets from clients. A STATS request packet is assumed to
+// have the format: [STATS <vin> [fleet=<name>] [token=<secret>]]. The server replies once to the sender with the
+// vehicle's subscriber delivery statistics in the format: [STATS <vin> total=<n> failed=<n>
+// last-sent=<timestamp> lost=<n> [fleet=<name>]]. Here, total is the number of attempted sends and
+// failed is the number of sends that failed. The last-sent field is [never] if no update has been
+// delivered. The lost field is the number of the vehicle's packets detected as lost.
+func handleStatsPacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 1 && len(elements) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: invalid stats packet.\n")
+		store.recordDrop(dropInvalidPacket)
 		return
 	}
 
-	timestamp, err := time.Parse(time.RFC3339Nano, elements[0])
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
+		return
+	}
+
+	// A STATS packet without a VIN requests the server-wide drop counters.
+	if len(elements) == 1 {
+		err := source.send("STATS " + formatDrops(store))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to send stats reply.\n  -->  %s\n", err.Error())
+		}
+		return
+	}
+
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
+	stats := store.deliveryStatsFor(key)
+
+	lastSent := "never"
+	if !stats.lastSent.IsZero() {
+		lastSent = stats.lastSent.UTC().Format(time.RFC3339Nano)
+	}
+
+	lost := store.sequenceTrackerFor(key).lost
+
+	reply := fmt.Sprintf(
+		"STATS %s total=%d failed=%d last-sent=%s lost=%d",
+		key.vin,
+		stats.total,
+		stats.failed,
+		lastSent,
+		lost)
+	if key.namespace != "" {
+		reply += " fleet=" + key.namespace
+	}
+
+	err := source.send(reply)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: invalid timestamp.\n")
+		fmt.Fprintf(os.Stderr, "Error: failed to send stats reply.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function handles incoming SNAPSHOT packets from clients. A SNAPSHOT request packet is assumed
+// to have the format: [SNAPSHOT [fleet=<name>] [token=<secret>]]. The server replies with one packet
+// for each vehicle in the namespace in the format [SNAPSHOT <update>], where <update> has the same
+// format as a subscriber update packet. The server then sends a final [SNAPSHOT-END <count>] packet.
+func handleSnapshotPacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 1 {
+		fmt.Fprintf(os.Stderr, "Error: invalid snapshot packet.\n")
+		store.recordDrop(dropInvalidPacket)
 		return
 	}
 
-	vin := elements[1]
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
+		return
+	}
+
+	sendSnapshot(source, store, options["fleet"])
+}
+
+// This function sends a snapshot of every vehicle in the namespace to the source of a request: a
+// [SNAPSHOT <update>] packet for each vehicle followed by a [SNAPSHOT-END <count>] packet.
+func sendSnapshot(source peer, store *fleetStore, namespace string) {
+	count := 0
+	for key := range store.fleet {
+		if key.namespace != namespace {
+			continue
+		}
+
+		err := source.send("SNAPSHOT " + formatUpdate(store, key))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to send snapshot reply.\n  -->  %s\n", err.Error())
+			return
+		}
+		count++
+	}
 
-	latitude, err := strconv.ParseFloat(elements[2], 64)
+	err := source.send(fmt.Sprintf("SNAPSHOT-END %d", count))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: invalid latitude.\n")
+		fmt.Fprintf(os.Stderr, "Error: failed to send snapshot reply.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function handles incoming HISTORY packets from clients. A HISTORY request packet is assumed
+// to have the format: [HISTORY <vin> [count=<n>] [fleet=<name>] [token=<secret>]]. The server
+// replies with one [HISTORY <update>] packet for each of the vehicle's newest n stored locations,
+// oldest first, followed by a [HISTORY-END <count>] packet. If count is omitted, the server sends
+// every stored location. An unknown vehicle simply has no history.
+//
+// History packets omit the odometer, ignition, and battery fields as the server only stores their
+// current values.
+func handleHistoryPacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: invalid history packet.\n")
+		store.recordDrop(dropInvalidPacket)
+		return
+	}
+
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
 		return
 	}
 
-	longitude, err := strconv.ParseFloat(elements[3], 64)
+	count := historySize
+	if value, found := options["count"]; found {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "Error: invalid history packet.\n")
+			store.recordDrop(dropInvalidPacket)
+			replyError(source, "invalid-count")
+			return
+		}
+		count = n
+	}
+
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
+	sent := 0
+
+	if entries, found := store.fleet[key]; found && count > 0 {
+		// We fetch one extra location so we can calculate the speed at the oldest location sent.
+		locations := entries.LastN(count + 1)
+		first := 1
+		if len(locations) <= count {
+			first = 0
+		}
+
+		for i := first; i < len(locations); i++ {
+			start := i - 1
+			if start < 0 {
+				start = 0
+			}
+
+			err := source.send("HISTORY " + formatLocation(key, locations[start:i+1]))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to send history reply.\n  -->  %s\n", err.Error())
+				return
+			}
+			sent++
+		}
+	}
+
+	err := source.send(fmt.Sprintf("HISTORY-END %d", sent))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: invalid longitude.\n")
+		fmt.Fprintf(os.Stderr, "Error: failed to send history reply.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function handles incoming UNSUBSCRIBE packets from clients. An UNSUBSCRIBE request packet is
+// assumed to have the format: [UNSUBSCRIBE <vin> [fleet=<name>] [token=<secret>]]. The sender is
+// removed from the list of subscribers for that VIN in the specified namespace.
+func handleUnsubscribePacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: invalid unsubscribe packet.\n")
+		store.recordDrop(dropInvalidPacket)
 		return
 	}
 
-	// This is the new entry for the vehicle's stored list of [location] structs.
-	new_entry := location{timestamp: timestamp, latitude: latitude, longitude: longitude}
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
+		return
+	}
 
-	// We only add the new entry to the list if its timestamp is newer than the last entry, i.e.
-	// we simply discard out-of-order packets.
-	if entry_list, found := fleet[vin]; found {
-		last_entry := entry_list[len(entry_list)-1]
-		if new_entry.timestamp.After(last_entry.timestamp) {
-			fleet[vin] = append(entry_list, new_entry)
-		} else {
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
+	store.unsubscribe(key, source)
+}
+
+// This function handles incoming SUBSCRIBE packets from clients. A SUBSCRIBE request packet is
+// assumed to have the format: [SUBSCRIBE <vin> [fleet=<name>] [token=<secret>]]. The subscriber is
+// added to the list of subscribers for that VIN in the specified namespace, replacing any existing
+// subscription from the same peer so a resent SUBSCRIBE packet doesn't double up updates. If TLS is
+// enabled, subscriptions over UDP are rejected with an [ERROR tls-required] reply. If an auth token
+// is configured, subscriptions without the correct [token=<secret>] field are rejected with an
+// [ERROR unauthorized] reply. A [status=<code>,<code>,...] field limits the subscription to updates
+// with those status codes. A [format=text|json|binary] field selects the format of the
+// subscriber's update packets. New subscriptions beyond --max-total-subscribers are rejected with
+// an [ERROR capacity] reply.
+//
+// A subscription to the VIN '*' is a wildcard subscription to every vehicle in the namespace,
+// including vehicles which appear later. Band and delta subscriptions track a single vehicle so
+// they can't be combined with a wildcard and are rejected with an [ERROR invalid-wildcard] reply.
+// A wildcard subscription with a [snapshot=true] field is followed by a reply in the same format
+// as a SNAPSHOT request. We hold the store's lock throughout so no update can fall between the
+// snapshot and the live feed.
+func handleSubscriberPacket(source peer, message string, store *fleetStore) {
+	elements, options := splitFields(message)
+	if len(elements) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: invalid subscriber packet.\n")
+		store.recordDrop(dropInvalidPacket)
+		return
+	}
+
+	if _, isUDP := source.(packetPeer); isUDP && tlsRequired {
+		store.recordDrop(dropTLSRequired)
+		replyError(source, "tls-required")
+		return
+	}
+
+	if !isAuthorized(options) {
+		store.recordDrop(dropUnauthorized)
+		replyError(source, "unauthorized")
+		return
+	}
+
+	key := vehicleKey{namespace: options["fleet"], vin: elements[1]}
+
+	if key.vin == wildcardVIN && (options["bands"] == "true" || options["delta"] == "true") {
+		replyError(source, "invalid-wildcard")
+		return
+	}
+
+	sub := &subscriber{peer: source}
+	if options["bands"] == "true" {
+		// Band subscribers need speeds. They never receive positions so the delta option is
+		// ignored.
+		if loadSettings().noSpeed {
+			replyError(source, "no-speed")
+			return
+		}
+		sub.bands = true
+	} else if options["delta"] == "true" {
+		sub.delta = &deltaState{}
+	}
+
+	if value, found := options["batch"]; found {
+		batch, err := time.ParseDuration(value)
+		if err != nil || batch <= 0 || batch > maxBatchInterval {
+			replyError(source, "invalid-batch")
+			return
+		}
+		sub.batch = batch
+	}
+
+	// Compressed packets are binary so they can't be sent over a newline-delimited TLS
+	// connection. Compression only applies to batches as single updates are always small.
+	if options["compress"] == "true" {
+		if _, isUDP := source.(packetPeer); !isUDP || sub.batch == 0 {
+			replyError(source, "invalid-compress")
+			return
+		}
+		sub.compress = true
+	}
+
+	if value, found := options["status"]; found {
+		filter, err := parseStatusFilter(value)
+		if err != nil {
+			replyError(source, "invalid-status")
+			return
+		}
+		sub.statusFilter = filter
+	}
+
+	// Band and delta updates have their own text formats. Binary packets may contain newlines so
+	// they can't be batched or sent over a newline-delimited TLS connection.
+	if value, found := options["format"]; found {
+		encoder, known := updateEncoders[value]
+		_, isUDP := source.(packetPeer)
+		invalid := !known || (value != "text" && (sub.bands || sub.delta != nil))
+		invalid = invalid || (value == "binary" && (!isUDP || sub.batch > 0))
+		if invalid {
+			replyError(source, "invalid-format")
+			return
+		}
+		sub.encode = encoder
+	}
+
+	if !store.subscribe(key, sub) {
+		store.recordDrop(dropCapacity)
+		replyError(source, "capacity")
+		return
+	}
+
+	if key.vin == wildcardVIN && options["snapshot"] == "true" {
+		sendSnapshot(source, store, key.namespace)
+	}
+}
+
+// This function applies the server's timestamp policies to a packet from a vehicle. If
+// --server-timestamps is set, we ignore the vehicle's timestamp entirely and use the time the
+// packet arrived. Otherwise packets with timestamps outside the --max-clock-skew and
+// --max-packet-age limits are dropped. It returns the timestamp to use for the packet, or false if
+// the packet has been dropped.
+func checkTimestamp(store *fleetStore, key vehicleKey, timestamp time.Time) (time.Time, bool) {
+	settings := loadSettings()
+
+	now := store.clock()
+	if settings.serverTimestamps {
+		return now.UTC(), true
+	}
+
+	if settings.maxClockSkew > 0 && timestamp.Sub(now) > settings.maxClockSkew {
+		fmt.Fprintf(os.Stderr, "Error: timestamp too far in the future.\n")
+		store.recordDrop(dropClockSkew)
+		return timestamp, false
+	}
+
+	if settings.maxPacketAge > 0 && now.Sub(timestamp) > settings.maxPacketAge {
+		if settings.verbose {
+			fmt.Printf("Dropped stale packet from %s with timestamp %s.\n", key, timestamp.Format(time.RFC3339Nano))
+		}
+		store.recordDrop(dropStale)
+		return timestamp, false
+	}
+
+	return timestamp, true
+}
+
+// This function handles incoming update packets from vehicles. An update packet is assumed to have
+// the format: [<timestamp> <vin> <latitude> <longitude> [fleet=<name>] [seq=<n>]], or the
+// positional fields can be in the --field-order. With --format geojson the packet can also be a
+// GeoJSON Point feature. The timestamp can be in either RFC3339 format or a Unix epoch time in
+// seconds. If present, the sequence number is used to count lost packets.
+func handleVehiclePacket(source peer, message string, store *fleetStore) {
+	settings := loadSettings()
+
+	if isGeoJSONPacket(message) {
+		converted, err := parseGeoJSONPacket(message)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			store.recordDrop(dropInvalidPacket)
 			return
 		}
+		message = converted
 	} else {
-		fleet[vin] = []location{new_entry}
+		message = reorderFields(message)
 	}
 
-	// If one or more clients have subscribed to updates about this particular vehicle, send
-	// each of them an update packet.
-	if subscriberList, ok := subscribers[vin]; ok {
-		sendSubscriberUpdate(subscriberList, fleet[vin], vin)
+	// If --server-timestamps is set, we ignore the vehicle's timestamp entirely and use the time
+	// the packet arrived. This trades the accuracy of the vehicle's clock for robustness against
+	// devices with bad clocks.
+	packet, err := parseVehiclePacket(message)
+	if err != nil && !(settings.serverTimestamps && errors.Is(err, errInvalidTimestamp)) {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		store.recordDrop(dropReasonFor(err))
+		return
+	}
+
+	timestamp, ok := checkTimestamp(store, packet.key, packet.timestamp)
+	if !ok {
+		return
+	}
+
+	key := packet.key
+
+	// If the vehicle includes sequence numbers in its packets, check for gaps.
+	if packet.hasSeq {
+		lost := store.sequenceTrackerFor(key).record(packet.seq)
+		if settings.verbose && lost > 0 {
+			fmt.Printf("Lost %d packet(s) from %s before seq=%d.\n", lost, key, packet.seq)
+		}
+	}
+
+	// We discard out-of-order packets, i.e. packets which aren't newer than the last packet we
+	// accepted from the vehicle.
+	if lastSeen, found := store.lastSeen[key]; found && !timestamp.After(lastSeen) {
+		store.recordDrop(dropOutOfOrder)
+		return
+	}
+	store.lastSeen[key] = timestamp
+	store.fixLost[key] = packet.noFix
+
+	// The packet has been accepted so we relay it upstream, including packets with no GPS fix. If
+	// we're the first server to receive the packet and --server-id is set, we tag it as ours.
+	fields := forwardedFields(message, 0, timestamp)
+	if packet.origin == "" && serverID != "" {
+		fields = append(fields, "origin="+serverID)
+	}
+	store.forward(fields)
+
+	if origin := packetOrigin(packet); origin != "" {
+		store.origins[key] = origin
+	} else {
+		delete(store.origins, key)
+	}
+
+	if packet.ignition != "" {
+		store.ignition[key] = packet.ignition
+	}
+
+	if packet.hasBattery {
+		store.battery[key] = packet.battery
+	}
+
+	if packet.status != "" {
+		store.status[key] = vehicleStatus{code: packet.status, timestamp: timestamp}
+	}
+
+	if packet.controlPort != 0 {
+		store.recordControlAddr(key, source, packet.controlPort)
+	}
+
+	// A packet with no GPS fix leaves the vehicle's stored position unchanged. Subscribers are
+	// told the vehicle has lost its fix.
+	if packet.noFix {
+		if store.hasSubscribers(key) {
+			sendNoFixUpdate(store, key, timestamp)
+		}
+		return
+	}
+
+	// If --smooth is set, we store the filtered position instead of the raw position.
+	latitude, longitude := packet.latitude, packet.longitude
+	if smooth {
+		latitude, longitude = store.filterFor(key).update(timestamp, latitude, longitude)
+	}
+
+	// This is the new entry for the vehicle's stored list of [location] structs.
+	new_entry := location{timestamp: timestamp, latitude: latitude, longitude: longitude}
+
+	if entries, found := store.fleet[key]; found {
+		last_entry := entries.Last()
+		entries.Append(new_entry)
+		store.odometers[key] += getDistance(
+			last_entry.latitude,
+			last_entry.longitude,
+			new_entry.latitude,
+			new_entry.longitude)
+	} else {
+		entries = newHistory(historySize)
+		entries.Append(new_entry)
+		store.fleet[key] = entries
+	}
+
+	// The new entry is the newest so trimming never empties the history.
+	if historyWindow > 0 {
+		store.fleet[key].TrimBefore(timestamp.Add(-historyWindow))
+	}
+
+	if archiveDir != "" {
+		store.archive = append(store.archive, archiveEntry{key: key, location: new_entry})
+	}
+
+	// If one or more clients have subscribed to updates about this particular vehicle, or to
+	// every vehicle in its namespace, send each of them an update packet.
+	if store.hasSubscribers(key) {
+		sendSubscriberUpdate(store, key)
 	}
 }
 
-// This function sends an update packet to each subscriber in the subscribers list.
-func sendSubscriberUpdate(subscribers []*net.UDPAddr, locations []location, vin string) {
-	// The vehicle's speed in meters per second. A value of -1.0 means we don't have enough
-	// information to calculate the speed.
+// This function sends an update packet to each subscriber to the specified vehicle, including
+// wildcard subscribers to its namespace, and records the results in the vehicle's delivery
+// statistics. A subscriber is removed after --max-send-failures
+// consecutive failed sends, e.g. if it's stopped listening or is behind a firewall.
+//
+// If --max-bandwidth is set, updates that would take a subscriber over its limit are skipped.
+// Each update describes the vehicle's latest state so skipping an update just means the
+// subscriber's next update covers both.
+//
+// There's nothing to send if we have no locations for the vehicle. This can't happen when we're
+// called right after storing a location but we check anyway rather than panicking in formatUpdate.
+func sendSubscriberUpdate(store *fleetStore, key vehicleKey) {
+	settings := loadSettings()
+
+	entries, found := store.fleet[key]
+	if !found || entries.Len() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no locations to send for %s.\n", key)
+		return
+	}
+
+	// We time the fan-out with the real clock, even under a test clock, as we're measuring the
+	// server's own performance.
+	var start time.Time
+	sends := 0
+	if fanoutMetrics != nil {
+		start = time.Now()
+	}
+
+	message := formatUpdate(store, key)
+	status := store.statusAt(key, entries.Last().timestamp)
+	stats := store.deliveryStatsFor(key)
+	now := store.clock()
+
+	// Wildcard subscribers receive the same updates as the vehicle's own subscribers. A peer
+	// subscribed both to the vehicle and to its namespace receives a single update.
+	sent := make(map[string]bool)
+	for _, subsKey := range []vehicleKey{key, wildcardKey(key.namespace)} {
+		var remaining []*subscriber
+		for _, sub := range store.subscribers[subsKey] {
+			if sent[sub.peer.String()] || (!sub.bands && !sub.wantsStatus(status)) {
+				remaining = append(remaining, sub)
+				continue
+			}
+
+			text := message
+			var next deltaState
+			var band string
+			if sub.bands {
+				var changed bool
+				text, band, changed = formatBandUpdate(store, key, sub)
+				if !changed {
+					remaining = append(remaining, sub)
+					continue
+				}
+			} else if sub.delta != nil {
+				text, next = formatDeltaUpdate(store, key, message, *sub.delta)
+			} else if sub.encode != nil {
+				text = sub.encode(message)
+			}
+			sent[sub.peer.String()] = true
+
+			if settings.maxBandwidth > 0 {
+				if !sub.allow(len(text), settings.maxBandwidth, now) {
+					if sub.skipped == 0 {
+						fmt.Printf("Throttling subscriber '%s' to %s: over %d bytes/sec.\n", sub.peer, key, settings.maxBandwidth)
+					}
+					sub.skipped++
+					remaining = append(remaining, sub)
+					continue
+				}
+				if sub.skipped > 0 {
+					fmt.Printf("Stopped throttling subscriber '%s' to %s after skipping %d updates.\n", sub.peer, key, sub.skipped)
+					sub.skipped = 0
+				}
+			}
+
+			// Batching subscribers receive their updates later, in bulk. We treat the update as
+			// sent so the subscriber's delta and band state stay in step with the updates it will
+			// receive.
+			if sub.batch > 0 {
+				if len(sub.pending) == 0 {
+					sub.batchStart = now
+				}
+				sub.pending = append(sub.pending, batchedUpdate{key: key, message: text})
+				if sub.delta != nil {
+					*sub.delta = next
+				}
+				if sub.bands {
+					sub.band = band
+				}
+				remaining = append(remaining, sub)
+				continue
+			}
+
+			stats.total++
+			sends++
+
+			err := sub.peer.send(text)
+			if err != nil {
+				stats.failed++
+				sub.failures++
+
+				// The client may not have received the update so we resync with a keyframe.
+				if sub.delta != nil {
+					sub.delta.started = false
+				}
+				fmt.Fprintf(os.Stderr, "Error: failed to send subscriber update.\n  -->  %s\n", err.Error())
+
+				if settings.maxSendFailures > 0 && sub.failures >= settings.maxSendFailures {
+					fmt.Fprintf(
+						os.Stderr,
+						"Evicted subscriber '%s' from %s after %d failed sends.\n",
+						sub.peer,
+						subsKey,
+						sub.failures)
+					continue
+				}
+			} else {
+				sub.failures = 0
+				stats.lastSent = now
+				if sub.delta != nil {
+					*sub.delta = next
+				}
+				if sub.bands {
+					sub.band = band
+				}
+			}
+
+			remaining = append(remaining, sub)
+		}
+
+		store.setSubscribers(subsKey, remaining)
+	}
+
+	if fanoutMetrics != nil {
+		fanoutMetrics.record(time.Since(start), sends)
+	}
+}
+
+// This function tells each subscriber to the specified vehicle, including wildcard subscribers to
+// its namespace, that it has no GPS fix. The packet has the format:
+// [<timestamp> <vin> nofix nofix [fleet=<name>] [status=<code>]]. Band subscribers only hear
+// about speed band changes so they're skipped, as are subscribers filtering on a different status.
+// Sends are throttled, recorded, and evicted on failure exactly as in [sendSubscriberUpdate].
+func sendNoFixUpdate(store *fleetStore, key vehicleKey, timestamp time.Time) {
+	settings := loadSettings()
+
+	message := fmt.Sprintf("%s %s %s %s", timestamp.Format(time.RFC3339Nano), key.vin, noFix, noFix)
+	if key.namespace != "" {
+		message += " fleet=" + key.namespace
+	}
+	status := store.statusAt(key, timestamp)
+	if status != "" {
+		message += " status=" + status
+	}
+	if origin, found := store.origins[key]; found {
+		message += " origin=" + origin
+	}
+	stats := store.deliveryStatsFor(key)
+	now := store.clock()
+
+	// A peer subscribed both to the vehicle and to its namespace receives a single update.
+	sent := make(map[string]bool)
+	for _, subsKey := range []vehicleKey{key, wildcardKey(key.namespace)} {
+		var remaining []*subscriber
+		for _, sub := range store.subscribers[subsKey] {
+			if sent[sub.peer.String()] || sub.bands || !sub.wantsStatus(status) {
+				remaining = append(remaining, sub)
+				continue
+			}
+
+			text := message
+			if sub.encode != nil {
+				text = sub.encode(message)
+			}
+			sent[sub.peer.String()] = true
+
+			if settings.maxBandwidth > 0 {
+				if !sub.allow(len(text), settings.maxBandwidth, now) {
+					if sub.skipped == 0 {
+						fmt.Printf("Throttling subscriber '%s' to %s: over %d bytes/sec.\n", sub.peer, key, settings.maxBandwidth)
+					}
+					sub.skipped++
+					remaining = append(remaining, sub)
+					continue
+				}
+				if sub.skipped > 0 {
+					fmt.Printf("Stopped throttling subscriber '%s' to %s after skipping %d updates.\n", sub.peer, key, sub.skipped)
+					sub.skipped = 0
+				}
+			}
+
+			if sub.batch > 0 {
+				if len(sub.pending) == 0 {
+					sub.batchStart = now
+				}
+				sub.pending = append(sub.pending, batchedUpdate{key: key, message: text})
+				remaining = append(remaining, sub)
+				continue
+			}
+
+			stats.total++
+
+			err := sub.peer.send(text)
+			if err != nil {
+				stats.failed++
+				sub.failures++
+				fmt.Fprintf(os.Stderr, "Error: failed to send no-fix update.\n  -->  %s\n", err.Error())
+
+				if settings.maxSendFailures > 0 && sub.failures >= settings.maxSendFailures {
+					fmt.Fprintf(
+						os.Stderr,
+						"Evicted subscriber '%s' from %s after %d failed sends.\n",
+						sub.peer,
+						subsKey,
+						sub.failures)
+					continue
+				}
+			} else {
+				sub.failures = 0
+				stats.lastSent = now
+			}
+
+			remaining = append(remaining, sub)
+		}
+
+		store.setSubscribers(subsKey, remaining)
+	}
+}
+
+// This function returns an update packet describing the vehicle's latest location and speed. The
+// packet has the format: [<timestamp> <vin> <latitude> <longitude> <speed> [fleet=<name>]
+// [odometer=<meters>] [ignition=on|off] [battery=<percent>] [status=<code>] [origin=<id>]]. The
+// fleet field is omitted for vehicles in the default namespace. The odometer field is only
+// included if the --include-odometer flag is set. The ignition and battery fields are only
+// included if the vehicle reports them. The status field is only included if the vehicle's latest
+// packet had one. The origin field is only included if the latest packet has an origin, see
+// [packetOrigin].
+//
+// If the --no-speed flag is set, we skip the speed calculation and the packet has no speed field.
+func formatUpdate(store *fleetStore, key vehicleKey) string {
+	message := formatLocation(key, store.fleet[key].LastN(2))
+	if loadSettings().includeOdometer {
+		message += fmt.Sprintf(" odometer=%.1f", store.odometers[key])
+	}
+	if ignition, found := store.ignition[key]; found {
+		message += " ignition=" + ignition
+	}
+	if battery, found := store.battery[key]; found {
+		message += fmt.Sprintf(" battery=%.1f", battery)
+	}
+	if status := store.statusAt(key, store.fleet[key].Last().timestamp); status != "" {
+		message += " status=" + status
+	}
+	if violation, found := checkSpeedLimit(store.fleet[key].LastN(2)); found {
+		message += fmt.Sprintf(" violation=%t", violation)
+	}
+	if origin, found := store.origins[key]; found {
+		message += " origin=" + origin
+	}
+
+	return message
+}
+
+// This function returns the core of an update packet describing the last location in the slice:
+// [<timestamp> <vin> <latitude> <longitude> <speed> [fleet=<name>]]. The speed is calculated from
+// the last two locations in the slice and is omitted if the --no-speed flag is set.
+func formatLocation(key vehicleKey, locations []location) string {
+	settings := loadSettings()
+
+	lastLocation := locations[len(locations)-1]
+	message := fmt.Sprintf(
+		"%s %s %.*f %.*f",
+		lastLocation.timestamp.Format(time.RFC3339Nano),
+		key.vin,
+		settings.coordinatePrecision,
+		lastLocation.latitude,
+		settings.coordinatePrecision,
+		lastLocation.longitude)
+	if !settings.noSpeed {
+		speed := computeSpeed(locations)
+		message += fmt.Sprintf(" %.*f", settings.speedPrecision, speed)
+	}
+	if key.namespace != "" {
+		message += " fleet=" + key.namespace
+	}
+
+	return message
+}
+
+// This function returns the vehicle's speed in meters per second calculated from its last two
+// locations. A value of -1.0 means we don't have enough information to calculate the speed. Speeds
+// below the --speed-deadband are reported as zero.
+func computeSpeed(locations []location) float64 {
 	speed := -1.0
 
 	// We need at least two locations to try calculating the speed.
@@ -219,39 +1647,22 @@ func sendSubscriberUpdate(subscribers []*net.UDPAddr, locations []location, vin
 		if duration < 2.0 {
 			distance := getDistance(loc1.latitude, loc1.longitude, loc2.latitude, loc2.longitude)
 			speed = distance / duration
-		}
-	}
-
-	lastLocation := locations[length-1]
-	timestamp := lastLocation.timestamp.Format(time.RFC3339Nano)
-	latitude := lastLocation.latitude
-	longitude := lastLocation.longitude
-	message := fmt.Sprintf("%s %s %.6f %.6f %.6f", timestamp, vin, latitude, longitude, speed)
 
-	for _, addr := range subscribers {
-		conn, err := net.DialUDP("udp", nil, addr)
-		if err != nil {
-			fmt.Fprintf(
-				os.Stderr,
-				"Error: unable to connect to subscriber address '%s'.\n  -->  %s\n",
-				addr,
-				err.Error())
-			return
+			// Snap small speeds caused by GPS noise to zero.
+			if speed < loadSettings().speedDeadband {
+				speed = 0
+			}
 		}
-
-		_, err = conn.Write([]byte(message))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to send subscriber update.\n  -->  %s\n", err.Error())
-		}
-
-		conn.Close()
 	}
+
+	return speed
 }
 
 // This function returns the great-circle distance in meters between two points on the earth's
 // surface calculated using the haversine formula. This formula remains well-conditioned for small
-// distances with an error of up to approx 0.5%. Latitude and longitude are assumed to be specified
-// in degrees.
+// distances with an error of up to approx 0.5%. It also handles points either side of the
+// antimeridian as the sine of half the longitude difference wraps correctly. Latitude and longitude
+// are assumed to be specified in degrees.
 // Ref: http://www.movable-type.co.uk/scripts/latlong.html
 func getDistance(lat1, long1, lat2, long2 float64) float64 {
 	// Average radius of the earth in meters.
@@ -271,3 +1682,23 @@ func getDistance(lat1, long1, lat2, long2 float64) float64 {
 
 	return earthRadius * c
 }
+
+// This function prints the effective value of every command line option, including defaults and
+// any values resolved during validation. It's useful for debugging misconfiguration. The auth token
+// is redacted so the output can be shared safely.
+func printConfig() {
+	fmt.Println("--------------------------")
+	fmt.Println("Configuration")
+	fmt.Println("--------------------------")
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == "" {
+			value = `""`
+		}
+		if f.Name == "auth-token" && f.Value.String() != "" {
+			value = "<redacted>"
+		}
+		fmt.Printf("%-28s%s\n", "--"+f.Name, value)
+	})
+	fmt.Println("--------------------------")
+}
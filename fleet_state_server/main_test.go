@@ -0,0 +1,436 @@
+package main
+
+import "fmt"
+import "math"
+import "strings"
+import "testing"
+import "time"
+
+// The time the test store's clock is fixed at.
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// This function publishes the server's default settings, modified by the callback if it isn't nil,
+// for the duration of the test.
+func useTestSettings(t testing.TB, modify func(settings *serverSettings)) {
+	t.Helper()
+
+	flagSettings = serverSettings{
+		maxSendFailures:     5,
+		bandsArg:            "stopped:0,slow:1,fast:10",
+		coordinatePrecision: 6,
+		speedPrecision:      6,
+	}
+	if modify != nil {
+		modify(&flagSettings)
+	}
+
+	err := publishSettings()
+	if err != nil {
+		t.Fatalf("invalid test settings: %v", err)
+	}
+}
+
+// This function returns an empty store with the default settings and a clock fixed at [testNow].
+func newTestStore(t testing.TB) *fleetStore {
+	t.Helper()
+
+	useTestSettings(t, nil)
+
+	previous := historySize
+	historySize = 10
+	t.Cleanup(func() {
+		historySize = previous
+	})
+
+	store := newFleetStore()
+	store.clock = func() time.Time {
+		return testNow
+	}
+	return store
+}
+
+// This function returns a vehicle packet from the vehicle at the time offset from [testNow].
+func testPacket(vin string, offset time.Duration, latitude string, longitude string) string {
+	timestamp := testNow.Add(offset).Format(time.RFC3339Nano)
+	return strings.Join([]string{timestamp, vin, latitude, longitude}, " ")
+}
+
+func TestSendSubscriberUpdate(t *testing.T) {
+	store := newTestStore(t)
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+	bystander := network.listen("bystander")
+
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE VIN1", store)
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("bystander")}, "SUBSCRIBE VIN2", store)
+
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, testPacket("VIN1", -time.Second, "53.000000", "-6.000000"), store)
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, testPacket("VIN1", 0, "53.000100", "-6.000000"), store)
+
+	updates := watcher.pending()
+	if len(updates) != 2 {
+		t.Fatalf("expected 2 updates, found %d: %q", len(updates), updates)
+	}
+
+	// 0.0001 degrees of latitude is about 11.1m so the vehicle moved at about 11.1 m/s.
+	fields := strings.Fields(updates[1])
+	expected := []string{testNow.Format(time.RFC3339Nano), "VIN1", "53.000100", "-6.000000"}
+	if len(fields) != 5 || strings.Join(fields[:4], " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected update '%s'", updates[1])
+	}
+	if !strings.HasPrefix(fields[4], "11.1") {
+		t.Errorf("expected a speed of about 11.1 m/s, found %s", fields[4])
+	}
+
+	if messages := bystander.pending(); len(messages) != 0 {
+		t.Errorf("expected no updates for another vehicle's subscriber, found %q", messages)
+	}
+}
+
+func TestSendSubscriberUpdateEvictsFailingSubscriber(t *testing.T) {
+	store := newTestStore(t)
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.maxSendFailures = 2
+	})
+
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+
+	// Sends from a closed connection always fail.
+	broken := network.listen("broken")
+	broken.Close()
+
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE VIN1", store)
+	handlePacket(packetPeer{conn: broken, addr: memoryAddr("gone")}, "SUBSCRIBE VIN1", store)
+
+	key := vehicleKey{vin: "VIN1"}
+	for i := 0; i < 3; i++ {
+		packet := testPacket("VIN1", time.Duration(i-3)*time.Second, "53.000000", "-6.000000")
+		handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, packet, store)
+
+		expected := 2
+		if i >= 1 {
+			expected = 1
+		}
+		if len(store.subscribers[key]) != expected {
+			t.Fatalf("after %d updates expected %d subscribers, found %d", i+1, expected, len(store.subscribers[key]))
+		}
+	}
+
+	if updates := watcher.pending(); len(updates) != 3 {
+		t.Errorf("expected the healthy subscriber to receive 3 updates, found %d", len(updates))
+	}
+	if store.subscriberCount != 1 {
+		t.Errorf("expected a subscriber count of 1, found %d", store.subscriberCount)
+	}
+}
+
+func TestSendNoFixUpdateEvictsFailingSubscriber(t *testing.T) {
+	store := newTestStore(t)
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.maxSendFailures = 2
+	})
+
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+
+	// Sends from a closed connection always fail.
+	broken := network.listen("broken")
+	broken.Close()
+
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE VIN1", store)
+	handlePacket(packetPeer{conn: broken, addr: memoryAddr("gone")}, "SUBSCRIBE VIN1", store)
+
+	key := vehicleKey{vin: "VIN1"}
+	for i := 0; i < 3; i++ {
+		packet := testPacket("VIN1", time.Duration(i-3)*time.Second, noFix, noFix)
+		handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, packet, store)
+	}
+
+	if len(store.subscribers[key]) != 1 || store.subscriberCount != 1 {
+		t.Fatalf("expected the failing subscriber to be evicted, found %d subscribers", len(store.subscribers[key]))
+	}
+	if updates := watcher.pending(); len(updates) != 3 {
+		t.Errorf("expected the healthy subscriber to receive 3 no-fix updates, found %d", len(updates))
+	}
+
+	stats := store.stats[key]
+	if stats == nil || stats.total != 5 || stats.failed != 2 || !stats.lastSent.Equal(testNow) {
+		t.Errorf("expected 5 sends with 2 failures, found %+v", stats)
+	}
+}
+
+func TestOverlappingSubscriptionsReceiveOneUpdate(t *testing.T) {
+	store := newTestStore(t)
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+	source := packetPeer{conn: server, addr: memoryAddr("watcher")}
+	vehicle := packetPeer{conn: server, addr: memoryAddr("vehicle")}
+
+	// The watcher is subscribed to the vehicle and to every vehicle in its namespace.
+	handlePacket(source, "SUBSCRIBE VIN1", store)
+	handlePacket(source, "SUBSCRIBE * snapshot=true", store)
+	watcher.pending()
+
+	handlePacket(vehicle, testPacket("VIN1", -2*time.Second, "53.000000", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN1", -time.Second, "53.000100", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN1", 0, noFix, noFix), store)
+
+	if updates := watcher.pending(); len(updates) != 3 {
+		t.Errorf("expected one update per packet, found %d: %q", len(updates), updates)
+	}
+
+	stats := store.stats[vehicleKey{vin: "VIN1"}]
+	if stats == nil || stats.total != 3 || stats.failed != 0 {
+		t.Errorf("expected 3 sends, found %+v", stats)
+	}
+}
+
+func TestCheckTimestampClockSkew(t *testing.T) {
+	store := newTestStore(t)
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.maxClockSkew = 5 * time.Second
+	})
+	key := vehicleKey{vin: "VIN1"}
+
+	for _, offset := range []time.Duration{-time.Hour, 0, 5 * time.Second} {
+		_, ok := checkTimestamp(store, key, testNow.Add(offset))
+		if !ok {
+			t.Errorf("expected a timestamp %s from now to be accepted", offset)
+		}
+	}
+
+	_, ok := checkTimestamp(store, key, testNow.Add(5*time.Second+time.Millisecond))
+	if ok {
+		t.Errorf("expected a timestamp beyond the clock skew to be rejected")
+	}
+	if store.drops[dropClockSkew] != 1 {
+		t.Errorf("expected 1 clock-skew drop, found %d", store.drops[dropClockSkew])
+	}
+
+	// Epoch timestamps are subject to the same limit.
+	server := newMemoryNetwork().listen("server")
+	future := testNow.Add(time.Minute).Unix()
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, fmt.Sprintf("%d VIN1 53.0 -6.0", future), store)
+	if _, found := store.fleet[key]; found {
+		t.Errorf("expected the future packet not to be stored")
+	}
+	if store.drops[dropClockSkew] != 2 {
+		t.Errorf("expected 2 clock-skew drops, found %d", store.drops[dropClockSkew])
+	}
+}
+
+func TestOdometerIncreasesMonotonically(t *testing.T) {
+	store := newTestStore(t)
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.includeOdometer = true
+	})
+
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE VIN1", store)
+
+	// The vehicle drives north, pausing every fifth second, for more updates than the history
+	// holds so the odometer has to survive the oldest locations being overwritten.
+	key := vehicleKey{vin: "VIN1"}
+	latitude, expected, previous := 53.0, 0.0, 0.0
+	for i := 0; i < 3*historySize; i++ {
+		if i > 0 && i%5 != 0 {
+			latitude += 0.0001
+			expected += getDistance(latitude-0.0001, -6, latitude, -6)
+		}
+
+		packet := testPacket("VIN1", time.Duration(i-3*historySize)*time.Second, fmt.Sprintf("%.6f", latitude), "-6.000000")
+		handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, packet, store)
+
+		odometer := store.odometers[key]
+		if odometer < previous {
+			t.Fatalf("update %d: the odometer went backwards from %.3f to %.3f", i, previous, odometer)
+		}
+		previous = odometer
+	}
+
+	if math.Abs(previous-expected) > 0.01 {
+		t.Errorf("expected an odometer reading of %.2f after the history wrapped, found %.2f", expected, previous)
+	}
+
+	updates := watcher.pending()
+	last := updates[len(updates)-1]
+	if !strings.HasSuffix(last, fmt.Sprintf(" odometer=%.1f", previous)) {
+		t.Errorf("expected the update to end with the odometer reading, found '%s'", last)
+	}
+}
+
+func TestMaxPacketAgeDropsStalePackets(t *testing.T) {
+	store := newTestStore(t)
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.maxPacketAge = time.Minute
+	})
+
+	server := newMemoryNetwork().listen("server")
+	vehicle := packetPeer{conn: server, addr: memoryAddr("vehicle")}
+	key := vehicleKey{vin: "VIN1"}
+
+	// A backlog flushed after a long offline period.
+	handlePacket(vehicle, testPacket("VIN1", -2*time.Hour, "53.000000", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN1", -time.Minute-time.Millisecond, "53.000100", "-6.000000"), store)
+	if _, found := store.fleet[key]; found {
+		t.Fatalf("expected stale packets not to be stored")
+	}
+	if store.drops[dropStale] != 2 {
+		t.Errorf("expected 2 stale drops, found %d", store.drops[dropStale])
+	}
+
+	// Packets within the limit are accepted.
+	handlePacket(vehicle, testPacket("VIN1", -time.Minute, "53.000200", "-6.000000"), store)
+	handlePacket(vehicle, testPacket("VIN1", 0, "53.000300", "-6.000000"), store)
+	if entries, found := store.fleet[key]; !found || entries.Len() != 2 {
+		t.Errorf("expected 2 stored locations")
+	}
+	if store.drops[dropStale] != 2 {
+		t.Errorf("expected fresh packets not to be counted as stale")
+	}
+}
+
+func TestSendSubscriberUpdateWithNoLocations(t *testing.T) {
+	store := newTestStore(t)
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	watcher := network.listen("watcher")
+	handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE VIN1", store)
+
+	// An unknown vehicle, then a vehicle whose history has been trimmed to nothing.
+	key := vehicleKey{vin: "VIN1"}
+	sendSubscriberUpdate(store, key)
+
+	entries := newHistory(historySize)
+	entries.Append(location{timestamp: testNow, latitude: 53, longitude: -6})
+	entries.TrimBefore(testNow.Add(time.Second))
+	store.fleet[key] = entries
+	sendSubscriberUpdate(store, key)
+
+	if updates := watcher.pending(); len(updates) != 0 {
+		t.Errorf("expected no updates without locations, found %q", updates)
+	}
+	if len(store.subscribers[key]) != 1 {
+		t.Errorf("expected the subscriber to be kept")
+	}
+}
+
+func TestComputeSpeedWithTooFewLocations(t *testing.T) {
+	useTestSettings(t, nil)
+
+	if speed := computeSpeed([]location{}); speed != -1 {
+		t.Errorf("expected -1 for an empty slice, found %v", speed)
+	}
+	if speed := computeSpeed(nil); speed != -1 {
+		t.Errorf("expected -1 for a nil slice, found %v", speed)
+	}
+	if speed := computeSpeed([]location{{timestamp: testNow}}); speed != -1 {
+		t.Errorf("expected -1 for a single location, found %v", speed)
+	}
+}
+
+func TestComputeSpeedDeadband(t *testing.T) {
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.speedDeadband = 0.5
+	})
+
+	// 0.000001 degrees of latitude is about 0.11m. These are the sort of jumps GPS noise gives a
+	// stationary vehicle.
+	tests := []struct {
+		delta    float64
+		expected float64
+	}{
+		{0, 0},
+		{0.000001, 0},
+		{0.000004, 0},
+		{0.000005, 0.556},
+		{0.0001, 11.12},
+	}
+
+	for _, test := range tests {
+		locations := []location{
+			{timestamp: testNow, latitude: 53, longitude: -6},
+			{timestamp: testNow.Add(time.Second), latitude: 53 + test.delta, longitude: -6},
+		}
+		speed := computeSpeed(locations)
+		if test.expected == 0 && speed != 0 {
+			t.Errorf("delta %v: expected a sub-deadband speed to snap to 0, found %v", test.delta, speed)
+		}
+		if math.Abs(speed-test.expected) > 0.01 {
+			t.Errorf("delta %v: expected a speed of about %v, found %v", test.delta, test.expected, speed)
+		}
+	}
+
+	// The deadband doesn't hide a missing speed.
+	if speed := computeSpeed([]location{{timestamp: testNow}}); speed != -1 {
+		t.Errorf("expected -1 for a single location, found %v", speed)
+	}
+}
+
+func TestStorageCapacity(t *testing.T) {
+	tests := []struct {
+		mode       string
+		historySet bool
+		expected   int
+		valid      bool
+	}{
+		{storageHistory, false, 3600, true},
+		{storageHistory, true, 3600, true},
+		{storageLatest, false, latestStorageSize, true},
+		{storageLatest, true, 0, false},
+		{"newest", false, 0, false},
+	}
+
+	for _, test := range tests {
+		size, err := storageCapacity(test.mode, 3600, test.historySet)
+		if (err == nil) != test.valid || size != test.expected {
+			t.Errorf("%s (history set: %v): expected %d, valid: %v, found %d, %v", test.mode, test.historySet, test.expected, test.valid, size, err)
+		}
+	}
+}
+
+func TestStorageModes(t *testing.T) {
+	for _, mode := range []string{storageHistory, storageLatest} {
+		t.Run(mode, func(t *testing.T) {
+			store := newTestStore(t)
+			size, err := storageCapacity(mode, 10, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			historySize = size
+
+			network := newMemoryNetwork()
+			server := network.listen("server")
+			watcher := network.listen("watcher")
+			handlePacket(packetPeer{conn: server, addr: memoryAddr("watcher")}, "SUBSCRIBE VIN1", store)
+
+			for i := 0; i < 5; i++ {
+				latitude := fmt.Sprintf("%.6f", 53+0.0001*float64(i))
+				handlePacket(packetPeer{conn: server, addr: memoryAddr("vehicle")}, testPacket("VIN1", time.Duration(i-5)*time.Second, latitude, "-6.000000"), store)
+			}
+
+			stored := store.fleet[vehicleKey{vin: "VIN1"}].Len()
+			expected := 5
+			if mode == storageLatest {
+				expected = latestStorageSize
+			}
+			if stored != expected {
+				t.Errorf("expected %d stored locations, found %d", expected, stored)
+			}
+
+			// Both modes keep enough locations to calculate the speed.
+			updates := watcher.pending()
+			fields := strings.Fields(updates[len(updates)-1])
+			if len(fields) != 5 || !strings.HasPrefix(fields[4], "11.1") {
+				t.Errorf("expected a speed of about 11.1 m/s, found '%s'", updates[len(updates)-1])
+			}
+		})
+	}
+}
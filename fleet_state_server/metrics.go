@@ -0,0 +1,147 @@
+package main
+
+import "net/http"
+import "sync"
+import "time"
+
+// The upper bounds of the fan-out histogram's buckets. Each bucket counts the durations greater
+// than the previous bound and no greater than its own. Durations above the last bound are counted
+// in an overflow bucket.
+var fanoutBuckets = []time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// This type is a histogram of how long [sendSubscriberUpdate] takes to deliver a single vehicle
+// update to all its subscribers. The HTTP handler reads the histogram while the packet handlers
+// update it so access is serialized by the mutex.
+type fanoutHistogram struct {
+	mutex  sync.Mutex
+	counts []int64
+	count  int64
+	sends  int64
+	total  time.Duration
+	max    time.Duration
+}
+
+// If not nil, we time every subscriber fan-out and serve the results at [GET /metrics]. Set by
+// the --metrics flag. Timing is skipped entirely when it's nil.
+var fanoutMetrics *fanoutHistogram
+
+// The JSON representation of the fan-out histogram. Durations are in microseconds. The
+// percentiles are estimated as the upper bound of the bucket they fall in, capped at the maximum.
+// The per-send mean is the total duration divided by the number of packets sent, which shows
+// whether delivery time is growing with the number of subscribers.
+type fanoutJSON struct {
+	Count       int64              `json:"count"`
+	Sends       int64              `json:"sends"`
+	P50         int64              `json:"p50_us"`
+	P95         int64              `json:"p95_us"`
+	Max         int64              `json:"max_us"`
+	MeanPerSend float64            `json:"mean_per_send_us"`
+	Buckets     []fanoutBucketJSON `json:"buckets"`
+}
+
+// A single histogram bucket. A null upper bound marks the overflow bucket.
+type fanoutBucketJSON struct {
+	UpperBound *int64 `json:"le_us"`
+	Count      int64  `json:"count"`
+}
+
+// This function returns a new, empty histogram.
+func newFanoutHistogram() *fanoutHistogram {
+	return &fanoutHistogram{counts: make([]int64, len(fanoutBuckets)+1)}
+}
+
+// This function records the duration of a single fan-out which sent the specified number of
+// packets.
+func (h *fanoutHistogram) record(elapsed time.Duration, sends int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	index := len(fanoutBuckets)
+	for i, bound := range fanoutBuckets {
+		if elapsed <= bound {
+			index = i
+			break
+		}
+	}
+
+	h.counts[index]++
+	h.count++
+	h.sends += int64(sends)
+	h.total += elapsed
+	if elapsed > h.max {
+		h.max = elapsed
+	}
+}
+
+// This function returns the upper bound of the bucket containing the q-th quantile, where q is in
+// the range (0, 1]. The caller must hold the mutex.
+func (h *fanoutHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank && i < len(fanoutBuckets) && fanoutBuckets[i] < h.max {
+			return fanoutBuckets[i]
+		}
+		if seen >= rank {
+			break
+		}
+	}
+	return h.max
+}
+
+// This function returns the histogram's JSON representation.
+func (h *fanoutHistogram) toJSON() fanoutJSON {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	output := fanoutJSON{
+		Count: h.count,
+		Sends: h.sends,
+		P50:   h.quantile(0.5).Microseconds(),
+		P95:   h.quantile(0.95).Microseconds(),
+		Max:   h.max.Microseconds(),
+	}
+
+	if h.sends > 0 {
+		output.MeanPerSend = float64(h.total.Microseconds()) / float64(h.sends)
+	}
+
+	for i, count := range h.counts {
+		bucket := fanoutBucketJSON{Count: count}
+		if i < len(fanoutBuckets) {
+			bound := fanoutBuckets[i].Microseconds()
+			bucket.UpperBound = &bound
+		}
+		output.Buckets = append(output.Buckets, bucket)
+	}
+
+	return output
+}
+
+// This function handles a [GET /metrics] request.
+func handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]fanoutJSON{"subscriber_fanout": fanoutMetrics.toJSON()})
+}
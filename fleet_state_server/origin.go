@@ -0,0 +1,38 @@
+package main
+
+// If not empty, we tag vehicle packets we receive directly from vehicles with this ID as an
+// [origin=<id>] field, so servers further along a --forward-to chain and subscribers can tell
+// which server first received each update. Set by --server-id.
+var serverID string
+
+// Server IDs can be at most this many characters long.
+const maxServerIDLength = 64
+
+// This function returns true if the ID is a valid server ID, i.e. 1-64 letters, digits, hyphens,
+// underscores, or periods, e.g. a hostname. An ID can't contain spaces or '=' as it's sent as an
+// optional field.
+func isValidServerID(id string) bool {
+	if len(id) == 0 || len(id) > maxServerIDLength {
+		return false
+	}
+
+	for _, char := range id {
+		isLetter := char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z'
+		isDigit := char >= '0' && char <= '9'
+		if !isLetter && !isDigit && char != '-' && char != '_' && char != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// This function returns the origin of a vehicle packet, i.e. the ID of the server which first
+// received it. A packet relayed by another server carries its origin with it; otherwise it's us.
+// It returns an empty string if the packet has no origin and --server-id isn't set.
+func packetOrigin(packet vehiclePacket) string {
+	if packet.origin != "" {
+		return packet.origin
+	}
+	return serverID
+}
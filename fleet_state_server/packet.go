@@ -0,0 +1,202 @@
+package main
+
+import "errors"
+import "fmt"
+import "strconv"
+import "strings"
+import "time"
+
+// These errors describe why a vehicle packet failed to parse. The errors returned by
+// [parseVehiclePacket] wrap one of these values with more detail so callers can distinguish the
+// failure modes using errors.Is().
+var errInvalidPacket = errors.New("invalid vehicle packet")
+var errInvalidTimestamp = errors.New("invalid timestamp")
+var errInvalidCoord = errors.New("invalid coordinate")
+var errInvalidSequence = errors.New("invalid sequence number")
+var errInvalidIgnition = errors.New("invalid ignition state")
+var errInvalidBattery = errors.New("invalid battery level")
+var errInvalidStatus = errors.New("invalid status code")
+
+// A vehicle with no GPS fix sends this sentinel in place of its latitude and longitude.
+const noFix = "nofix"
+
+// This type is a parsed vehicle packet.
+type vehiclePacket struct {
+	timestamp time.Time
+	key       vehicleKey
+	latitude  float64
+	longitude float64
+
+	// True if the vehicle has no GPS fix, in which case the packet has no coordinates.
+	noFix bool
+
+	// The packet's sequence number, if hasSeq is true.
+	seq    uint64
+	hasSeq bool
+
+	// The vehicle's ignition state, "on" or "off", or an empty string if the packet doesn't
+	// include it.
+	ignition string
+
+	// The vehicle's battery level as a percentage, if hasBattery is true.
+	battery    float64
+	hasBattery bool
+
+	// The vehicle's status or alarm code, or an empty string if the packet doesn't include one.
+	status string
+
+	// The UDP port the vehicle listens on for commands, or zero if it doesn't accept commands.
+	controlPort int
+
+	// The ID of the server which first received the packet if it was relayed to us by another
+	// server, or an empty string.
+	origin string
+}
+
+// This function parses a vehicle packet with the format: [<timestamp> <vin> <latitude>
+// <longitude>] optionally followed by [<key>=<value>] fields. A vehicle with no GPS fix sends
+// [nofix] for both its latitude and longitude. The timestamp is parsed last so a caller which
+// ignores vehicle timestamps can accept a packet which fails with errInvalidTimestamp -- all the
+// other fields will have been parsed.
+func parseVehiclePacket(message string) (vehiclePacket, error) {
+	var packet vehiclePacket
+
+	elements, options := splitFields(message)
+	if len(elements) != 4 {
+		return packet, fmt.Errorf("%w: expected 4 fields, found %d", errInvalidPacket, len(elements))
+	}
+
+	packet.key = vehicleKey{namespace: options["fleet"], vin: elements[1]}
+	if packet.key.vin == wildcardVIN {
+		return packet, fmt.Errorf("%w: the VIN '%s' is reserved", errInvalidPacket, wildcardVIN)
+	}
+
+	// Both coordinates must be the sentinel. A packet with only one is invalid.
+	if elements[2] == noFix && elements[3] == noFix {
+		packet.noFix = true
+	} else if err := parseCoordinates(&packet, elements[2], elements[3]); err != nil {
+		return packet, err
+	}
+
+	if value, found := options["seq"]; found {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return packet, fmt.Errorf("%w: '%s'", errInvalidSequence, value)
+		}
+		packet.seq = seq
+		packet.hasSeq = true
+	}
+
+	// The ignition field is optional. If present, it must be "on" or "off".
+	if value, found := options["ignition"]; found {
+		if value != "on" && value != "off" {
+			return packet, fmt.Errorf("%w: '%s'", errInvalidIgnition, value)
+		}
+		packet.ignition = value
+	}
+
+	// The battery field is optional. If present, it must be a percentage.
+	if value, found := options["battery"]; found {
+		battery, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(battery >= 0 && battery <= 100) {
+			return packet, fmt.Errorf("%w: '%s'", errInvalidBattery, value)
+		}
+		packet.battery = battery
+		packet.hasBattery = true
+	}
+
+	// The status field is optional. If present, it must be a valid status code.
+	if value, found := options["status"]; found {
+		if !isValidStatus(value) {
+			return packet, fmt.Errorf("%w: '%s'", errInvalidStatus, value)
+		}
+		packet.status = value
+	}
+
+	// The control field is optional. If present, it must be a valid port number.
+	if value, found := options["control"]; found {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return packet, fmt.Errorf("%w: invalid control port '%s'", errInvalidPacket, value)
+		}
+		packet.controlPort = port
+	}
+
+	// The origin field is optional. If present, it must be a valid server ID.
+	if value, found := options["origin"]; found {
+		if !isValidServerID(value) {
+			return packet, fmt.Errorf("%w: invalid origin '%s'", errInvalidPacket, value)
+		}
+		packet.origin = value
+	}
+
+	timestamp, err := parseTimestamp(elements[0])
+	if err != nil {
+		return packet, err
+	}
+	packet.timestamp = timestamp
+
+	return packet, nil
+}
+
+// This function parses a vehicle packet's latitude and longitude fields into the packet.
+func parseCoordinates(packet *vehiclePacket, latField string, longField string) error {
+	latitude, err := strconv.ParseFloat(latField, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid latitude '%s'", errInvalidCoord, latField)
+	}
+
+	longitude, err := strconv.ParseFloat(longField, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid longitude '%s'", errInvalidCoord, longField)
+	}
+
+	// ParseFloat accepts values like "NaN" and "Inf" so we also need to check the range. (NaN
+	// fails every comparison.)
+	if !(latitude >= -90 && latitude <= 90) {
+		return fmt.Errorf("%w: latitude out of range", errInvalidCoord)
+	}
+
+	if !(longitude >= -180 && longitude <= 180) {
+		return fmt.Errorf("%w: longitude out of range", errInvalidCoord)
+	}
+
+	packet.latitude = latitude
+	packet.longitude = longitude
+	return nil
+}
+
+// This function parses a vehicle timestamp. The format is detected automatically -- the timestamp
+// can be either an RFC3339 string with optional fractional seconds or a Unix epoch time in seconds,
+// e.g. "1643673600" or "1643673600.25".
+func parseTimestamp(value string) (time.Time, error) {
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp, nil
+	}
+
+	// We parse the whole and fractional parts of an epoch time separately to avoid losing
+	// precision in a float64.
+	whole, fraction := value, ""
+	if index := strings.Index(value, "."); index >= 0 {
+		whole, fraction = value[:index], value[index+1:]
+	}
+
+	seconds, err := strconv.ParseUint(whole, 10, 63)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: unrecognised format '%s'", errInvalidTimestamp, value)
+	}
+
+	if len(fraction) > 9 {
+		fraction = fraction[:9]
+	}
+
+	nanoseconds := uint64(0)
+	if fraction != "" {
+		nanoseconds, err = strconv.ParseUint(fraction+strings.Repeat("0", 9-len(fraction)), 10, 32)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: unrecognised format '%s'", errInvalidTimestamp, value)
+		}
+	}
+
+	return time.Unix(int64(seconds), int64(nanoseconds)).UTC(), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import "errors"
+import "testing"
+import "time"
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2024-03-01T12:00:00Z", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"2024-03-01T12:00:00.123456789Z", time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC)},
+		{"2024-03-01T13:00:00+01:00", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"1709294400", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"1709294400.25", time.Date(2024, 3, 1, 12, 0, 0, 250000000, time.UTC)},
+		{"1709294400.000000001", time.Date(2024, 3, 1, 12, 0, 0, 1, time.UTC)},
+		{"1709294400.1234567891234", time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC)},
+		{"0", time.Unix(0, 0).UTC()},
+	}
+
+	for _, test := range tests {
+		timestamp, err := parseTimestamp(test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !timestamp.Equal(test.expected) {
+			t.Errorf("%s: expected %s, found %s", test.value, test.expected, timestamp)
+		}
+	}
+}
+
+func TestParseTimestampInvalid(t *testing.T) {
+	for _, value := range []string{"", "now", "-1709294400", "1709294400.x", "1.2.3", "2024-03-01", "2024-13-01T12:00:00Z"} {
+		_, err := parseTimestamp(value)
+		if !errors.Is(err, errInvalidTimestamp) {
+			t.Errorf("%q: expected errInvalidTimestamp, found %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import "crypto/tls"
+import "errors"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+
+// A peer is the source of an incoming packet. We send replies and subscriber updates back to a
+// peer using the same transport its packet arrived on.
+type peer interface {
+	send(message string) error
+	String() string
+}
+
+// A packetPeer is a peer that sent us a packet, usually over UDP. We send each message to the peer as
+// a new packet from the connection its packet arrived on.
+type packetPeer struct {
+	conn packetConn
+	addr net.Addr
+}
+
+func (p packetPeer) send(message string) error {
+	_, err := p.conn.WriteTo([]byte(message), p.addr)
+	return err
+}
+
+func (p packetPeer) String() string {
+	return p.addr.String()
+}
+
+// A tlsPeer is a peer connected to us over TLS. We send messages to the peer as newline-delimited
+// lines on its connection. Messages are usually sent while holding the store's lock so we never
+// write to the connection directly -- a stalled subscriber would block the whole server. Instead we
+// queue each message and a writer goroutine per connection writes them in order.
+//
+// Closing done stops the writer straight away, discarding any queued messages. Closing draining
+// asks the writer to write the queued messages first. The writer closes stopped when it exits.
+type tlsPeer struct {
+	conn      *tls.Conn
+	queue     chan string
+	done      chan struct{}
+	draining  chan struct{}
+	stopped   chan struct{}
+	once      sync.Once
+	drainOnce sync.Once
+}
+
+// The number of messages we queue for a TLS peer before we consider it stalled.
+const tlsQueueSize = 256
+
+// A write to a TLS peer which takes longer than this fails and the peer is dropped.
+const tlsWriteTimeout = 5 * time.Second
+
+// The error returned when we can't queue a message for a TLS peer.
+var errPeerStalled = errors.New("the connection is stalled or closed")
+
+// This function returns a new TLS peer for the connection and starts its writer goroutine. The
+// caller should call close() when it's finished with the peer.
+func newTLSPeer(conn *tls.Conn) *tlsPeer {
+	p := &tlsPeer{
+		conn:     conn,
+		queue:    make(chan string, tlsQueueSize),
+		done:     make(chan struct{}),
+		draining: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// This function queues the message without blocking. If the queue is full the peer isn't keeping
+// up so we drop it by closing its connection. Messages can't be queued once the peer is draining.
+func (p *tlsPeer) send(message string) error {
+	select {
+	case <-p.done:
+		return errPeerStalled
+	case <-p.draining:
+		return errPeerStalled
+	default:
+	}
+
+	select {
+	case p.queue <- message:
+		return nil
+	default:
+		p.close()
+		return errPeerStalled
+	}
+}
+
+// This function writes queued messages to the connection until the peer is closed or drained. If a
+// write fails or times out we close the connection, which ends the peer's read loop and removes it
+// from every subscriber list.
+func (p *tlsPeer) run() {
+	defer close(p.stopped)
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.draining:
+			p.flush()
+			p.close()
+			return
+		case message := <-p.queue:
+			if !p.write(message, time.Now().Add(tlsWriteTimeout)) {
+				return
+			}
+		}
+	}
+}
+
+// This function writes the messages left in the queue. The whole flush shares a single write
+// deadline so a stalled peer can't hold up a shutdown for longer than [tlsWriteTimeout].
+func (p *tlsPeer) flush() {
+	deadline := time.Now().Add(tlsWriteTimeout)
+	for {
+		select {
+		case message := <-p.queue:
+			if !p.write(message, deadline) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// This function writes a single message to the connection. If the write fails it closes the peer
+// and returns false.
+func (p *tlsPeer) write(message string, deadline time.Time) bool {
+	p.conn.SetWriteDeadline(deadline)
+	_, err := p.conn.Write([]byte(message + "\n"))
+	if err != nil {
+		if loadSettings().verbose {
+			fmt.Printf("Dropping %s: %s\n", p, err.Error())
+		}
+		p.close()
+		return false
+	}
+	return true
+}
+
+// This function stops the writer goroutine and closes the connection, discarding any queued
+// messages. It's safe to call more than once.
+func (p *tlsPeer) close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// This function asks the writer goroutine to write the queued messages, then close the connection.
+// It doesn't wait -- the peer's stopped channel is closed when the writer has finished. It's safe
+// to call more than once.
+func (p *tlsPeer) drain() {
+	p.drainOnce.Do(func() {
+		close(p.draining)
+	})
+}
+
+func (p *tlsPeer) String() string {
+	return "tls://" + p.conn.RemoteAddr().String()
+}
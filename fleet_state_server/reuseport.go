@@ -0,0 +1,66 @@
+package main
+
+import "context"
+import "fmt"
+import "net"
+import "reflect"
+import "runtime"
+import "syscall"
+
+// This function returns the value of the SO_REUSEPORT socket option for the current platform. The
+// syscall package doesn't define the option so we hardcode the values from the system headers.
+func reusePortOption() (int, bool) {
+	switch runtime.GOOS {
+	case "linux":
+		return 0xf, true
+	case "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		return 0x200, true
+	}
+	return 0, false
+}
+
+// This function returns a packetConn listening for UDP packets on the specified address with the
+// SO_REUSEPORT option set so several sockets can bind to the same address. The kernel distributes
+// incoming packets between the sockets, always sending packets from the same source to the same
+// socket.
+func listenUDPReusePort(addr *net.UDPAddr) (net.PacketConn, error) {
+	option, ok := reusePortOption()
+	if !ok {
+		return nil, fmt.Errorf("SO_REUSEPORT is not supported on %s", runtime.GOOS)
+	}
+
+	config := net.ListenConfig{
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			var optErr error
+			err := conn.Control(func(fd uintptr) {
+				optErr = setsockoptInt(fd, syscall.SOL_SOCKET, option, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return optErr
+		},
+	}
+
+	return config.ListenPacket(context.Background(), "udp", addr.String())
+}
+
+// This function calls syscall.SetsockoptInt. The file descriptor argument is an int on unixy
+// systems but a syscall.Handle on Windows so we make the call via reflection. The makefile builds
+// each binary from a list of files, which ignores build constraints, so we can't split this into
+// per-platform files.
+func setsockoptInt(fd uintptr, level int, option int, value int) error {
+	function := reflect.ValueOf(syscall.SetsockoptInt)
+	args := []reflect.Value{
+		reflect.ValueOf(fd).Convert(function.Type().In(0)),
+		reflect.ValueOf(level),
+		reflect.ValueOf(option),
+		reflect.ValueOf(value),
+	}
+
+	result := function.Call(args)[0]
+	if result.IsNil() {
+		return nil
+	}
+	return result.Interface().(error)
+}
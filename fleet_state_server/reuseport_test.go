@@ -0,0 +1,99 @@
+package main
+
+import "fmt"
+import "net"
+import "sync"
+import "testing"
+import "time"
+
+// This benchmark measures the server's throughput with 1, 2, and 4 reader sockets sharing the
+// port. Several senders, each with its own socket, send vehicle packets as fast as they can. The
+// kernel picks a reader for each packet from its source address so the senders are spread across
+// the readers. Every packet still takes the store's lock so only the socket reads run in
+// parallel. The senders can easily outpace the readers so the time per op mostly measures the
+// senders. The useful numbers are the rate at which the readers handled packets and the
+// percentage of packets the kernel dropped because the readers fell behind.
+func BenchmarkReusePortReaders(b *testing.B) {
+	for _, count := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("readers=%d", count), func(b *testing.B) {
+			benchmarkReaders(b, count)
+		})
+	}
+}
+
+func benchmarkReaders(b *testing.B, count int) {
+	const senders = 8
+
+	store := newTestStore(b)
+	previous := readers
+	readers = count
+	defer func() {
+		readers = previous
+	}()
+
+	listeners, err := listenReaders(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Skipf("unable to listen with %d readers: %v", count, err)
+	}
+	for _, listener := range listeners {
+		defer listener.Close()
+		go serve(listener, store)
+	}
+	serverAddr := listeners[0].(net.PacketConn).LocalAddr()
+
+	perSender := b.N/senders + 1
+	b.ResetTimer()
+	start := time.Now()
+
+	var group sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		group.Add(1)
+		go func(s int) {
+			defer group.Done()
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			for seq := 0; seq < perSender; seq++ {
+				timestamp := testNow.Add(time.Duration(seq) * time.Millisecond).Format(time.RFC3339Nano)
+				packet := fmt.Sprintf("%s BENCH%d 53.000000 -6.000000 seq=%d", timestamp, s, seq)
+				conn.WriteTo([]byte(packet), serverAddr)
+			}
+		}(s)
+	}
+	group.Wait()
+
+	// Wait until every sender's last packet has arrived, or until the readers stop making progress
+	// if it was dropped.
+	received, lastProgress := 0, time.Now()
+	for time.Since(lastProgress) < 200*time.Millisecond {
+		total, done := 0, true
+		store.mutex.Lock()
+		for s := 0; s < senders; s++ {
+			tracker, found := store.sequences[vehicleKey{vin: fmt.Sprintf("BENCH%d", s)}]
+			if !found {
+				done = false
+				continue
+			}
+			total += int(tracker.next - tracker.lost)
+			done = done && tracker.next == uint64(perSender)
+		}
+		store.mutex.Unlock()
+
+		if total > received {
+			received, lastProgress = total, time.Now()
+		}
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.StopTimer()
+	sent := senders * perSender
+	b.ReportMetric(float64(received)/lastProgress.Sub(start).Seconds(), "handled/s")
+	b.ReportMetric(100*float64(sent-received)/float64(sent), "%lost")
+}
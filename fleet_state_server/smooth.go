@@ -0,0 +1,109 @@
+package main
+
+import "math"
+import "time"
+
+// If the --smooth flag is set, we pass each vehicle's positions through a Kalman filter before
+// storing them. The filter assumes the vehicle moves at a roughly constant velocity, disturbed by
+// random accelerations with variance --smooth-process-noise, and that each reported position has
+// random errors with standard deviation --smooth-measurement-noise meters. Speeds and headings
+// derived from the smoothed positions are much less noisy than those derived from raw positions.
+//
+// We filter in meters on a flat plane centered on the vehicle's first position, with independent
+// filters for the north-south and east-west axes. The flat-plane approximation is accurate to well
+// within GPS error over the distances a vehicle covers in a simulation.
+type kalmanFilter struct {
+	originLat  float64
+	originLong float64
+
+	// Meters per degree of longitude at the origin's latitude.
+	metersPerDegreeLong float64
+
+	north kalmanAxis
+	east  kalmanAxis
+
+	last time.Time
+}
+
+// The state of a one-dimensional constant-velocity Kalman filter: the estimated position in meters
+// and velocity in m/s, and their covariance matrix.
+type kalmanAxis struct {
+	position float64
+	velocity float64
+	p00      float64
+	p01      float64
+	p10      float64
+	p11      float64
+}
+
+// The number of meters per degree of latitude.
+const metersPerDegreeLat = 6371009 * math.Pi / 180
+
+// This function returns the Kalman filter for the vehicle, creating it if necessary.
+func (store *fleetStore) filterFor(key vehicleKey) *kalmanFilter {
+	filter, found := store.filters[key]
+	if !found {
+		filter = &kalmanFilter{}
+		store.filters[key] = filter
+	}
+	return filter
+}
+
+// This function feeds a new position into the filter and returns the smoothed position. The
+// timestamp must be after the timestamp of the previous position.
+func (f *kalmanFilter) update(timestamp time.Time, latitude, longitude float64) (float64, float64) {
+	// The first position initializes the filter. We don't know the velocity yet so we give it a
+	// large variance.
+	if f.last.IsZero() {
+		f.originLat = latitude
+		f.originLong = longitude
+		f.metersPerDegreeLong = metersPerDegreeLat * math.Cos(latitude*math.Pi/180)
+		variance := smoothMeasurementNoise * smoothMeasurementNoise
+		f.north = kalmanAxis{p00: variance, p11: 1000}
+		f.east = kalmanAxis{p00: variance, p11: 1000}
+		f.last = timestamp
+		return latitude, longitude
+	}
+
+	dt := timestamp.Sub(f.last).Seconds()
+	f.last = timestamp
+
+	north := f.north.update(dt, (latitude-f.originLat)*metersPerDegreeLat)
+	east := f.east.update(dt, (longitude-f.originLong)*f.metersPerDegreeLong)
+
+	// Near the poles there are almost no meters per degree of longitude so we keep the raw value.
+	smoothedLong := longitude
+	if f.metersPerDegreeLong > 1 {
+		smoothedLong = f.originLong + east/f.metersPerDegreeLong
+	}
+
+	return f.originLat + north/metersPerDegreeLat, smoothedLong
+}
+
+// This function runs a single predict-update step of the filter with a new measurement of the
+// position in meters, dt seconds after the previous measurement, and returns the new position
+// estimate.
+func (a *kalmanAxis) update(dt float64, measured float64) float64 {
+	// Predict: the position advances by velocity * dt. Random accelerations add uncertainty.
+	q := smoothProcessNoise
+	a.position += a.velocity * dt
+	p00 := a.p00 + dt*(a.p10+a.p01) + dt*dt*a.p11 + q*dt*dt*dt*dt/4
+	p01 := a.p01 + dt*a.p11 + q*dt*dt*dt/2
+	p10 := a.p10 + dt*a.p11 + q*dt*dt*dt/2
+	p11 := a.p11 + q*dt*dt
+
+	// Update: blend the prediction with the measurement in proportion to their uncertainties.
+	s := p00 + smoothMeasurementNoise*smoothMeasurementNoise
+	k0 := p00 / s
+	k1 := p10 / s
+	residual := measured - a.position
+	a.position += k0 * residual
+	a.velocity += k1 * residual
+
+	a.p00 = (1 - k0) * p00
+	a.p01 = (1 - k0) * p01
+	a.p10 = p10 - k1*p00
+	a.p11 = p11 - k1*p01
+
+	return a.position
+}
@@ -0,0 +1,66 @@
+package main
+
+import "math"
+import "math/rand"
+import "testing"
+import "time"
+
+// This function returns the variance of the values.
+func variance(values []float64) float64 {
+	mean := 0.0
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+
+	total := 0.0
+	for _, value := range values {
+		total += (value - mean) * (value - mean)
+	}
+	return total / float64(len(values))
+}
+
+func TestKalmanFilterReducesNoise(t *testing.T) {
+	previousProcess, previousMeasurement := smoothProcessNoise, smoothMeasurementNoise
+	smoothProcessNoise, smoothMeasurementNoise = 1.0, 5.0
+	t.Cleanup(func() {
+		smoothProcessNoise, smoothMeasurementNoise = previousProcess, previousMeasurement
+	})
+
+	// A vehicle heading north-east at a steady 10 m/s in each direction, reporting once a second
+	// with GPS errors of 5m in each direction. The seed keeps the noise the same on every run.
+	random := rand.New(rand.NewSource(1))
+	const originLat, originLong = 53.0, -6.0
+	metersPerDegreeLong := metersPerDegreeLat * math.Cos(originLat*math.Pi/180)
+
+	filter := &kalmanFilter{}
+	var rawErrors, filteredErrors []float64
+
+	for i := 0; i < 300; i++ {
+		timestamp := testNow.Add(time.Duration(i) * time.Second)
+		trueNorth, trueEast := 10.0*float64(i), 10.0*float64(i)
+
+		measuredNorth := trueNorth + random.NormFloat64()*smoothMeasurementNoise
+		measuredEast := trueEast + random.NormFloat64()*smoothMeasurementNoise
+		latitude := originLat + measuredNorth/metersPerDegreeLat
+		longitude := originLong + measuredEast/metersPerDegreeLong
+
+		smoothedLat, smoothedLong := filter.update(timestamp, latitude, longitude)
+
+		// The filter needs a few updates to estimate the velocity.
+		if i < 20 {
+			continue
+		}
+
+		rawErrors = append(rawErrors, measuredNorth-trueNorth, measuredEast-trueEast)
+		filteredErrors = append(
+			filteredErrors,
+			(smoothedLat-originLat)*metersPerDegreeLat-trueNorth,
+			(smoothedLong-originLong)*metersPerDegreeLong-trueEast)
+	}
+
+	raw, filtered := variance(rawErrors), variance(filteredErrors)
+	if filtered > raw/2 {
+		t.Errorf("expected the filter to at least halve the variance, raw: %.2f m^2, filtered: %.2f m^2", raw, filtered)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import "fmt"
+import "strings"
+import "time"
+
+// The maximum length of a status code.
+const maxStatusLength = 32
+
+// Vehicles can report an event or alarm, e.g. a door opening or a panic button, by including a
+// [status=<code>] field in an update packet. A status describes a single packet, not the vehicle's
+// ongoing state, so we store it with the packet's timestamp and only include it in the update
+// generated from that packet.
+type vehicleStatus struct {
+	code      string
+	timestamp time.Time
+}
+
+// This function returns true if the status code is valid. Codes are forwarded to subscribers
+// unchanged so we only accept a conservative set of characters. Commas are reserved for
+// subscription filters.
+func isValidStatus(code string) bool {
+	if len(code) == 0 || len(code) > maxStatusLength {
+		return false
+	}
+
+	for _, char := range code {
+		isLetter := char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z'
+		isDigit := char >= '0' && char <= '9'
+		if !isLetter && !isDigit && char != '-' && char != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// This function returns the status code the vehicle reported in the packet with the specified
+// timestamp, or an empty string if the packet didn't include one.
+func (store *fleetStore) statusAt(key vehicleKey, timestamp time.Time) string {
+	status, found := store.status[key]
+	if found && status.timestamp.Equal(timestamp) {
+		return status.code
+	}
+	return ""
+}
+
+// This function parses a subscriber's [status=<code>,<code>,...] filter. The special code [*]
+// matches any status.
+func parseStatusFilter(value string) (map[string]bool, error) {
+	filter := make(map[string]bool)
+	for _, code := range strings.Split(value, ",") {
+		if code != "*" && !isValidStatus(code) {
+			return nil, fmt.Errorf("invalid status code '%s'", code)
+		}
+		filter[code] = true
+	}
+	return filter, nil
+}
+
+// This function returns true if the subscriber wants an update with the specified status code. A
+// subscriber without a filter receives every update.
+func (sub *subscriber) wantsStatus(code string) bool {
+	if sub.statusFilter == nil {
+		return true
+	}
+	if code == "" {
+		return false
+	}
+	return sub.statusFilter["*"] || sub.statusFilter[code]
+}
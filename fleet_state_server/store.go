@@ -0,0 +1,319 @@
+package main
+
+import "sync"
+import "time"
+
+// Vehicles are grouped into independent fleets or namespaces so that logically separate fleets can
+// share a server without their VINs colliding. Packets select a namespace using an optional
+// [fleet=<name>] field. Packets without this field belong to the default namespace, "".
+type vehicleKey struct {
+	namespace string
+	vin       string
+}
+
+// A subscription to this VIN receives updates from every vehicle in the subscriber's namespace.
+// Vehicles can't use it as their own VIN.
+const wildcardVIN = "*"
+
+// This function returns the key for wildcard subscriptions to the namespace.
+func wildcardKey(namespace string) vehicleKey {
+	return vehicleKey{namespace: namespace, vin: wildcardVIN}
+}
+
+// This function returns a printable name for the key, e.g. for use in log messages.
+func (key vehicleKey) String() string {
+	if key.namespace == "" {
+		return key.vin
+	}
+	return key.namespace + "/" + key.vin
+}
+
+// We use this type to store location updates from individual vehicles in the fleet. For each
+// vehicle, we store a [history] of its most recent [location] updates.
+type location struct {
+	timestamp time.Time
+	latitude  float64
+	longitude float64
+}
+
+// We use this type to record statistics about the update packets sent to subscribers for a single
+// vehicle.
+type deliveryStats struct {
+	total    int
+	failed   int
+	lastSent time.Time
+}
+
+// We use this type to track the sequence numbers in a vehicle's update packets so we can measure
+// packet loss. A gap in the sequence counts as lost packets. Late packets which arrive after a gap
+// has been counted are ignored.
+type sequenceTracker struct {
+	started bool
+	next    uint64
+	lost    uint64
+}
+
+// This function records the arrival of a packet with the specified sequence number and returns the
+// number of packets newly detected as lost. The first packet we see starts the sequence so a
+// vehicle which started sending before the server isn't penalized.
+func (tracker *sequenceTracker) record(seq uint64) uint64 {
+	if !tracker.started {
+		tracker.started = true
+		tracker.next = seq + 1
+		return 0
+	}
+
+	if seq < tracker.next {
+		return 0
+	}
+
+	lost := seq - tracker.next
+	tracker.lost += lost
+	tracker.next = seq + 1
+	return lost
+}
+
+// We use this type to store information about a single subscription.
+type subscriber struct {
+	peer peer
+
+	// The number of consecutive failed sends to this subscriber.
+	failures int
+
+	// A token bucket measured in bytes that limits the subscriber's bandwidth to --max-bandwidth.
+	// The bucket holds one second's worth of bytes or a single packet, whichever is larger.
+	tokens     float64
+	lastRefill time.Time
+
+	// The number of updates skipped since the subscriber was last within its bandwidth limit.
+	skipped int
+
+	// If not nil, the subscriber receives positions as deltas. See [formatDeltaUpdate].
+	delta *deltaState
+
+	// If bands is true, the subscriber only receives updates when the vehicle's speed band
+	// changes. The band field is the last band we sent. See [formatBandUpdate].
+	bands bool
+	band  string
+
+	// If batch is non-zero, the subscriber's updates are held in pending and sent together once
+	// the batch interval has elapsed since batchStart, the time of the oldest pending update. See
+	// [flushBatches].
+	batch      time.Duration
+	pending    []batchedUpdate
+	batchStart time.Time
+
+	// If compress is true, large batch packets are gzip-compressed. See [compressPacket].
+	compress bool
+
+	// The subscriber's update format, set by a [format=<name>] field. If nil, the subscriber
+	// receives text updates. See [updateEncoders].
+	encode updateEncoder
+
+	// If not nil, the subscriber only receives updates with one of these status codes. See
+	// [wantsStatus].
+	statusFilter map[string]bool
+}
+
+// This function refills the subscriber's token bucket and returns true if it holds enough tokens
+// to send a packet of the specified size, in which case the tokens are consumed. The bandwidth
+// is measured in bytes per second.
+func (sub *subscriber) allow(size int, bandwidth int, now time.Time) bool {
+	capacity := float64(bandwidth)
+	if float64(size) > capacity {
+		capacity = float64(size)
+	}
+
+	if sub.lastRefill.IsZero() {
+		sub.tokens = capacity
+	} else {
+		sub.tokens += now.Sub(sub.lastRefill).Seconds() * float64(bandwidth)
+		if sub.tokens > capacity {
+			sub.tokens = capacity
+		}
+	}
+	sub.lastRefill = now
+
+	if sub.tokens < float64(size) {
+		return false
+	}
+
+	sub.tokens -= float64(size)
+	return true
+}
+
+// This type is the server's shared data store. Packets can arrive on multiple goroutines (e.g. from
+// TLS connections) so we hold the mutex while handling each packet.
+type fleetStore struct {
+	mutex sync.Mutex
+
+	// This is the server's primary data store. Each key is a (namespace, VIN) pair. Each value is
+	// the history of timestamped [location] structs for that vehicle.
+	fleet map[vehicleKey]*history
+
+	// This is the server's subscriber store. Each key is a (namespace, VIN) pair. Each value is a
+	// list of subscribers for that vehicle. Wildcard subscribers are stored under [wildcardKey].
+	subscribers map[vehicleKey][]*subscriber
+
+	// The total number of subscriptions across all vehicles. See [setSubscribers].
+	subscriberCount int
+
+	// Subscriber delivery statistics for each vehicle.
+	stats map[vehicleKey]*deliveryStats
+
+	// The total distance in meters each vehicle has travelled since the server started. This is
+	// accumulated as each location arrives so it isn't affected by the history's limited capacity.
+	odometers map[vehicleKey]float64
+
+	// Sequence number trackers for vehicles which include sequence numbers in their packets.
+	sequences map[vehicleKey]*sequenceTracker
+
+	// The latest ignition state, "on" or "off", for vehicles which include it in their packets.
+	ignition map[vehicleKey]string
+
+	// The latest battery level as a percentage for vehicles which include it in their packets.
+	battery map[vehicleKey]float64
+
+	// If --smooth is set, the Kalman filter for each vehicle's positions.
+	filters map[vehicleKey]*kalmanFilter
+
+	// The ID of the server which first received each vehicle's latest packet. See [packetOrigin].
+	origins map[vehicleKey]string
+
+	// The latest status reported by each vehicle which includes a status in its packets.
+	status map[vehicleKey]vehicleStatus
+
+	// The control address of each vehicle which accepts commands. See [recordControlAddr].
+	controlPeers map[vehicleKey]peer
+
+	// The timestamp of the latest packet from each vehicle, including packets with no GPS fix and
+	// heartbeats.
+	lastSeen map[vehicleKey]time.Time
+
+	// True for each vehicle whose latest position report had no GPS fix. Heartbeats don't change
+	// this as they don't report a position.
+	fixLost map[vehicleKey]bool
+
+	// If --archive-dir is set, locations waiting to be written to the archive.
+	archive []archiveEntry
+
+	// If --forward-to is set, the upstream server we relay vehicle packets to. The forwardFailing
+	// field is true while forwarding is failing. See [forward].
+	upstream       peer
+	forwardFailing bool
+
+	// The connected TLS peers. When the server shuts down we flush their queues before closing
+	// them, and once closingTLS is set any new TLS connection is closed straight away. See
+	// [closeTLSPeers].
+	tlsPeers   map[*tlsPeer]bool
+	closingTLS bool
+
+	// The number of dropped packets for each reason. See [recordDrop].
+	drops [numDropReasons]uint64
+
+	// The store's clock. This is [time.Now] except in tests, which can replace it with a fixed or
+	// simulated clock to test the time-based features deterministically. Packet handlers and the
+	// background tasks read the time from here rather than calling time.Now directly.
+	clock func() time.Time
+}
+
+func newFleetStore() *fleetStore {
+	return &fleetStore{
+		fleet:        make(map[vehicleKey]*history),
+		subscribers:  make(map[vehicleKey][]*subscriber),
+		stats:        make(map[vehicleKey]*deliveryStats),
+		odometers:    make(map[vehicleKey]float64),
+		sequences:    make(map[vehicleKey]*sequenceTracker),
+		ignition:     make(map[vehicleKey]string),
+		battery:      make(map[vehicleKey]float64),
+		origins:      make(map[vehicleKey]string),
+		filters:      make(map[vehicleKey]*kalmanFilter),
+		status:       make(map[vehicleKey]vehicleStatus),
+		lastSeen:     make(map[vehicleKey]time.Time),
+		fixLost:      make(map[vehicleKey]bool),
+		controlPeers: make(map[vehicleKey]peer),
+		tlsPeers:     make(map[*tlsPeer]bool),
+		clock:        time.Now,
+	}
+}
+
+// This function returns the delivery statistics for the specified vehicle, creating a new zeroed
+// entry if none exists.
+func (store *fleetStore) deliveryStatsFor(key vehicleKey) *deliveryStats {
+	stats, found := store.stats[key]
+	if !found {
+		stats = &deliveryStats{}
+		store.stats[key] = stats
+	}
+	return stats
+}
+
+// This function returns the sequence tracker for the specified vehicle, creating a new tracker if
+// none exists.
+func (store *fleetStore) sequenceTrackerFor(key vehicleKey) *sequenceTracker {
+	tracker, found := store.sequences[key]
+	if !found {
+		tracker = &sequenceTracker{}
+		store.sequences[key] = tracker
+	}
+	return tracker
+}
+
+// This function removes the peer from every subscriber list.
+func (store *fleetStore) removeSubscriber(target peer) {
+	for key := range store.subscribers {
+		store.unsubscribe(key, target)
+	}
+}
+
+// This function returns true if any subscriber should be sent updates about the specified vehicle,
+// either directly or through a wildcard subscription to its namespace.
+func (store *fleetStore) hasSubscribers(key vehicleKey) bool {
+	return len(store.subscribers[key]) > 0 || len(store.subscribers[wildcardKey(key.namespace)]) > 0
+}
+
+// This function adds the subscriber to the subscriber list for the specified vehicle. An existing
+// subscription from the same peer is replaced so clients can safely resend SUBSCRIBE packets. It
+// returns false without subscribing if the new subscription would exceed --max-total-subscribers.
+func (store *fleetStore) subscribe(key vehicleKey, sub *subscriber) bool {
+	for i, existing := range store.subscribers[key] {
+		if existing.peer.String() == sub.peer.String() {
+			store.subscribers[key][i] = sub
+			return true
+		}
+	}
+
+	limit := loadSettings().maxTotalSubscribers
+	if limit > 0 && store.subscriberCount >= limit {
+		return false
+	}
+
+	store.setSubscribers(key, append(store.subscribers[key], sub))
+	return true
+}
+
+// This function replaces the subscriber list for the specified vehicle, deleting the list if it's
+// empty. Every change to the subscriber lists goes through this function so it can keep the running
+// total of subscriptions up to date.
+func (store *fleetStore) setSubscribers(key vehicleKey, subs []*subscriber) {
+	store.subscriberCount += len(subs) - len(store.subscribers[key])
+
+	if len(subs) == 0 {
+		delete(store.subscribers, key)
+	} else {
+		store.subscribers[key] = subs
+	}
+}
+
+// This function removes the peer from the subscriber list for the specified vehicle. We compare
+// peers by address as a UDP client sends each request as a separate packet.
+func (store *fleetStore) unsubscribe(key vehicleKey, target peer) {
+	var remaining []*subscriber
+	for _, sub := range store.subscribers[key] {
+		if sub.peer.String() != target.String() {
+			remaining = append(remaining, sub)
+		}
+	}
+
+	store.setSubscribers(key, remaining)
+}
@@ -0,0 +1,61 @@
+package main
+
+import "reflect"
+import "testing"
+
+func TestMaxTotalSubscribers(t *testing.T) {
+	store := newTestStore(t)
+	useTestSettings(t, func(settings *serverSettings) {
+		settings.maxTotalSubscribers = 3
+	})
+
+	network := newMemoryNetwork()
+	server := network.listen("server")
+	clients := map[string]*memoryConn{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		clients[name] = network.listen(name)
+	}
+
+	// This function sends a packet from the named client and returns the server's replies.
+	send := func(name string, message string) []string {
+		handlePacket(packetPeer{conn: server, addr: memoryAddr(name)}, message, store)
+		return clients[name].pending()
+	}
+	capacity := []string{"ERROR capacity"}
+
+	// The cap applies across every vehicle, not per vehicle.
+	for _, request := range [][2]string{{"a", "VIN1"}, {"b", "VIN2"}, {"c", "VIN3"}} {
+		if replies := send(request[0], "SUBSCRIBE "+request[1]); len(replies) != 0 {
+			t.Fatalf("expected the subscription to %s to be accepted, found %q", request[1], replies)
+		}
+	}
+	if replies := send("d", "SUBSCRIBE VIN4"); !reflect.DeepEqual(replies, capacity) {
+		t.Fatalf("expected a fourth subscription to be rejected, found %q", replies)
+	}
+
+	// Resubscribing replaces the existing subscription so it's allowed at the cap...
+	if replies := send("a", "SUBSCRIBE VIN1 delta=true"); len(replies) != 0 {
+		t.Errorf("expected a resubscription to be accepted at the cap, found %q", replies)
+	}
+	if store.subscriberCount != 3 {
+		t.Errorf("expected a resubscription not to change the count, found %d", store.subscriberCount)
+	}
+
+	// ...but the same peer subscribing to another vehicle is a new subscription.
+	if replies := send("a", "SUBSCRIBE VIN2"); !reflect.DeepEqual(replies, capacity) {
+		t.Errorf("expected a second vehicle for the same peer to be rejected, found %q", replies)
+	}
+
+	// Unsubscribing frees a slot.
+	send("b", "UNSUBSCRIBE VIN2")
+	if replies := send("d", "SUBSCRIBE VIN4"); len(replies) != 0 {
+		t.Errorf("expected a subscription to be accepted after an unsubscribe, found %q", replies)
+	}
+
+	if store.subscriberCount != 3 {
+		t.Errorf("expected 3 subscriptions, found %d", store.subscriberCount)
+	}
+	if store.drops[dropCapacity] != 2 {
+		t.Errorf("expected 2 capacity drops, found %d", store.drops[dropCapacity])
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "bufio"
+import "crypto/tls"
+import "errors"
+import "fmt"
+import "net"
+import "os"
+
+// This function loads the server's certificate and private key and returns a TLS configuration for
+// the subscription listener. We require TLS 1.2 or later and use Go's default cipher suites, which
+// only include suites with forward secrecy and authenticated encryption.
+func loadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return config, nil
+}
+
+// This function accepts TLS connections from subscribers until the listener is closed. Each
+// connection is handled in its own goroutine.
+func runTLSListener(listener net.Listener, store *fleetStore) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to accept TLS connection.\n  -->  %s\n", err.Error())
+			continue
+		}
+
+		go handleTLSConnection(conn.(*tls.Conn), store)
+	}
+}
+
+// A TLS connection carries a stream of newline-delimited packets in the same format as our UDP
+// packets. When the connection closes, we remove the peer from every subscriber list.
+func handleTLSConnection(conn *tls.Conn, store *fleetStore) {
+	source := newTLSPeer(conn)
+	defer source.close()
+
+	store.mutex.Lock()
+	if store.closingTLS {
+		store.mutex.Unlock()
+		return
+	}
+	store.tlsPeers[source] = true
+	store.mutex.Unlock()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		handlePacket(source, scanner.Text(), store)
+	}
+
+	store.mutex.Lock()
+	store.removeSubscriber(source)
+	delete(store.tlsPeers, source)
+	store.mutex.Unlock()
+
+	if loadSettings().verbose {
+		fmt.Println(source, "closed")
+	}
+}
+
+// This function writes the messages queued for each TLS peer, e.g. the [SHUTDOWN] notices and
+// flushed batches from a graceful shutdown, then closes the peer. It waits until every peer's
+// writer has finished, which takes at most [tlsWriteTimeout]. Any TLS connection which arrives
+// afterwards is closed straight away.
+func closeTLSPeers(store *fleetStore) {
+	store.mutex.Lock()
+	store.closingTLS = true
+	peers := make([]*tlsPeer, 0, len(store.tlsPeers))
+	for p := range store.tlsPeers {
+		peers = append(peers, p)
+	}
+	store.mutex.Unlock()
+
+	for _, p := range peers {
+		p.drain()
+	}
+	for _, p := range peers {
+		<-p.stopped
+	}
+}
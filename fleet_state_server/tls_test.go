@@ -0,0 +1,93 @@
+package main
+
+import "bufio"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "math/big"
+import "net"
+import "testing"
+import "time"
+
+// This function returns the two ends of an in-memory TLS connection. The server end uses a
+// freshly generated self-signed certificate which the client end doesn't verify.
+func testTLSConns(t *testing.T) (*tls.Conn, *tls.Conn) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	})
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	return server, client
+}
+
+func TestCloseTLSPeersDeliversQueuedMessages(t *testing.T) {
+	store := newTestStore(t)
+	server, client := testTLSConns(t)
+
+	// The peer's messages queue up while the client isn't reading.
+	p := newTLSPeer(server)
+	store.tlsPeers[p] = true
+	expected := []string{"update 1", "update 2", "update 3", "SHUTDOWN"}
+	for _, message := range expected {
+		err := p.send(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan []string)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	closeTLSPeers(store)
+
+	select {
+	case <-p.stopped:
+	default:
+		t.Errorf("expected closeTLSPeers to wait for the peer's writer")
+	}
+	if err := p.send("late"); err != errPeerStalled {
+		t.Errorf("expected a send after closing to fail, found %v", err)
+	}
+
+	lines := <-received
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %q before the connection closed, found %q", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %q, found %q", expected, lines)
+			break
+		}
+	}
+}
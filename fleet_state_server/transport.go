@@ -0,0 +1,39 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "runtime"
+import "syscall"
+
+// A packetConn sends and receives packets. This is the subset of the net.PacketConn interface we
+// actually use, which lets us swap the real UDP transport for an in-memory transport in tests.
+type packetConn interface {
+	ReadFrom(buffer []byte) (int, net.Addr, error)
+	WriteTo(message []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+// This function returns a packetConn listening for UDP packets on the specified address.
+func listenUDP(addr *net.UDPAddr) (packetConn, error) {
+	return net.ListenUDP("udp", addr)
+}
+
+// Windows reports a port in use as WSAEADDRINUSE rather than EADDRINUSE. The syscall package
+// doesn't define it so we hardcode the value from the system headers.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// This function returns true if the error is the result of trying to listen on an address that's
+// already in use.
+func isAddrInUse(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true
+	}
+	return runtime.GOOS == "windows" && errors.Is(err, wsaeaddrinuse)
+}
+
+// This function returns an actionable error for a port that's already in use, suggesting the
+// option the user can use to pick a different port.
+func portInUseError(port string, option string) error {
+	return fmt.Errorf("port %s already in use; is another server running? try %s", port, option)
+}
@@ -0,0 +1,153 @@
+package main
+
+import "net"
+import "sync"
+import "testing"
+
+// A memoryNetwork is a deterministic in-memory network for testing. Packets written to one of its
+// connections are delivered to the connection listening at the destination address. Packets sent
+// to an address with no listener are silently dropped, just like UDP.
+type memoryNetwork struct {
+	mutex sync.Mutex
+	conns map[string]*memoryConn
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{conns: make(map[string]*memoryConn)}
+}
+
+// This function returns a new connection listening at the specified address. The address can be any
+// unique string.
+func (network *memoryNetwork) listen(addr string) *memoryConn {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	conn := &memoryConn{
+		network: network,
+		addr:    memoryAddr(addr),
+		inbox:   make(chan memoryPacket, 1024),
+		closed:  make(chan struct{}),
+	}
+	network.conns[addr] = conn
+
+	return conn
+}
+
+// A memoryAddr is the address of a connection on a memoryNetwork.
+type memoryAddr string
+
+func (addr memoryAddr) Network() string {
+	return "memory"
+}
+
+func (addr memoryAddr) String() string {
+	return string(addr)
+}
+
+// A memoryPacket is a packet in transit on a memoryNetwork.
+type memoryPacket struct {
+	source  net.Addr
+	message []byte
+}
+
+// A memoryConn is a connection on a memoryNetwork. It implements the packetConn interface.
+type memoryConn struct {
+	network   *memoryNetwork
+	addr      memoryAddr
+	inbox     chan memoryPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// This function blocks until a packet arrives or the connection is closed. As with UDP, if the
+// buffer is too small the packet is truncated.
+func (conn *memoryConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-conn.inbox:
+		n := copy(buffer, packet.message)
+		return n, packet.source, nil
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (conn *memoryConn) WriteTo(message []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	conn.network.mutex.Lock()
+	target, found := conn.network.conns[addr.String()]
+	conn.network.mutex.Unlock()
+
+	if found {
+		packet := memoryPacket{source: conn.addr, message: append([]byte(nil), message...)}
+		select {
+		case target.inbox <- packet:
+		case <-target.closed:
+		}
+	}
+
+	return len(message), nil
+}
+
+func (conn *memoryConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.network.mutex.Lock()
+		delete(conn.network.conns, string(conn.addr))
+		conn.network.mutex.Unlock()
+	})
+	return nil
+}
+
+// This function returns the packets waiting in the connection's inbox without blocking. Packets
+// are delivered as soon as they're written so this is everything sent to the connection so far.
+func (conn *memoryConn) pending() []string {
+	var messages []string
+	for {
+		select {
+		case packet := <-conn.inbox:
+			messages = append(messages, string(packet.message))
+		default:
+			return messages
+		}
+	}
+}
+
+func TestMemoryNetworkDeliversToListener(t *testing.T) {
+	network := newMemoryNetwork()
+	sender := network.listen("sender")
+	receiver := network.listen("receiver")
+
+	_, err := sender.WriteTo([]byte("hello"), memoryAddr("receiver"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 3)
+	n, source, err := receiver.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "hel" {
+		t.Errorf("expected a truncated packet 'hel', found '%s'", buffer[:n])
+	}
+	if source.String() != "sender" {
+		t.Errorf("expected source 'sender', found '%s'", source)
+	}
+
+	// Packets to an address with no listener are dropped.
+	_, err = sender.WriteTo([]byte("lost"), memoryAddr("nobody"))
+	if err != nil {
+		t.Errorf("expected no error for an unreachable address, found %v", err)
+	}
+
+	receiver.Close()
+	_, _, err = receiver.ReadFrom(buffer)
+	if err != net.ErrClosed {
+		t.Errorf("expected net.ErrClosed after Close, found %v", err)
+	}
+}
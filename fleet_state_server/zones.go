@@ -0,0 +1,101 @@
+package main
+
+import "bufio"
+import "fmt"
+import "math"
+import "os"
+import "strconv"
+import "strings"
+
+// This type is a circular zone with a posted speed limit, e.g. a school zone. The radius is
+// measured in meters and the limit in meters per second.
+type speedZone struct {
+	latitude  float64
+	longitude float64
+	radius    float64
+	limit     float64
+}
+
+// If --speed-limit-zones is set, these are the zones we check subscriber updates against.
+var speedZones []speedZone
+
+// This function reads a speed limit zones file. The file contains one zone per line in the format:
+// [<lat>,<long> <radius> <limit>], with the radius in meters and the limit in m/s, e.g.
+// [53.3498,-6.2603 500 8.3]. Blank lines and lines beginning with '#' are ignored.
+func loadSpeedZones(path string) ([]speedZone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var zones []speedZone
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected '<lat>,<long> <radius> <limit>'", lineNumber)
+		}
+
+		var zone speedZone
+		_, err := fmt.Sscanf(fields[0], "%f,%f", &zone.latitude, &zone.longitude)
+		if err != nil || math.Abs(zone.latitude) > 90 || math.Abs(zone.longitude) > 180 {
+			return nil, fmt.Errorf("line %d: invalid center '%s'", lineNumber, fields[0])
+		}
+
+		zone.radius, err = strconv.ParseFloat(fields[1], 64)
+		if err != nil || !(zone.radius > 0) {
+			return nil, fmt.Errorf("line %d: invalid radius '%s'", lineNumber, fields[1])
+		}
+
+		zone.limit, err = strconv.ParseFloat(fields[2], 64)
+		if err != nil || !(zone.limit >= 0) {
+			return nil, fmt.Errorf("line %d: invalid speed limit '%s'", lineNumber, fields[2])
+		}
+
+		zones = append(zones, zone)
+	}
+
+	return zones, scanner.Err()
+}
+
+// This function returns the speed limit at the specified position and true, or false if the
+// position isn't inside any zone. Where zones overlap, the lowest limit applies.
+func speedLimitAt(latitude, longitude float64) (float64, bool) {
+	limit, found := 0.0, false
+	for _, zone := range speedZones {
+		if getDistance(zone.latitude, zone.longitude, latitude, longitude) > zone.radius {
+			continue
+		}
+		if !found || zone.limit < limit {
+			limit, found = zone.limit, true
+		}
+	}
+	return limit, found
+}
+
+// This function checks the last location in the slice against the speed limit zones. It returns
+// true if the vehicle is breaking the zone's limit, and false for found if the vehicle isn't in a
+// zone or we don't have a speed for it.
+func checkSpeedLimit(locations []location) (violation bool, found bool) {
+	if len(speedZones) == 0 || loadSettings().noSpeed {
+		return false, false
+	}
+
+	last := locations[len(locations)-1]
+	limit, found := speedLimitAt(last.latitude, last.longitude)
+	if !found {
+		return false, false
+	}
+
+	speed := computeSpeed(locations)
+	if speed < 0 {
+		return false, false
+	}
+	return speed > limit, true
+}
@@ -0,0 +1,126 @@
+package main
+
+import "errors"
+import "fmt"
+import "os"
+import "os/exec"
+import "os/signal"
+import "path/filepath"
+import "runtime"
+import "syscall"
+
+var helptext = `Usage: fleetsim <command> [options]
+
+  Runs one of the fleet simulator's binaries as a subcommand. Each command
+  accepts the same options as the standalone binary it runs and looks for
+  that binary in the same directory as fleetsim, then on the PATH.
+
+Commands:
+  client                    Run a subscriber client (client).
+  server                    Run the fleet state server (fleet_state_server).
+  simulate                  Run the vehicle simulator (vehicle_simulator).
+
+Flags:
+  -h, --help                Print this help text and exit.
+
+Use 'fleetsim <command> --help' for a command's options.
+`
+
+// Each subcommand runs the standalone binary with the same functionality. Running each command as
+// its own process keeps the binaries' flag sets and global settings completely isolated.
+var commands = map[string]string{
+	"client":   "client",
+	"server":   "fleet_state_server",
+	"simulate": "vehicle_simulator",
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, helptext)
+		os.Exit(1)
+	}
+
+	if os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		fmt.Print(helptext)
+		os.Exit(0)
+	}
+
+	name, found := commands[os.Args[1]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Error: unknown command '%s'. Run 'fleetsim --help' for usage.\n", os.Args[1])
+		os.Exit(1)
+	}
+
+	path, err := findBinary(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to find the '%s' binary.\n  -->  %s\n", name, err.Error())
+		os.Exit(1)
+	}
+
+	os.Exit(runCommand(path, os.Args[2:]))
+}
+
+// This function returns the path to the named binary. We look in the same directory as our own
+// executable first so a bin/ directory built by make works without being on the PATH.
+func findBinary(name string) (string, error) {
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		path := filepath.Join(filepath.Dir(executable), name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+
+	return exec.LookPath(name)
+}
+
+// This function runs the binary with the specified arguments, connected to our own stdin, stdout,
+// and stderr, and returns its exit code.
+//
+// We forward SIGTERM and SIGHUP to the binary rather than exiting so it can shut down gracefully
+// or reload its config. We don't forward interrupts: Ctrl-C in a terminal sends SIGINT to every
+// process in the foreground process group, which includes the binary, so forwarding would deliver
+// it twice. We still catch interrupts so we stay alive to report the binary's exit code.
+func runCommand(path string, args []string) int {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to run '%s'.\n  -->  %s\n", path, err.Error())
+		return 1
+	}
+
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: '%s' failed.\n  -->  %s\n", path, err.Error())
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import "math"
+import "math/rand"
+
+// This type models an electric vehicle's battery. The capacity and charge are measured in kWh.
+type battery struct {
+	capacity float64
+	charge   float64
+}
+
+// This function returns a new battery with the --battery-capacity capacity, or nil if battery
+// modelling is turned off. Each vehicle starts with a random charge between 20% and 100% so the
+// fleet doesn't run flat all at once.
+func newBattery() *battery {
+	if batteryCapacity == 0 {
+		return nil
+	}
+
+	return &battery{
+		capacity: batteryCapacity,
+		charge:   batteryCapacity * (0.2 + rand.Float64()*0.8),
+	}
+}
+
+// This function drains the battery for a vehicle which has travelled the specified distance in
+// meters at the specified speed in meters per second. The vehicle uses --battery-drain kWh per km
+// when crawling, rising to double that at 28 m/s (about 100 km/h), as drag increases with speed.
+func (b *battery) drain(distance, speed float64) {
+	b.charge -= distance / 1000 * batteryDrain * (1 + speed/28)
+	b.charge = math.Max(b.charge, 0)
+}
+
+// This function returns true if the battery is flat.
+func (b *battery) depleted() bool {
+	return b.charge <= 0
+}
+
+// This function returns the battery's charge as a percentage of its capacity.
+func (b *battery) percent() float64 {
+	return b.charge / b.capacity * 100
+}
@@ -0,0 +1,99 @@
+package main
+
+import "context"
+import "fmt"
+import "math"
+import "math/rand"
+import "net"
+import "time"
+
+// This type tracks the independent vehicles currently running in the simulation so that vehicles
+// can join and leave the fleet over time. Convoy vehicles aren't tracked here -- they stay in the
+// fleet for the whole run so the convoy isn't broken up. The type is only used from the goroutine
+// running [churn] so it needs no locking.
+type fleet struct {
+	serverAddr *net.UDPAddr
+	namespace  string
+
+	// Cancel functions for the running vehicles, indexed by serial number.
+	vehicles map[int]context.CancelFunc
+
+	// The serial number for the next vehicle to join the fleet. Serial numbers are never reused so
+	// each new vehicle has a fresh VIN.
+	nextSerial int
+}
+
+// This function returns a new, empty fleet. Serial numbers for new vehicles start at nextSerial.
+func newFleet(serverAddr *net.UDPAddr, namespace string, nextSerial int) *fleet {
+	return &fleet{
+		serverAddr: serverAddr,
+		namespace:  namespace,
+		vehicles:   make(map[int]context.CancelFunc),
+		nextSerial: nextSerial,
+	}
+}
+
+// This function launches a new independent vehicle and returns its VIN.
+func (f *fleet) spawn() string {
+	serial := f.nextSerial
+	f.nextSerial++
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.vehicles[serial] = cancel
+	go simulateVehicle(ctx, f.serverAddr, serial, f.namespace, nil, 0)
+
+	return makeVIN(serial)
+}
+
+// This function stops a randomly selected vehicle and returns its VIN. It returns false if the
+// fleet is empty.
+func (f *fleet) despawn() (string, bool) {
+	if len(f.vehicles) == 0 {
+		return "", false
+	}
+
+	target := rand.Intn(len(f.vehicles))
+	for serial, cancel := range f.vehicles {
+		if target == 0 {
+			cancel()
+			delete(f.vehicles, serial)
+			return makeVIN(serial), true
+		}
+		target--
+	}
+
+	return "", false
+}
+
+// This function adds and removes vehicles once per second, forever. The rates are the average
+// number of vehicles joining and leaving the fleet per second.
+func (f *fleet) churn(spawnRate, despawnRate float64) {
+	for {
+		time.Sleep(time.Second)
+
+		for i := 0; i < churnCount(despawnRate); i++ {
+			vin, ok := f.despawn()
+			if !ok {
+				break
+			}
+			fmt.Printf("Despawn: %s left the fleet.\n", vin)
+		}
+
+		for i := 0; i < churnCount(spawnRate); i++ {
+			vin := f.spawn()
+			fmt.Printf("Spawn: %s joined the fleet.\n", vin)
+		}
+	}
+}
+
+// This function returns the number of vehicles to add or remove in a one-second interval given
+// the average rate per second. A fractional rate is handled probabilistically, e.g. a rate of 2.5
+// gives 2 vehicles half the time and 3 vehicles the other half.
+func churnCount(rate float64) int {
+	whole := math.Floor(rate)
+	count := int(whole)
+	if rand.Float64() < rate-whole {
+		count++
+	}
+	return count
+}
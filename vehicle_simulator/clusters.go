@@ -0,0 +1,83 @@
+package main
+
+import "fmt"
+import "math/rand"
+import "strconv"
+import "strings"
+
+// This type is a regional cluster of vehicles, e.g. the part of the fleet based in one city. Each
+// vehicle in the cluster starts at its center. If fence is not nil, the cluster's vehicles are
+// confined to it.
+type cluster struct {
+	number    int
+	latitude  float64
+	longitude float64
+	count     int
+	fence     *geofence
+}
+
+// This function parses a clusters string with the format: [<lat>,<long>:<count>[:<radius>];...].
+// The optional radius is measured in meters and confines the cluster's vehicles to a circle
+// around its center.
+func parseClusters(arg string) ([]*cluster, error) {
+	var result []*cluster
+	for _, element := range strings.Split(arg, ";") {
+		parts := strings.Split(strings.TrimSpace(element), ":")
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, fmt.Errorf("invalid cluster '%s', expected '<lat>,<long>:<count>[:<radius>]'", element)
+		}
+
+		latitude, longitude, err := parseGeofenceCenter(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster center '%s': %w", parts[0], err)
+		}
+
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid cluster size '%s'", parts[1])
+		}
+
+		c := &cluster{number: len(result) + 1, latitude: latitude, longitude: longitude, count: count}
+
+		if len(parts) == 3 {
+			radius, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil || !(radius > 0) {
+				return nil, fmt.Errorf("invalid cluster radius '%s'", parts[2])
+			}
+			c.fence = &geofence{latitude: latitude, longitude: longitude, radius: radius}
+		}
+
+		result = append(result, c)
+	}
+
+	return result, nil
+}
+
+// This function returns the cluster for the vehicle with the specified serial number, or nil if
+// --clusters isn't set. The starting fleet is assigned to clusters in order, e.g. with clusters of
+// 20 and 10 vehicles, vehicles 0-19 go to the first cluster and 20-29 to the second. Vehicles which
+// join later with --spawn-rate are assigned at random, weighted by cluster size.
+func clusterFor(serialNumber int) *cluster {
+	if len(clusters) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, c := range clusters {
+		total += c.count
+	}
+
+	index := serialNumber
+	if index >= total {
+		index = rand.Intn(total)
+	}
+
+	for _, c := range clusters {
+		if index < c.count {
+			return c
+		}
+		index -= c.count
+	}
+
+	return nil
+}
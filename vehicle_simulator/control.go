@@ -0,0 +1,83 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "strings"
+import "time"
+
+// The limits for a vehicle's reporting interval. These match the limits the server enforces on
+// SETRATE commands.
+const minReportInterval = 100 * time.Millisecond
+const maxReportInterval = time.Hour
+
+// If the --control flag is set, each vehicle listens for commands from the server on its own UDP
+// port and includes a [control=<port>] field in its update packets so the server knows where to
+// send them. The only command is [SETRATE <vin> <interval>], which changes the interval between
+// the vehicle's update packets.
+var enableControl bool
+
+// This function opens a vehicle's control socket on a port picked by the OS.
+func openControlSocket() (*net.UDPConn, error) {
+	return net.ListenUDP("udp", &net.UDPAddr{})
+}
+
+// This function reads commands from the vehicle's control socket until the socket is closed and
+// sends each new reporting interval to the rates channel, which must have a buffer of size 1. We
+// only accept commands from the server's address.
+func readCommands(conn *net.UDPConn, serverAddr *net.UDPAddr, vin string, rates chan time.Duration) {
+	buffer := make([]byte, 1024)
+
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		if !source.IP.Equal(serverAddr.IP) || source.Port != serverAddr.Port {
+			fmt.Printf("Control: %s ignored a command from unexpected address '%s'.\n", vin, source)
+			continue
+		}
+
+		for _, message := range strings.Split(strings.TrimRight(string(buffer[:n]), "\n"), "\n") {
+			interval, err := parseSetRate(message, vin)
+			if err != nil {
+				fmt.Printf("Control: %s ignored an invalid command '%s'.\n  -->  %s\n", vin, message, err.Error())
+				continue
+			}
+			// A newer command supersedes one the vehicle hasn't applied yet. We're the only
+			// sender so the send can't block once the buffer is empty.
+			select {
+			case <-rates:
+			default:
+			}
+			rates <- interval
+		}
+	}
+}
+
+// This function parses a command with the format: [SETRATE <vin> <interval>].
+func parseSetRate(message string, vin string) (time.Duration, error) {
+	elements := strings.Fields(message)
+	if len(elements) != 3 || elements[0] != "SETRATE" {
+		return 0, fmt.Errorf("unrecognised command")
+	}
+
+	if elements[1] != vin {
+		return 0, fmt.Errorf("command is for vehicle %s", elements[1])
+	}
+
+	interval, err := time.ParseDuration(elements[2])
+	if err != nil {
+		return 0, err
+	}
+
+	if interval < minReportInterval || interval > maxReportInterval {
+		return 0, fmt.Errorf("interval must be in the range [%s, %s]", minReportInterval, maxReportInterval)
+	}
+
+	return interval, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "math"
+import "sync"
+
+// This type lets the lead vehicle in a convoy publish its state to the vehicles following it. Each
+// follower shares the lead vehicle's speed and direction but trails it by a fixed distance.
+type convoy struct {
+	mutex     sync.Mutex
+	latitude  float64
+	longitude float64
+	speed     float64
+	direction float64
+
+	// The distance in meters between consecutive vehicles in the convoy.
+	spacing float64
+}
+
+// This function returns a new convoy. Until the lead vehicle publishes its first update, the
+// convoy is stationary at the specified position.
+func newConvoy(latitude, longitude, direction, spacing float64) *convoy {
+	return &convoy{
+		latitude:  latitude,
+		longitude: longitude,
+		direction: direction,
+		spacing:   spacing,
+	}
+}
+
+// The lead vehicle calls this function to publish its latest state.
+func (c *convoy) publish(latitude, longitude, speed, direction float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.latitude = latitude
+	c.longitude = longitude
+	c.speed = speed
+	c.direction = direction
+}
+
+// Following vehicles call this function to get their latest state. The position argument is the
+// vehicle's position in the convoy -- 1 for the vehicle directly behind the lead, 2 for the vehicle
+// behind that, etc. The function returns the vehicle's latitude, longitude, speed, and direction.
+func (c *convoy) follow(position int) (float64, float64, float64, float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// We find the follower's location by moving backwards from the lead vehicle's location, i.e.
+	// travelling in the opposite direction for the follower's trailing distance.
+	trailingDistance := c.spacing * float64(position)
+	latitude, longitude := updateLocation(c.latitude, c.longitude, trailingDistance, c.direction+math.Pi, 1.0)
+
+	return latitude, longitude, c.speed, c.direction
+}
@@ -0,0 +1,24 @@
+package main
+
+import "math/rand"
+
+// If the --events flag is set, each update packet has this probability of carrying a status code.
+const eventProbability = 0.02
+
+// The status codes a simulated vehicle can report. These are just examples -- the server and the
+// client treat status codes as opaque strings.
+var eventCodes = []string{
+	"door-open",
+	"engine-fault",
+	"low-tire",
+	"panic",
+}
+
+// This function returns a random status code, or an empty string if the vehicle has nothing to
+// report this time.
+func randomEvent() string {
+	if rand.Float64() >= eventProbability {
+		return ""
+	}
+	return eventCodes[rand.Intn(len(eventCodes))]
+}
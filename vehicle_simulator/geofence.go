@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+import "math"
+import "math/rand"
+
+// This type is a circular region that confines the simulated vehicles, e.g. to a realistic service
+// area. The radius is measured in meters.
+type geofence struct {
+	latitude  float64
+	longitude float64
+	radius    float64
+}
+
+// This function parses a center string with the format: [<lat>,<long>].
+func parseGeofenceCenter(center string) (float64, float64, error) {
+	var latitude, longitude float64
+	_, err := fmt.Sscanf(center, "%f,%f", &latitude, &longitude)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return 0, 0, fmt.Errorf("coordinates out of range")
+	}
+
+	return latitude, longitude, nil
+}
+
+// This function returns the offset in meters east and north from the center of the geofence to
+// the specified position.
+func (g *geofence) offset(latitude, longitude float64) (float64, float64) {
+	return flatOffset(g.latitude, g.longitude, latitude, longitude)
+}
+
+// This function returns the offset in meters east and north from one position to another. Like
+// [updateLocation], this is a flat-earth approximation which is fine over the distances we're
+// simulating. We take the shorter way round so positions either side of the antimeridian are
+// close together.
+func flatOffset(fromLatitude, fromLongitude, toLatitude, toLongitude float64) (float64, float64) {
+	x := normalizeLongitude(toLongitude-fromLongitude) * 111319.5 * math.Cos(fromLatitude*math.Pi/180.0)
+	y := (toLatitude - fromLatitude) / 0.000009
+	return x, y
+}
+
+// This function returns true if the position is inside the geofence.
+func (g *geofence) contains(latitude, longitude float64) bool {
+	x, y := g.offset(latitude, longitude)
+	return math.Hypot(x, y) <= g.radius
+}
+
+// This function returns a new direction for a vehicle at the specified position which is about to
+// leave the geofence. The vehicle turns back towards the center, give or take up to 45 degrees, so
+// vehicles don't all converge on the center point. The direction is measured in radians
+// anticlockwise from due east.
+func (g *geofence) steer(latitude, longitude float64) float64 {
+	x, y := g.offset(latitude, longitude)
+	direction := math.Atan2(-y, -x)
+	direction += (rand.Float64()*2 - 1) * math.Pi / 4
+	return math.Mod(direction+2*math.Pi, 2*math.Pi)
+}
@@ -0,0 +1,88 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "strconv"
+import "strings"
+
+// The largest payload the server can read from a single UDP packet. Anything longer is truncated.
+const maxPacketSize = 65507
+
+// If set to true, vehicles send their update packets as GeoJSON Point features instead of text.
+// Set by --format geojson.
+var sendGeoJSON bool
+
+// This type is a vehicle update in GeoJSON format, a Feature with a Point geometry. The geometry
+// is null if the vehicle has no GPS fix. We use json.Number for the coordinates so they keep the
+// --precision of the text packet.
+// Ref: https://datatracker.ietf.org/doc/html/rfc7946
+type pointFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *pointGeometry         `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// This type is a GeoJSON Point. Coordinates are in the order [longitude, latitude].
+type pointGeometry struct {
+	Type        string        `json:"type"`
+	Coordinates []json.Number `json:"coordinates"`
+}
+
+// The optional fields we send as JSON numbers rather than strings.
+var numericProperties = map[string]bool{
+	"battery": true,
+	"control": true,
+	"seq":     true,
+}
+
+// This function converts a text update packet into a GeoJSON Point feature with the vehicle's
+// timestamp, VIN, and speed in m/s as properties, along with any optional [<key>=<value>] fields.
+// The packet is assumed to have the format: [<timestamp> <vin> <latitude> <longitude>] optionally
+// followed by [<key>=<value>] fields. It returns an error if the feature would be too large for
+// the server to read in a single packet.
+func encodeGeoJSON(message string, speed float64) (string, error) {
+	elements := strings.Split(message, " ")
+	if len(elements) < 4 {
+		return "", fmt.Errorf("expected 4 fields, found %d", len(elements))
+	}
+
+	feature := pointFeature{
+		Type: "Feature",
+		Properties: map[string]interface{}{
+			"timestamp": elements[0],
+			"vin":       elements[1],
+			"speed":     json.Number(strconv.FormatFloat(speed, 'f', 2, 64)),
+		},
+	}
+
+	if elements[2] != noFix {
+		feature.Geometry = &pointGeometry{
+			Type:        "Point",
+			Coordinates: []json.Number{json.Number(elements[3]), json.Number(elements[2])},
+		}
+	}
+
+	for _, element := range elements[4:] {
+		index := strings.Index(element, "=")
+		if index < 0 {
+			continue
+		}
+		key, value := element[:index], element[index+1:]
+		if numericProperties[key] {
+			feature.Properties[key] = json.Number(value)
+		} else {
+			feature.Properties[key] = value
+		}
+	}
+
+	data, err := json.Marshal(feature)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > maxPacketSize {
+		return "", fmt.Errorf("the feature is %d bytes, larger than the maximum packet size of %d bytes", len(data), maxPacketSize)
+	}
+
+	return string(data), nil
+}
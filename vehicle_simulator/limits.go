@@ -0,0 +1,72 @@
+package main
+
+import "fmt"
+import "os"
+import "strconv"
+import "strings"
+
+// The largest fleet we'll simulate without the --force flag. Each vehicle runs in its own goroutine
+// with its own UDP socket so very large fleets are more likely to be a typo than a plan.
+const maxFleetSize = 10000
+
+// The number of file descriptors we leave free for the process itself, e.g. stdin/stdout/stderr
+// and any sockets the runtime opens, on top of the one socket per vehicle.
+const reservedFileDescriptors = 32
+
+// This function returns an error if a fleet of the specified size is likely to exceed the
+// process's resources: either it's larger than [maxFleetSize] or the vehicles' sockets would
+// exceed the limit on open file descriptors.
+func checkFleetSize(numVehicles int) error {
+	if numVehicles > maxFleetSize {
+		return fmt.Errorf("%d vehicles exceeds the maximum fleet size of %d", numVehicles, maxFleetSize)
+	}
+
+	// With --control, each vehicle also has a control socket.
+	needed := numVehicles + reservedFileDescriptors
+	if enableControl {
+		needed += numVehicles
+	}
+
+	limit, found := openFileLimit()
+	if found && needed > limit {
+		return fmt.Errorf(
+			"%d vehicles need at least %d file descriptors but the limit is %d, try raising it with 'ulimit -n'",
+			numVehicles,
+			needed,
+			limit)
+	}
+
+	return nil
+}
+
+// This function returns the process's soft limit on open file descriptors. We read the limit from
+// /proc rather than calling getrlimit as syscall.Getrlimit doesn't exist on Windows and the makefile
+// builds every file for every platform. The second return value is false if the limit is unknown
+// (e.g. on platforms without /proc) or unlimited.
+func openFileLimit() (int, bool) {
+	data, err := os.ReadFile("/proc/self/limits")
+	if err != nil {
+		return 0, false
+	}
+
+	// The line has the format: [Max open files <soft> <hard> files].
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return 0, false
+		}
+
+		limit, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, false
+		}
+
+		return limit, true
+	}
+
+	return 0, false
+}
@@ -1,13 +1,30 @@
 package main
 
+import "context"
 import "fmt"
 import "net"
 import "os"
 import "time"
 import "os/signal"
+import "syscall"
 import "flag"
 import "math"
 import "math/rand"
+import "sync/atomic"
+
+// The maximum delay between send attempts when a vehicle is backing off after consecutive failed
+// sends.
+const maxBackoff = time.Minute
+
+// The initial position of each simulated vehicle. Every vehicle starts off in the centre of Dublin
+// at the front gate of Trinity College. Working with latitude/longitude coordinates to six decimal
+// places gives us accuracy to within about 11cm.
+// Ref: https://en.wikipedia.org/wiki/Decimal_degrees
+const startLatitude = 53.344496
+const startLongitude = -6.259427
+
+// A vehicle with no GPS fix sends this sentinel in place of its latitude and longitude.
+const noFix = "nofix"
 
 var helptext = `Usage: vehicle_simulator
 
@@ -15,17 +32,208 @@ var helptext = `Usage: vehicle_simulator
   fleet sends a location update once per second to the fleet state server.
 
 Options:
+  --battery-capacity <float>
+                            Battery capacity in kWh. If set, each vehicle
+                            reports its battery level and stops when the
+                            battery is flat. Zero turns batteries off.
+                            Default: 0.
+  --battery-drain <float>   Battery consumption in kWh per km at low speed.
+                            Consumption doubles at 100 km/h.
+                            Default: 0.15.
+  --clusters <string>       Split the fleet into regional clusters in the
+                            format 'lat,long:count[:radius];...'. Each
+                            cluster's vehicles start at its center and, if a
+                            radius in meters is given, stay within it.
+                            Replaces --number.
+  --convoy <int>            Number of vehicles travelling together in a
+                            convoy. The first vehicle leads and the others
+                            follow it in line.
+                            Default: 0.
+  --convoy-spacing <float>  Distance in meters between vehicles in the convoy.
+                            Default: 25.
+  --despawn-rate <float>    Average number of vehicles leaving the fleet per
+                            second. Convoy vehicles never leave.
+                            Default: 0.
+  --dropout-rate <float>    Fraction of update packets that report no GPS fix
+                            instead of coordinates, in the range [0, 1].
+                            Default: 0.
+  --fleet <string>          Fleet namespace for the simulated vehicles.
+                            Default: the server's default namespace.
+  --format <string>         Format of update packets: 'text' or 'geojson'.
+                            GeoJSON updates are Point features with the
+                            vehicle's speed as a property. Heartbeats are
+                            always text.
+                            Default: "text".
+  --heading-spread <float>  Vehicles start on a heading chosen at random within
+                            this many degrees either side of --initial-heading.
+                            Default: 180, i.e. any heading.
   --host <string>           IP address of the fleet state server.
                             Default: "localhost".
+  --initial-heading <float> Central compass bearing in degrees for the
+                            vehicles' initial headings, e.g. the bearing of
+                            a main road. See --heading-spread.
+                            Default: 0.
+  --malform-rate <float>    Fraction of update packets to deliberately
+                            malform for fuzz testing the server, in the
+                            range [0, 1].
+                            Default: 0.
+  --max-turn-rate <float>   Maximum rate at which a vehicle's heading changes
+                            in radians per second. Zero means vehicles travel
+                            in straight lines.
+                            Default: 0.1.
+  --model <string>          Movement model for the vehicles: 'random-walk',
+                            'waypoints', or 'roads'.
+                            Default: 'roads' if --roads is set, 'waypoints'
+                            if --waypoints is set, otherwise 'random-walk'.
   --number <int>            Number of vehicles in the simulated fleet.
                             Default: 20.
   --port <int>              Port number of the fleet state server.
                             Default: 8000.
+  --precision <int>         Number of decimal places for latitude and
+                            longitude in update packets, in the range [0, 9].
+                            Default: 6.
+  --push-interval <duration>
+                            How often to push metrics to the --pushgateway.
+                            Default: "10s".
+  --pushgateway <url>       Push the simulator's packet counts and number of
+                            active vehicles to the Prometheus Pushgateway at
+                            this URL, e.g. "http://localhost:9091".
+                            Default: disabled.
+  --ramp-rate <float>       Number of vehicles to start per second. Zero
+                            starts the whole fleet at once.
+                            Default: 0.
+  --record <file>           Append every packet the vehicles send to this file
+                            in the --replay format.
+  --replay <file>           Replay a recorded session from a file instead of
+                            simulating vehicles. The file contains one update
+                            packet per line.
+  --roads <file>            GeoJSON file containing a road network of
+                            LineStrings. Vehicles drive along the roads,
+                            turning at random at intersections.
+  --route-mode <string>     What vehicles following --waypoints do at the last
+                            waypoint: 'loop' to drive back to the first,
+                            'reverse' to drive the route backwards, or 'once'
+                            to stop.
+                            Default: 'loop'.
+  --sim-geofence-center <string>
+                            Center of a circular region that confines the
+                            vehicles, in the format 'lat,long'.
+                            Default: the vehicles' starting position.
+  --sim-geofence-radius <float>
+                            Radius in meters of the confining region. Zero
+                            means vehicles can roam freely.
+                            Default: 0.
+  --source-port-range <string>
+                            Send each vehicle's packets from a local port in
+                            this range, e.g. '40000-40999'. Each vehicle
+                            holds one port unless --dial-per-packet is set.
+                            Default: the OS picks each port.
+  --spawn-rate <float>      Average number of new vehicles joining the fleet
+                            per second.
+                            Default: 0.
+  --speed-multiplier <float>
+                            Replay speed relative to real time, e.g. 60 to
+                            replay an hour in a minute. Zero sends packets as
+                            fast as possible.
+                            Default: 1.
+  --vin-list <file>         File of VINs for the vehicles, one per line. The
+                            first vehicle uses the first VIN, etc. Vehicles
+                            beyond the end of the list use --vin-template.
+  --vin-template <string>   Template for generated VINs, with a single %d or
+                            %0Nd placeholder for the vehicle's serial number.
+                            VINs must have 17 characters.
+                            Default: "1HGBH41JXMN%06d".
+  --waypoints <string>      Circuit of waypoints for the 'waypoints' model in
+                            the format 'lat,long;lat,long;...'.
 
 Flags:
   -h, --help                Print this help text and exit.
+  --control                 Listen for commands from the server, e.g. to change
+                            a vehicle's reporting interval. Each vehicle opens
+                            its own control port.
+  --dial-per-packet         Dial a new UDP connection for every packet
+                            instead of reusing one connection per vehicle.
+  --events                  Occasionally include a random status code, e.g.
+                            'door-open' or 'panic', in update packets.
+  --force                   Start the fleet even if it's larger than 10,000
+                            vehicles or would exceed the open file limit.
+  --heartbeats              Send a lightweight heartbeat packet instead of an
+                            update while the vehicle is stationary.
+  --ignition                Include the vehicle's ignition state in each
+                            update packet.
+  --print-config            Print the effective value of every option on
+                            startup.
+  --require-server          Check the server is reachable before starting
+                            and exit with an error if it isn't.
+  --rewrite-timestamps      In replay mode, replace each packet's timestamp
+                            with the time it's sent.
+  --sequence                Include a sequence number in each update packet.
 `
 
+// If set to true, each vehicle includes a monotonically increasing sequence number in its update
+// packets so the server can measure packet loss. As in the server, we're using a global variable
+// here to avoid passing settings through every function.
+var includeSequence bool
+
+// If set to true, each vehicle includes its ignition state in its update packets.
+var includeIgnition bool
+
+// If set to true, vehicles occasionally include a random status code in their update packets.
+var includeEvents bool
+
+// If set to true, a vehicle whose update would be identical to its last update apart from the
+// timestamp, e.g. because it's stopped, sends a [HEARTBEAT <vin> <timestamp>] packet instead.
+var sendHeartbeats bool
+
+// The number of vehicles to start per second. Zero means start the whole fleet at once.
+var rampRate float64
+
+// If not nil, vehicles are confined to this region. Vehicles start at its center.
+var simGeofence *geofence
+
+// If not nil, vehicles drive along the roads in this network.
+var roads *roadNetwork
+
+// The movement model for the vehicles. See [newMover].
+var movementModel string
+
+// If the movement model is 'waypoints', vehicles drive around this circuit.
+var waypoints []waypoint
+
+// What vehicles following waypoints do at the end of the route. See [waypointFollower.advance].
+var routeMode string
+
+// If not empty, the fleet is split into these regional clusters. See [clusterFor].
+var clusters []*cluster
+
+// The fraction of update packets that are deliberately malformed.
+var malformRate float64
+
+// The fraction of update packets that report no GPS fix instead of coordinates.
+var dropoutRate float64
+
+// The maximum rate at which a vehicle's heading changes in radians per second.
+var maxTurnRate float64
+
+// Each vehicle's initial heading is a compass bearing in degrees chosen at random within
+// headingSpread degrees either side of initialHeading. A spread of 180 degrees means any heading.
+var initialHeading float64
+var headingSpread float64
+
+// The number of decimal places for coordinates in update packets.
+var coordinatePrecision int
+
+// If set to true, each vehicle dials a new connection for every packet instead of reusing one.
+var dialPerPacket bool
+
+// If set to true, we start the fleet even if it looks too large for the available resources.
+var force bool
+
+// If batteryCapacity is non-zero, each vehicle has a battery with this capacity in kWh which drains
+// at batteryDrain kWh per km, more at higher speeds.
+var batteryCapacity float64
+var batteryDrain float64
+
 func main() {
 	var host string
 	flag.StringVar(&host, "host", "localhost", "IP address for server.")
@@ -36,16 +244,420 @@ func main() {
 	var number int
 	flag.IntVar(&number, "number", 20, "Number of vehicles.")
 
+	var namespace string
+	flag.StringVar(&namespace, "fleet", "", "Fleet namespace.")
+
+	flag.BoolVar(&includeSequence, "sequence", false, "Include sequence numbers.")
+
+	flag.BoolVar(&includeIgnition, "ignition", false, "Include ignition state.")
+
+	flag.BoolVar(&includeEvents, "events", false, "Include random status codes.")
+
+	flag.BoolVar(&enableControl, "control", false, "Accept commands from the server.")
+
+	flag.BoolVar(&sendHeartbeats, "heartbeats", false, "Send heartbeats while stationary.")
+
+	flag.BoolVar(&dialPerPacket, "dial-per-packet", false, "Dial a new connection per packet.")
+
+	// If set, each vehicle sends its packets from a local port in this range.
+	var sourcePortRange string
+	flag.StringVar(&sourcePortRange, "source-port-range", "", "Local port range for vehicles.")
+
+	flag.BoolVar(&force, "force", false, "Skip the fleet size checks.")
+
+	flag.BoolVar(&requireServer, "require-server", false, "Exit if the server is unreachable.")
+
+	flag.Float64Var(&batteryCapacity, "battery-capacity", 0, "Battery capacity in kWh.")
+	flag.Float64Var(&batteryDrain, "battery-drain", 0.15, "Battery drain in kWh/km.")
+
+	flag.Float64Var(&malformRate, "malform-rate", 0, "Fraction of malformed packets.")
+
+	flag.Float64Var(&dropoutRate, "dropout-rate", 0, "Fraction of packets with no GPS fix.")
+
+	flag.IntVar(&coordinatePrecision, "precision", 6, "Decimal places for coordinates.")
+
+	flag.Float64Var(&maxTurnRate, "max-turn-rate", 0.1, "Maximum turn rate in radians/sec.")
+
+	flag.Float64Var(&initialHeading, "initial-heading", 0, "Initial compass heading in degrees.")
+	flag.Float64Var(&headingSpread, "heading-spread", 180, "Spread in degrees around the initial heading.")
+
+	var convoySize int
+	flag.IntVar(&convoySize, "convoy", 0, "Number of vehicles in convoy.")
+
+	var convoySpacing float64
+	flag.Float64Var(&convoySpacing, "convoy-spacing", 25, "Distance between convoy vehicles.")
+
+	var roadsFile string
+	flag.StringVar(&roadsFile, "roads", "", "GeoJSON road network.")
+
+	flag.StringVar(&movementModel, "model", "", "Movement model.")
+
+	var clustersArg string
+	flag.StringVar(&clustersArg, "clusters", "", "Regional clusters of vehicles.")
+
+	var waypointsArg string
+	flag.StringVar(&waypointsArg, "waypoints", "", "Circuit of waypoints.")
+
+	flag.StringVar(&routeMode, "route-mode", routeLoop, "End of route behaviour for waypoints.")
+
+	var format string
+	flag.StringVar(&format, "format", "text", "Format of update packets.")
+
+	var geofenceCenter string
+	flag.StringVar(&geofenceCenter, "sim-geofence-center", "", "Center of confining region.")
+
+	var geofenceRadius float64
+	flag.Float64Var(&geofenceRadius, "sim-geofence-radius", 0, "Radius of confining region.")
+
+	flag.Float64Var(&rampRate, "ramp-rate", 0, "Vehicles to start per second.")
+
+	var spawnRate float64
+	flag.Float64Var(&spawnRate, "spawn-rate", 0, "Vehicles joining per second.")
+
+	var despawnRate float64
+	flag.Float64Var(&despawnRate, "despawn-rate", 0, "Vehicles leaving per second.")
+
+	var replayFile string
+	flag.StringVar(&replayFile, "replay", "", "Recorded session to replay.")
+
+	var speedMultiplier float64
+	flag.Float64Var(&speedMultiplier, "speed-multiplier", 1, "Replay speed multiplier.")
+
+	var rewriteTimestamps bool
+	flag.BoolVar(&rewriteTimestamps, "rewrite-timestamps", false, "Rewrite replayed timestamps.")
+
+	flag.StringVar(&vinTemplate, "vin-template", "1HGBH41JXMN%06d", "Template for generated VINs.")
+
+	var vinListFile string
+	flag.StringVar(&vinListFile, "vin-list", "", "File of VINs for the vehicles.")
+
+	// If set, we push the simulator's metrics to this Prometheus Pushgateway.
+	var pushgateway string
+	flag.StringVar(&pushgateway, "pushgateway", "", "Prometheus Pushgateway URL.")
+
+	var pushInterval time.Duration
+	flag.DurationVar(&pushInterval, "push-interval", 10*time.Second, "Metrics push interval.")
+
+	// If set, we append every packet the vehicles send to this file.
+	var recordFile string
+	flag.StringVar(&recordFile, "record", "", "File to record sent packets to.")
+
+	// If set to true, we print the effective settings on startup.
+	var showConfig bool
+	flag.BoolVar(&showConfig, "print-config", false, "Print the effective settings.")
+
 	flag.Usage = func() {
 		fmt.Print(helptext)
 	}
 
 	flag.Parse()
+
+	if convoySize < 0 || convoySize > number {
+		fmt.Fprintf(os.Stderr, "Error: the convoy size must be in the range [0, %d].\n", number)
+		os.Exit(1)
+	}
+
+	if batteryCapacity < 0 || batteryDrain < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the battery capacity and drain must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if dropoutRate < 0 || dropoutRate > 1 {
+		fmt.Fprintf(os.Stderr, "Error: the dropout rate must be in the range [0, 1].\n")
+		os.Exit(1)
+	}
+
+	if malformRate < 0 || malformRate > 1 {
+		fmt.Fprintf(os.Stderr, "Error: the malform rate must be in the range [0, 1].\n")
+		os.Exit(1)
+	}
+
+	if format != "text" && format != "geojson" {
+		fmt.Fprintf(os.Stderr, "Error: the format must be 'text' or 'geojson'.\n")
+		os.Exit(1)
+	}
+	sendGeoJSON = format == "geojson"
+
+	if sendGeoJSON && malformRate > 0 {
+		fmt.Fprintf(os.Stderr, "Error: --malform-rate requires the text format.\n")
+		os.Exit(1)
+	}
+
+	if coordinatePrecision < 0 || coordinatePrecision > 9 {
+		fmt.Fprintf(os.Stderr, "Error: the precision must be in the range [0, 9].\n")
+		os.Exit(1)
+	}
+
+	if maxTurnRate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the maximum turn rate must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if !(initialHeading >= 0 && initialHeading < 360) {
+		fmt.Fprintf(os.Stderr, "Error: the initial heading must be in the range [0, 360).\n")
+		os.Exit(1)
+	}
+
+	if !(headingSpread >= 0 && headingSpread <= 180) {
+		fmt.Fprintf(os.Stderr, "Error: the heading spread must be in the range [0, 180].\n")
+		os.Exit(1)
+	}
+
+	if convoySpacing <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: the convoy spacing must be greater than zero.\n")
+		os.Exit(1)
+	}
+
+	if geofenceRadius < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the geofence radius must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if geofenceRadius > 0 {
+		simGeofence = &geofence{latitude: startLatitude, longitude: startLongitude, radius: geofenceRadius}
+		if geofenceCenter != "" {
+			latitude, longitude, err := parseGeofenceCenter(geofenceCenter)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid geofence center '%s'.\n  -->  %s\n", geofenceCenter, err.Error())
+				os.Exit(1)
+			}
+			simGeofence.latitude = latitude
+			simGeofence.longitude = longitude
+		}
+	} else if geofenceCenter != "" {
+		fmt.Fprintf(os.Stderr, "Error: --sim-geofence-center requires --sim-geofence-radius.\n")
+		os.Exit(1)
+	}
+
+	if roadsFile != "" {
+		if convoySize > 0 || simGeofence != nil {
+			fmt.Fprintf(os.Stderr, "Error: --roads can't be used with --convoy or a geofence.\n")
+			os.Exit(1)
+		}
+
+		network, err := loadRoadNetwork(roadsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to load road network '%s'.\n  -->  %s\n", roadsFile, err.Error())
+			os.Exit(1)
+		}
+		roads = network
+	}
+
+	if movementModel == "" {
+		if roads != nil {
+			movementModel = modelRoads
+		} else if waypointsArg != "" {
+			movementModel = modelWaypoints
+		} else {
+			movementModel = modelRandomWalk
+		}
+	}
+
+	if waypointsArg != "" && movementModel != modelWaypoints {
+		fmt.Fprintf(os.Stderr, "Error: --waypoints requires --model waypoints.\n")
+		os.Exit(1)
+	}
+
+	if routeMode != routeLoop && routeMode != routeReverse && routeMode != routeOnce {
+		fmt.Fprintf(os.Stderr, "Error: invalid route mode '%s'.\n", routeMode)
+		os.Exit(1)
+	}
+
+	if routeMode != routeLoop && movementModel != modelWaypoints {
+		fmt.Fprintf(os.Stderr, "Error: --route-mode requires --model waypoints.\n")
+		os.Exit(1)
+	}
+
+	if roads != nil && movementModel != modelRoads {
+		fmt.Fprintf(os.Stderr, "Error: --roads requires --model roads.\n")
+		os.Exit(1)
+	}
+
+	switch movementModel {
+	case modelRandomWalk:
+	case modelRoads:
+		if roads == nil {
+			fmt.Fprintf(os.Stderr, "Error: --model roads requires --roads.\n")
+			os.Exit(1)
+		}
+	case modelWaypoints:
+		if simGeofence != nil {
+			fmt.Fprintf(os.Stderr, "Error: --model waypoints can't be used with a geofence.\n")
+			os.Exit(1)
+		}
+		if waypointsArg == "" {
+			fmt.Fprintf(os.Stderr, "Error: --model waypoints requires --waypoints.\n")
+			os.Exit(1)
+		}
+		parsed, err := parseWaypoints(waypointsArg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid waypoints '%s'.\n  -->  %s\n", waypointsArg, err.Error())
+			os.Exit(1)
+		}
+		waypoints = parsed
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid movement model '%s'.\n", movementModel)
+		os.Exit(1)
+	}
+
+	if clustersArg != "" {
+		if convoySize > 0 || simGeofence != nil || movementModel != modelRandomWalk {
+			fmt.Fprintf(os.Stderr, "Error: --clusters can only be used with the random-walk model and no convoy or geofence.\n")
+			os.Exit(1)
+		}
+
+		numberSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "number" {
+				numberSet = true
+			}
+		})
+		if numberSet {
+			fmt.Fprintf(os.Stderr, "Error: --clusters sets the fleet size so it can't be used with --number.\n")
+			os.Exit(1)
+		}
+
+		parsed, err := parseClusters(clustersArg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid clusters '%s'.\n  -->  %s\n", clustersArg, err.Error())
+			os.Exit(1)
+		}
+		clusters = parsed
+
+		number = 0
+		for _, c := range clusters {
+			number += c.count
+		}
+	}
+
+	if rampRate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the ramp rate must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if spawnRate < 0 || despawnRate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the spawn and despawn rates must not be negative.\n")
+		os.Exit(1)
+	}
+
+	if speedMultiplier < 0 {
+		fmt.Fprintf(os.Stderr, "Error: the speed multiplier must not be negative.\n")
+		os.Exit(1)
+	}
+
+	// Spawned vehicles have serial numbers beyond the initial fleet, so the template is only
+	// checked for the initial fleet's serial numbers.
+	err := checkVINTemplate(vinTemplate, number)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid VIN template '%s'.\n  -->  %s\n", vinTemplate, err.Error())
+		os.Exit(1)
+	}
+
+	if vinListFile != "" {
+		vinList, err = loadVINList(vinListFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to load VIN list '%s'.\n  -->  %s\n", vinListFile, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if sourcePortRange != "" {
+		parsed, err := parsePortRange(sourcePortRange)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid source port range '%s'.\n  -->  %s\n", sourcePortRange, err.Error())
+			os.Exit(1)
+		}
+		sourcePorts = parsed
+
+		// Each vehicle holds its port for the whole run unless --dial-per-packet is set. Vehicles
+		// which can't get a port back off and retry so we warn rather than refusing to start.
+		if !dialPerPacket && sourcePorts.size() < number {
+			fmt.Fprintf(
+				os.Stderr,
+				"Warning: the source port range has %d ports for %d vehicles. Vehicles without a port will retry.\n",
+				sourcePorts.size(),
+				number)
+		}
+	}
+
+	if recordFile != "" {
+		if replayFile != "" {
+			fmt.Fprintf(os.Stderr, "Error: --record can't be used with --replay.\n")
+			os.Exit(1)
+		}
+
+		opened, err := openRecorder(recordFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to open record file '%s'.\n  -->  %s\n", recordFile, err.Error())
+			os.Exit(1)
+		}
+		recording = opened
+	}
+
+	if pushgateway != "" {
+		if replayFile != "" {
+			fmt.Fprintf(os.Stderr, "Error: --pushgateway can't be used with --replay.\n")
+			os.Exit(1)
+		}
+
+		if pushInterval <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: the push interval must be greater than zero.\n")
+			os.Exit(1)
+		}
+
+		opened, err := newPusher(pushgateway, pushInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid Pushgateway URL '%s'.\n  -->  %s\n", pushgateway, err.Error())
+			os.Exit(1)
+		}
+		metricsPusher = opened
+	}
+
+	if showConfig {
+		printConfig()
+	}
+
+	if replayFile != "" {
+		serverAddr, err := net.ResolveUDPAddr("udp", host+":"+port)
+		if err != nil {
+			fmt.Fprintf(
+				os.Stderr,
+				"Error: unable to resolve server address '%s:%s'.\n  -->  %s\n",
+				host,
+				port,
+				err.Error())
+			os.Exit(1)
+		}
+
+		requireReachableServer(serverAddr, namespace)
+
+		err = runReplay(serverAddr, replayFile, speedMultiplier, rewriteTimestamps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to replay '%s'.\n  -->  %s\n", replayFile, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	rand.Seed(time.Now().UnixNano())
-	runSimulator(host, port, number)
+	runSimulator(host, port, number, namespace, convoySize, convoySpacing, spawnRate, despawnRate)
 }
 
-func runSimulator(host string, port string, numVehicles int) {
+// The first convoySize vehicles travel together in a convoy. The remaining vehicles move
+// independently. If spawnRate or despawnRate is non-zero, independent vehicles join and leave the
+// fleet over the course of the run.
+func runSimulator(host string, port string, numVehicles int, namespace string, convoySize int, convoySpacing float64, spawnRate, despawnRate float64) {
+	// Check the fleet will fit in the available resources before we start, rather than failing
+	// with "too many open files" errors part way through the run.
+	err := checkFleetSize(numVehicles)
+	if err != nil && !force {
+		fmt.Fprintf(os.Stderr, "Error: fleet too large. Use --force to start anyway.\n  -->  %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s.\n", err.Error())
+	}
+
 	serverAddr, err := net.ResolveUDPAddr("udp", host+":"+port)
 	if err != nil {
 		fmt.Fprintf(
@@ -57,18 +669,79 @@ func runSimulator(host string, port string, numVehicles int) {
 		os.Exit(1)
 	}
 
+	requireReachableServer(serverAddr, namespace)
+
 	fmt.Println("-------------------------")
 	fmt.Println("Running Vehicle Simulator")
 	fmt.Println("-------------------------")
 	fmt.Printf("Num Vehicles: %d\n", numVehicles)
 	fmt.Printf("Server Host:  %s\n", host)
 	fmt.Printf("Server Port:  %s\n", port)
+	if namespace != "" {
+		fmt.Printf("Fleet:        %s\n", namespace)
+	}
+	if convoySize > 0 {
+		fmt.Printf("Convoy:       %d vehicles, %.1f m apart\n", convoySize, convoySpacing)
+	}
+	if rampRate > 0 {
+		fmt.Printf("Ramp-up:      %.2f vehicles/s\n", rampRate)
+	}
+	if simGeofence != nil {
+		fmt.Printf(
+			"Geofence:     %.1f m around (%.6f, %.6f)\n",
+			simGeofence.radius,
+			simGeofence.latitude,
+			simGeofence.longitude)
+	}
+	if len(clusters) > 0 {
+		fmt.Printf("Clusters:     %d\n", len(clusters))
+	}
+	if spawnRate > 0 || despawnRate > 0 {
+		fmt.Printf("Churn:        +%.2f/s, -%.2f/s\n", spawnRate, despawnRate)
+	}
+	if metricsPusher != nil {
+		fmt.Printf("Pushgateway:  %s every %s\n", metricsPusher.gateway, metricsPusher.interval)
+	}
 	fmt.Printf("Exit:         Ctrl-C\n")
 	fmt.Println("-------------------------")
 
-	// Launch a goroutine for each simulated vehicle in the fleet.
+	var group *convoy
+	if convoySize > 0 {
+		latitude, longitude := startPosition()
+		group = newConvoy(latitude, longitude, initialDirection(), convoySpacing)
+	}
+
+	// Launch a goroutine for each simulated vehicle in the fleet. If --ramp-rate is set, we start
+	// the vehicles gradually so the load on the OS and the server increases smoothly. We schedule
+	// each start relative to the first so time spent launching doesn't slow the ramp.
+	vehicles := newFleet(serverAddr, namespace, numVehicles)
+	start := time.Now()
 	for i := 0; i < numVehicles; i++ {
-		go simulateVehicle(serverAddr, i)
+		if rampRate > 0 && i > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(i) / rampRate * float64(time.Second)))))
+			if i%int(math.Ceil(rampRate)) == 0 {
+				fmt.Printf("Ramp-up: %d/%d vehicles started.\n", i, numVehicles)
+			}
+		}
+
+		if i < convoySize {
+			go simulateVehicle(context.Background(), serverAddr, i, namespace, group, i)
+		} else {
+			ctx, cancel := context.WithCancel(context.Background())
+			vehicles.vehicles[i] = cancel
+			go simulateVehicle(ctx, serverAddr, i, namespace, nil, 0)
+		}
+	}
+	if rampRate > 0 {
+		fmt.Printf("Ramp-up: complete, %d vehicles started.\n", numVehicles)
+	}
+
+	if spawnRate > 0 || despawnRate > 0 {
+		go vehicles.churn(spawnRate, despawnRate)
+	}
+
+	if metricsPusher != nil {
+		go metricsPusher.run()
 	}
 
 	// Give the vehicles time to start up and print their VINs.
@@ -77,68 +750,321 @@ func runSimulator(host string, port string, numVehicles int) {
 	fmt.Println("Ctrl-C to end simulation.")
 	fmt.Println("-------------------------")
 
-	// Block until the user hits Ctrl-C.
+	// Block until the user hits Ctrl-C. We also shut down on SIGTERM so the recording is flushed
+	// when the simulator is stopped by a script.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	_ = <-c
 
 	fmt.Println("\n-------------------------")
 	fmt.Println("Shutting down.")
 	fmt.Println("-------------------------")
+
+	// A final push records the totals for the run.
+	if metricsPusher != nil {
+		metricsPusher.push()
+	}
+
+	if recording != nil {
+		err := recording.close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to close the record file.\n  -->  %s\n", err.Error())
+		}
+	}
 }
 
 // This function simulates a single vehicle, sending location update packets to the fleet state
-// server once per second. It's not a very realistic simulation but it generates the right *kind*
-// of data.
-func simulateVehicle(serverAddr *net.UDPAddr, serialNumber int) {
+// server once per second, or at the interval set by the server if --control is set. It's not a
+// very realistic simulation but it generates the right *kind* of data. If namespace is not empty,
+// each packet is tagged with a [fleet=<name>] field.
+//
+// If group is not nil, the vehicle is part of a convoy. The vehicle at position 0 leads the convoy
+// and publishes its state after each move; vehicles at other positions follow behind it.
+//
+// The vehicle leaves the fleet and the function returns when ctx is cancelled.
+func simulateVehicle(ctx context.Context, serverAddr *net.UDPAddr, serialNumber int, namespace string, group *convoy, position int) {
 	vin := makeVIN(serialNumber)
-	fmt.Println("VIN:", vin)
 
-	// The vehicle's initial position. Every vehicle starts off in the centre of Dublin at the front
-	// gate of Trinity College. Working with latitude/longitude coordinates to six decimal places
-	// gives us accuracy to within about 11cm.
-	// Ref: https://en.wikipedia.org/wiki/Decimal_degrees
-	latitude := 53.344496
-	longitude := -6.259427
+	atomic.AddInt64(&activeVehicles, 1)
+	defer atomic.AddInt64(&activeVehicles, -1)
+	home := clusterFor(serialNumber)
+	if group != nil {
+		fmt.Printf("VIN: %s (convoy position %d)\n", vin, position)
+	} else if home != nil {
+		fmt.Printf("VIN: %s (cluster %d at %.6f, %.6f)\n", vin, home.number, home.latitude, home.longitude)
+	} else {
+		fmt.Println("VIN:", vin)
+	}
+
+	// The vehicle moves according to the selected movement model.
+	mover, state := newMover(group, position, home)
+
+	// If --battery-capacity is set, the vehicle's battery drains as it moves.
+	vehicleBattery := newBattery()
+
+	// The number of consecutive failed sends. While sends are failing we back off exponentially
+	// so an unreachable server doesn't cause a tight error loop.
+	failures := 0
 
-	// The vehicle's initial speed in meters per second -- 100 km/h is approximately 28 m/s.
-	// We select a random speed in the range [0, 28.0).
-	speed := rand.Float64() * 28.0
+	// The sequence number for the vehicle's next update packet.
+	sequence := 0
 
-	// The vehicle's initial direction. This is an angle in radians randomly selected from the
-	// interval [0, 2 * pi). The angle is measured anticlockwise from the reference direction
-	// which is due east.
-	direction := rand.Float64() * 2 * math.Pi
+	// The body of the vehicle's last update packet. See [sendHeartbeats].
+	lastBody := ""
+
+	// The vehicle reuses a single connection for all its packets.
+	conn := &vehicleConn{serverAddr: serverAddr}
+	defer conn.close()
+
+	// The interval between the vehicle's update packets, and the simulated time the vehicle moves
+	// for before its next update. These only differ when the server changes the interval.
+	interval := time.Second
+	stepTime := time.Second
+
+	// If --control is set, the vehicle listens for commands from the server on its own port.
+	var rates chan time.Duration
+	controlPort := 0
+	if enableControl {
+		control, err := openControlSocket()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s is unable to open a control socket.\n  -->  %s\n", vin, err.Error())
+		} else {
+			defer control.Close()
+			controlPort = control.LocalAddr().(*net.UDPAddr).Port
+			rates = make(chan time.Duration, 1)
+			go readCommands(control, serverAddr, vin, rates)
+		}
+	}
 
 	for {
-		speed = updateSpeed(speed)
-		latitude, longitude = updateLocation(latitude, longitude, speed, direction, 1.0)
+		// Each step lasts one second. A vehicle with a flat battery sits idle.
+		if vehicleBattery != nil && vehicleBattery.depleted() {
+			state.speed = 0
+		} else {
+			previous := state
+			state = mover.step(state, stepTime.Seconds())
+			if vehicleBattery != nil {
+				x, y := flatOffset(previous.latitude, previous.longitude, state.latitude, state.longitude)
+				vehicleBattery.drain(math.Hypot(x, y), state.speed)
+			}
+		}
+		if group != nil && position == 0 {
+			group.publish(state.latitude, state.longitude, state.speed, state.direction)
+		}
+
+		// The body of the update is everything after the timestamp and VIN except the sequence
+		// number.
 		timestamp := time.Now().UTC().Format(time.RFC3339Nano)
-		message := fmt.Sprintf("%s %s %.6f %.6f", timestamp, vin, latitude, longitude)
+		body := fmt.Sprintf(
+			"%.*f %.*f",
+			coordinatePrecision,
+			state.latitude,
+			coordinatePrecision,
+			state.longitude)
+		// A GPS dropout replaces both coordinates with the no-fix sentinel. The vehicle keeps
+		// moving; it just can't report where it is.
+		dropout := dropoutRate > 0 && rand.Float64() < dropoutRate
+		if dropout {
+			body = noFix + " " + noFix
+		}
+		if namespace != "" {
+			body += " fleet=" + namespace
+		}
+		// The vehicle switches its engine off while it's stopped and back on when it starts
+		// moving again.
+		if includeIgnition {
+			if state.speed > 0 {
+				body += " ignition=on"
+			} else {
+				body += " ignition=off"
+			}
+		}
+		if vehicleBattery != nil {
+			body += fmt.Sprintf(" battery=%.1f", vehicleBattery.percent())
+		}
+		if controlPort != 0 {
+			body += fmt.Sprintf(" control=%d", controlPort)
+		}
+		if includeEvents {
+			if event := randomEvent(); event != "" {
+				body += " status=" + event
+			}
+		}
 
-		conn, err := net.DialUDP("udp", nil, serverAddr)
+		// If --heartbeats is set and nothing has changed since the vehicle's last update, it
+		// sends a lightweight heartbeat instead. A vehicle without a fix can't tell if it has
+		// moved so it always sends an update.
+		heartbeat := sendHeartbeats && !dropout && body == lastBody
+		var message string
+		if heartbeat {
+			message = fmt.Sprintf("HEARTBEAT %s %s", vin, timestamp)
+			if namespace != "" {
+				message += " fleet=" + namespace
+			}
+		} else {
+			message = timestamp + " " + vin + " " + body
+			if includeSequence {
+				message += fmt.Sprintf(" seq=%d", sequence)
+				sequence++
+			}
+			if malformRate > 0 && rand.Float64() < malformRate {
+				message = malformMessage(message)
+			}
+			// The server accepts text updates alongside GeoJSON so a feature which can't be
+			// encoded is sent as text rather than lost.
+			if sendGeoJSON {
+				feature, err := encodeGeoJSON(message, state.speed)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s is unable to encode a GeoJSON update.\n  -->  %s\n", vin, err.Error())
+				} else {
+					message = feature
+				}
+			}
+		}
+
+		err := conn.send(message)
 		if err != nil {
-			fmt.Fprintf(
-				os.Stderr,
-				"Error: unable to connect to server '%s'.\n  -->  %s\n",
-				serverAddr,
-				err.Error())
+			atomic.AddInt64(&sendErrors, 1)
+			failures++
+			delay := backoffDelay(failures)
+			fmt.Fprintf(os.Stderr, "Error: failed to send packet.\n  -->  %s\n", err.Error())
+			if failures == 1 {
+				fmt.Fprintf(os.Stderr, "Backoff: %s is backing off after a failed send.\n", vin)
+			}
+			if !sleep(ctx, delay) {
+				return
+			}
+			stepTime = interval
 			continue
 		}
 
-		_, err = conn.Write([]byte(message))
+		atomic.AddInt64(&packetsSent, 1)
+
+		if failures > 0 {
+			fmt.Fprintf(os.Stderr, "Backoff: %s cleared after %d failed sends.\n", vin, failures)
+			failures = 0
+		}
+
+		// We only record packets which were actually sent.
+		if recording != nil {
+			recording.record(message)
+		}
+
+		if !heartbeat {
+			lastBody = body
+		}
+
+		// A new interval from the server takes effect immediately. The vehicle sends its next
+		// update now and then continues at the new rate.
+		sent := time.Now()
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			stepTime = interval
+		case interval = <-rates:
+			timer.Stop()
+			stepTime = time.Since(sent)
+			fmt.Printf("Control: %s now reporting every %s.\n", vin, interval)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// This function sleeps for the specified duration. It returns false if ctx is cancelled first.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// This function sends a single packet to the server.
+func sendPacket(serverAddr *net.UDPAddr, message string) error {
+	conn, err := dialServer(serverAddr)
+	if err != nil {
+		return fmt.Errorf("unable to connect to server '%s': %w", serverAddr, err)
+	}
+	defer closeServerConn(conn)
+
+	_, err = conn.Write([]byte(message))
+	return err
+}
+
+// This type holds a vehicle's connection to the server. The connection is dialed on the first send
+// and reused for every subsequent packet. If a write fails we close the connection and redial on
+// the next send.
+type vehicleConn struct {
+	serverAddr *net.UDPAddr
+	conn       *net.UDPConn
+}
+
+// This function sends a single packet to the server. If --dial-per-packet is set, it dials a new
+// connection for the packet instead.
+func (vc *vehicleConn) send(message string) error {
+	if dialPerPacket {
+		return sendPacket(vc.serverAddr, message)
+	}
+
+	if vc.conn == nil {
+		conn, err := dialServer(vc.serverAddr)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to send packet.\n  -->  %s\n", err.Error())
+			return fmt.Errorf("unable to connect to server '%s': %w", vc.serverAddr, err)
 		}
+		vc.conn = conn
+	}
 
-		conn.Close()
-		time.Sleep(time.Second)
+	_, err := vc.conn.Write([]byte(message))
+	if err != nil {
+		vc.close()
 	}
+	return err
 }
 
-// This function returns a valid-ish VIN. The template is a random VIN I grabbed from the internet.
+// This function closes the connection if it's open.
+func (vc *vehicleConn) close() {
+	if vc.conn != nil {
+		closeServerConn(vc.conn)
+		vc.conn = nil
+	}
+}
+
+// This function returns the delay before the next send attempt after the specified number of
+// consecutive failures. The delay starts at 2 seconds and doubles with each failure up to a
+// maximum of [maxBackoff].
+func backoffDelay(failures int) time.Duration {
+	delay := time.Second
+	for i := 0; i < failures; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// This function returns the initial position for each vehicle. This is the center of the geofence
+// if one is set.
+func startPosition() (float64, float64) {
+	if simGeofence != nil {
+		return simGeofence.latitude, simGeofence.longitude
+	}
+	return startLatitude, startLongitude
+}
+
+// This function returns the VIN for the vehicle with the specified serial number, from the
+// --vin-list file if the list is long enough, otherwise from the --vin-template.
 func makeVIN(number int) string {
-	return fmt.Sprintf("1HGBH41JXMN%06d", number)
+	if number < len(vinList) {
+		return vinList[number]
+	}
+	return fmt.Sprintf(vinTemplate, number)
 }
 
 // This function randomly varies the vehicle's speed, assuming a maximum acceleration of 5 m/s/s.
@@ -157,6 +1083,24 @@ func updateSpeed(speed float64) float64 {
 	return speed
 }
 
+// This function occasionally varies the rate at which the vehicle is turning. Most of the time the
+// vehicle holds its current turn rate so the heading changes smoothly; now and again it starts a
+// new turn or straightens up. It always returns a value in the range [-maxTurnRate, maxTurnRate].
+func updateTurnRate(turnRate float64) float64 {
+	if maxTurnRate == 0 {
+		return 0
+	}
+
+	switch r := rand.Float64(); {
+	case r < 0.1:
+		return (rand.Float64()*2 - 1) * maxTurnRate
+	case r < 0.3:
+		return 0
+	default:
+		return turnRate
+	}
+}
+
 // This function calculates the vehicle's new latitude and longitude coordinates. This is a fairly
 // rough approximation that should be fine for generating some sample data, but for real accuracy
 // we'd need to use proper spherical geometry.
@@ -186,7 +1130,33 @@ func updateLocation(latitude, longitude, speed, direction, duration float64) (fl
 	// latitude: 1 degree longitude = 111_319.5 * cos(latitude) meters.
 	// Ref: https://en.wikipedia.org/wiki/Decimal_degrees
 	degreesOfLongitudePerMeter := 1 / (111319.5 * math.Cos(latitude*math.Pi/180.0))
-	newLongitude := longitude + deltaX*degreesOfLongitudePerMeter
+	newLongitude := normalizeLongitude(longitude + deltaX*degreesOfLongitudePerMeter)
 
 	return newLatitude, newLongitude
 }
+
+// This function wraps a longitude in degrees into the range [-180, 180) so vehicles crossing the
+// antimeridian reappear on the other side rather than drifting off to e.g. 180.5.
+func normalizeLongitude(longitude float64) float64 {
+	longitude = math.Mod(longitude+180, 360)
+	if longitude < 0 {
+		longitude += 360
+	}
+	return longitude - 180
+}
+
+// This function prints the effective value of every command line option, including defaults and
+// any values resolved during validation. It's useful for debugging misconfiguration.
+func printConfig() {
+	fmt.Println("-------------------------")
+	fmt.Println("Configuration")
+	fmt.Println("-------------------------")
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == "" {
+			value = `""`
+		}
+		fmt.Printf("%-28s%s\n", "--"+f.Name, value)
+	})
+	fmt.Println("-------------------------")
+}
@@ -0,0 +1,72 @@
+package main
+
+import "math"
+import "testing"
+
+func TestNormalizeLongitude(t *testing.T) {
+	tests := []struct {
+		longitude float64
+		expected  float64
+	}{
+		{0, 0},
+		{179.5, 179.5},
+		{-179.5, -179.5},
+		{180, -180},
+		{-180, -180},
+		{190, -170},
+		{-190, 170},
+		{540, -180},
+		{-370, -10},
+	}
+
+	for _, test := range tests {
+		if result := normalizeLongitude(test.longitude); math.Abs(result-test.expected) > 1e-9 {
+			t.Errorf("normalizeLongitude(%v): expected %v, found %v", test.longitude, test.expected, result)
+		}
+	}
+}
+
+func TestUpdateLocationCrossesAntimeridian(t *testing.T) {
+	// At the equator 20m is about 0.00018 degrees of longitude.
+	const step = 20 / 111319.5
+
+	tests := []struct {
+		name      string
+		longitude float64
+		direction float64
+		expected  float64
+	}{
+		{"eastbound", 179.9999, 0, -360 + 179.9999 + step},
+		{"westbound", -179.9999, math.Pi, 360 - 179.9999 - step},
+	}
+
+	for _, test := range tests {
+		latitude, longitude := updateLocation(0, test.longitude, 20, test.direction, 1)
+		if math.Abs(longitude-test.expected) > 1e-9 {
+			t.Errorf("%s: expected longitude %v, found %v", test.name, test.expected, longitude)
+		}
+		if longitude < -180 || longitude >= 180 {
+			t.Errorf("%s: longitude %v is outside [-180, 180)", test.name, longitude)
+		}
+		if math.Abs(latitude) > 1e-9 {
+			t.Errorf("%s: expected the latitude to stay at 0, found %v", test.name, latitude)
+		}
+	}
+}
+
+func TestUpdateLocationRoundTripAcrossAntimeridian(t *testing.T) {
+	// A vehicle driving east across the antimeridian and back again ends up where it started.
+	latitude, longitude := 10.0, 179.99
+	for i := 0; i < 100; i++ {
+		latitude, longitude = updateLocation(latitude, longitude, 30, 0, 1)
+	}
+	if longitude > 0 {
+		t.Fatalf("expected the vehicle to have crossed into the western hemisphere, found %v", longitude)
+	}
+	for i := 0; i < 100; i++ {
+		latitude, longitude = updateLocation(latitude, longitude, 30, math.Pi, 1)
+	}
+	if math.Abs(longitude-179.99) > 1e-6 || math.Abs(latitude-10) > 1e-6 {
+		t.Errorf("expected to return to (10, 179.99), found (%v, %v)", latitude, longitude)
+	}
+}
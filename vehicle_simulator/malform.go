@@ -0,0 +1,35 @@
+package main
+
+import "math/rand"
+import "strings"
+
+// This function returns a deliberately malformed copy of a vehicle update packet for fuzz testing
+// the server. The packet is assumed to have the format: [<timestamp> <vin> <latitude> <longitude>]
+// optionally followed by [<key>=<value>] fields. We pick one of several kinds of damage at random.
+func malformMessage(message string) string {
+	elements := strings.Split(message, " ")
+
+	switch rand.Intn(6) {
+	case 0:
+		// Wrong field count -- drop the longitude.
+		elements = append(elements[:3], elements[4:]...)
+	case 1:
+		// Wrong field count -- add an extra positional field.
+		elements = append(elements[:4], append([]string{"extra"}, elements[4:]...)...)
+	case 2:
+		// Invalid timestamp.
+		elements[0] = "yesterday"
+	case 3:
+		// Unparsable latitude.
+		elements[2] = "53.34.44"
+	case 4:
+		// Parsable but invalid longitude.
+		elements[3] = "NaN"
+	case 5:
+		// Truncated packet.
+		joined := strings.Join(elements, " ")
+		return joined[:rand.Intn(len(joined))]
+	}
+
+	return strings.Join(elements, " ")
+}
@@ -0,0 +1,255 @@
+package main
+
+import "fmt"
+import "math"
+import "math/rand"
+import "strings"
+
+// The movement models a vehicle can use, selected with the --model option.
+const (
+	modelRandomWalk = "random-walk"
+	modelWaypoints  = "waypoints"
+	modelRoads      = "roads"
+)
+
+// What a vehicle following waypoints does at the end of the route, selected with the --route-mode
+// option. In loop mode the vehicle drives from the last waypoint back to the first and starts the
+// route again. In reverse mode it drives the route backwards to the first waypoint, then forwards
+// again, i.e. out-and-back. In once mode it stops at the last waypoint.
+const (
+	routeLoop    = "loop"
+	routeReverse = "reverse"
+	routeOnce    = "once"
+)
+
+// This type describes a simulated vehicle's position and motion. The speed is measured in meters
+// per second. The direction is an angle in radians measured anticlockwise from due east.
+type vehicleState struct {
+	latitude  float64
+	longitude float64
+	speed     float64
+	direction float64
+}
+
+// A mover implements a movement model. The step method returns the vehicle's new state after it
+// has moved for dt seconds. Each vehicle has its own mover so implementations can keep per-vehicle
+// state, e.g. the vehicle's current turn rate.
+type mover interface {
+	step(state vehicleState, dt float64) vehicleState
+}
+
+// This function returns a random initial direction in radians anticlockwise from due east within
+// --heading-spread degrees of the --initial-heading, a compass bearing measured clockwise from due
+// north. The result is in the interval [0, 2 * pi).
+func initialDirection() float64 {
+	bearing := initialHeading + (rand.Float64()*2-1)*headingSpread
+	direction := (90 - bearing) * math.Pi / 180
+	return math.Mod(direction+4*math.Pi, 2*math.Pi)
+}
+
+// This function returns the mover for a vehicle along with the vehicle's initial state. If group
+// is not nil and position is greater than 0, the vehicle follows the leader of the convoy;
+// otherwise the vehicle moves according to the --model option. If home is not nil, the vehicle
+// starts at the center of its cluster and stays inside the cluster's fence, if it has one.
+func newMover(group *convoy, position int, home *cluster) (mover, vehicleState) {
+	var state vehicleState
+	state.latitude, state.longitude = startPosition()
+	if home != nil {
+		state.latitude, state.longitude = home.latitude, home.longitude
+	}
+
+	// The vehicle's initial speed in meters per second -- 100 km/h is approximately 28 m/s.
+	// We select a random speed in the range [0, 28.0).
+	state.speed = rand.Float64() * 28.0
+
+	// The vehicle's initial direction, randomly selected within --heading-spread of the
+	// --initial-heading. By default any direction is equally likely.
+	state.direction = initialDirection()
+
+	// Vehicles in a convoy start out heading in the convoy's direction.
+	if group != nil {
+		_, _, _, state.direction = group.follow(position)
+	}
+
+	if group != nil && position > 0 {
+		return &convoyFollower{group: group, position: position}, state
+	}
+
+	switch movementModel {
+	case modelRoads:
+		// The vehicle starts at a random node and follows the roads.
+		route := roads.newRoute()
+		state.latitude, state.longitude, state.direction = route.position()
+		return &roadFollower{route: route}, state
+	case modelWaypoints:
+		// The vehicle starts at a random waypoint and heads for the next one. In once mode the
+		// last waypoint is the end of the route so we don't start there.
+		start := rand.Intn(len(waypoints))
+		if routeMode == routeOnce {
+			start = rand.Intn(len(waypoints) - 1)
+		}
+		state.latitude, state.longitude = waypoints[start].latitude, waypoints[start].longitude
+		follower := &waypointFollower{next: start}
+		follower.advance()
+		return follower, state
+	default:
+		fence := simGeofence
+		if home != nil {
+			fence = home.fence
+		}
+		return &randomWalk{fence: fence}, state
+	}
+}
+
+// The random walk is the simulator's original movement model. The vehicle randomly varies its
+// speed and occasionally turns. If fence is not nil, the vehicle turns back when it reaches the
+// boundary.
+type randomWalk struct {
+	// The rate at which the vehicle is turning in radians per second. Positive values turn
+	// anticlockwise.
+	turnRate float64
+
+	fence *geofence
+}
+
+func (w *randomWalk) step(state vehicleState, dt float64) vehicleState {
+	state.speed = updateSpeed(state.speed)
+	w.turnRate = updateTurnRate(w.turnRate)
+	state.direction = math.Mod(state.direction+w.turnRate*dt, 2*math.Pi)
+
+	latitude, longitude := updateLocation(state.latitude, state.longitude, state.speed, state.direction, dt)
+	if w.fence != nil && !w.fence.contains(latitude, longitude) {
+		state.direction = w.fence.steer(state.latitude, state.longitude)
+		w.turnRate = 0
+		latitude, longitude = updateLocation(state.latitude, state.longitude, state.speed, state.direction, dt)
+	}
+	state.latitude, state.longitude = latitude, longitude
+
+	return state
+}
+
+// The road follower drives along a route through the --roads network.
+type roadFollower struct {
+	route *roadRoute
+}
+
+func (f *roadFollower) step(state vehicleState, dt float64) vehicleState {
+	state.speed = updateSpeed(state.speed)
+	f.route.advance(state.speed * dt)
+	state.latitude, state.longitude, state.direction = f.route.position()
+	return state
+}
+
+// The convoy follower trails the convoy's lead vehicle at a fixed distance.
+type convoyFollower struct {
+	group    *convoy
+	position int
+}
+
+func (f *convoyFollower) step(state vehicleState, dt float64) vehicleState {
+	state.latitude, state.longitude, state.speed, state.direction = f.group.follow(f.position)
+	return state
+}
+
+// A waypoint is a point on the --waypoints circuit.
+type waypoint struct {
+	latitude  float64
+	longitude float64
+}
+
+// This function parses a waypoints string with the format: [<lat>,<long>;<lat>,<long>;...]. We
+// need at least two waypoints.
+func parseWaypoints(arg string) ([]waypoint, error) {
+	var result []waypoint
+	for _, element := range strings.Split(arg, ";") {
+		latitude, longitude, err := parseGeofenceCenter(strings.TrimSpace(element))
+		if err != nil {
+			return nil, fmt.Errorf("invalid waypoint '%s': %w", element, err)
+		}
+		result = append(result, waypoint{latitude, longitude})
+	}
+
+	if len(result) < 2 {
+		return nil, fmt.Errorf("at least two waypoints are required")
+	}
+
+	return result, nil
+}
+
+// The waypoint follower drives in a straight line to each waypoint in turn. What it does after the
+// last waypoint depends on the --route-mode.
+type waypointFollower struct {
+	// The index of the waypoint the vehicle is heading for.
+	next int
+
+	// In reverse mode, true while the vehicle is driving the route backwards.
+	backwards bool
+
+	// In once mode, true once the vehicle has reached the last waypoint.
+	finished bool
+}
+
+func (f *waypointFollower) step(state vehicleState, dt float64) vehicleState {
+	if f.finished {
+		state.speed = 0
+		return state
+	}
+
+	state.speed = updateSpeed(state.speed)
+	remaining := state.speed * dt
+
+	// If the vehicle reaches its waypoint during the step it turns and heads for the next one.
+	// We limit the number of waypoints we pass in a single step in case they're very close together.
+	for i := 0; i < len(waypoints); i++ {
+		target := waypoints[f.next]
+		x, y := flatOffset(state.latitude, state.longitude, target.latitude, target.longitude)
+		distance := math.Hypot(x, y)
+		if distance > 0 {
+			state.direction = math.Mod(math.Atan2(y, x)+2*math.Pi, 2*math.Pi)
+		}
+
+		if distance > remaining {
+			state.latitude, state.longitude = updateLocation(state.latitude, state.longitude, remaining, state.direction, 1.0)
+			break
+		}
+
+		state.latitude, state.longitude = target.latitude, target.longitude
+		remaining -= distance
+
+		f.advance()
+		if f.finished {
+			state.speed = 0
+			break
+		}
+	}
+
+	return state
+}
+
+// This function moves on to the next waypoint when the vehicle reaches the one it's heading for,
+// following the --route-mode at the end of the route.
+func (f *waypointFollower) advance() {
+	last := len(waypoints) - 1
+
+	switch routeMode {
+	case routeReverse:
+		if f.backwards && f.next == 0 {
+			f.backwards = false
+		} else if !f.backwards && f.next == last {
+			f.backwards = true
+		}
+		if f.backwards {
+			f.next--
+		} else {
+			f.next++
+		}
+	case routeOnce:
+		if f.next == last {
+			f.finished = true
+		} else {
+			f.next++
+		}
+	default:
+		f.next = (f.next + 1) % len(waypoints)
+	}
+}
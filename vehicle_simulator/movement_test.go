@@ -0,0 +1,83 @@
+package main
+
+import "reflect"
+import "testing"
+
+// This function sets the route to the specified number of waypoints and the route mode for the
+// duration of the test.
+func useTestRoute(t *testing.T, count int, mode string) {
+	t.Helper()
+
+	previousWaypoints, previousMode := waypoints, routeMode
+	t.Cleanup(func() {
+		waypoints, routeMode = previousWaypoints, previousMode
+	})
+
+	waypoints = make([]waypoint, count)
+	for i := range waypoints {
+		waypoints[i] = waypoint{latitude: 53, longitude: -6 + 0.01*float64(i)}
+	}
+	routeMode = mode
+}
+
+func TestWaypointFollowerAdvance(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		waypoints int
+		start     int
+		expected  []int
+	}{
+		{"loop", routeLoop, 3, 0, []int{1, 2, 0, 1, 2, 0}},
+		{"loop with 2 waypoints", routeLoop, 2, 0, []int{1, 0, 1, 0}},
+		{"loop from last", routeLoop, 3, 2, []int{0, 1, 2}},
+		{"reverse", routeReverse, 4, 0, []int{1, 2, 3, 2, 1, 0, 1, 2}},
+		{"reverse with 2 waypoints", routeReverse, 2, 0, []int{1, 0, 1, 0}},
+		{"reverse from last", routeReverse, 4, 3, []int{2, 1, 0, 1, 2, 3, 2}},
+		{"reverse from last with 2 waypoints", routeReverse, 2, 1, []int{0, 1, 0, 1}},
+		{"once", routeOnce, 3, 0, []int{1, 2}},
+		{"once with 2 waypoints", routeOnce, 2, 0, []int{1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRoute(t, test.waypoints, test.mode)
+
+			// The follower starts at a waypoint and advances to the next one, as in newMovement.
+			follower := &waypointFollower{next: test.start}
+			var visited []int
+			for i := 0; i < len(test.expected); i++ {
+				follower.advance()
+				visited = append(visited, follower.next)
+				if follower.next < 0 || follower.next >= test.waypoints {
+					t.Fatalf("waypoint index %d out of range after %v", follower.next, visited)
+				}
+			}
+
+			if !reflect.DeepEqual(visited, test.expected) {
+				t.Errorf("expected %v, found %v", test.expected, visited)
+			}
+			if test.mode == routeOnce && follower.finished {
+				t.Errorf("expected the follower not to finish before reaching the last waypoint")
+			}
+		})
+	}
+}
+
+func TestWaypointFollowerOnceFinishes(t *testing.T) {
+	useTestRoute(t, 2, routeOnce)
+
+	follower := &waypointFollower{next: 0}
+	follower.advance()
+	follower.advance()
+	if !follower.finished || follower.next != 1 {
+		t.Fatalf("expected the follower to finish at the last waypoint, found next=%d finished=%v", follower.next, follower.finished)
+	}
+
+	// A finished vehicle stays stopped at the last waypoint.
+	state := vehicleState{latitude: 53, longitude: -5.99, speed: 10}
+	state = follower.step(state, 1)
+	if state.speed != 0 || state.latitude != 53 || state.longitude != -5.99 {
+		t.Errorf("expected the vehicle to stay stopped at the last waypoint, found %+v", state)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+import "sync"
+
+// If --source-port-range is set, vehicles send their packets from local ports in this range, e.g.
+// so a firewall can allow them through. If nil, the OS picks each vehicle's local port.
+var sourcePorts *portRange
+
+// This type hands out local ports from a fixed range. Each port is used by at most one of our
+// connections at a time. Ports already in use by other processes are skipped.
+type portRange struct {
+	mutex sync.Mutex
+	low   int
+	high  int
+	inUse map[int]bool
+
+	// The offset into the range where we start looking for the next free port. We hand out ports
+	// in rotation rather than always reusing the lowest so a port is idle for as long as possible
+	// before it's reused.
+	next int
+}
+
+// This function parses a port range in the format 'low-high', e.g. '40000-40999'.
+func parsePortRange(arg string) (*portRange, error) {
+	bounds := strings.Split(arg, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("expected the format 'low-high'")
+	}
+
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", bounds[0])
+	}
+
+	high, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", bounds[1])
+	}
+
+	if low < 1 || high > 65535 || low > high {
+		return nil, fmt.Errorf("ports must be in the range [1, 65535] with low <= high")
+	}
+
+	return &portRange{low: low, high: high, inUse: make(map[int]bool)}, nil
+}
+
+// This function returns the number of ports in the range.
+func (r *portRange) size() int {
+	return r.high - r.low + 1
+}
+
+// This function dials the server from the next free port in the range. It returns an error if
+// every port in the range is in use, either by our own connections or by other processes.
+func (r *portRange) dial(serverAddr *net.UDPAddr) (*net.UDPConn, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var lastErr error
+	for i := 0; i < r.size(); i++ {
+		port := r.low + (r.next+i)%r.size()
+		if r.inUse[port] {
+			continue
+		}
+
+		conn, err := net.DialUDP("udp", &net.UDPAddr{Port: port}, serverAddr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		r.inUse[port] = true
+		r.next = (port - r.low + 1) % r.size()
+		return conn, nil
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("no free source port in range %d-%d: %w", r.low, r.high, lastErr)
+	}
+	return nil, fmt.Errorf("no free source port in range %d-%d", r.low, r.high)
+}
+
+// This function closes a connection returned by [dial] and returns its port to the range.
+func (r *portRange) close(conn *net.UDPConn) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.inUse, port)
+}
+
+// This function dials a UDP connection to the server, from a port in --source-port-range if set.
+func dialServer(serverAddr *net.UDPAddr) (*net.UDPConn, error) {
+	if sourcePorts != nil {
+		return sourcePorts.dial(serverAddr)
+	}
+	return net.DialUDP("udp", nil, serverAddr)
+}
+
+// This function closes a connection returned by [dialServer].
+func closeServerConn(conn *net.UDPConn) {
+	if sourcePorts != nil {
+		sourcePorts.close(conn)
+		return
+	}
+	conn.Close()
+}
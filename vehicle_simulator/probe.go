@@ -0,0 +1,69 @@
+package main
+
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "time"
+
+// If set to true, we check the server is reachable before starting the vehicles and exit if it
+// isn't, rather than have every vehicle report send errors on every tick.
+var requireServer bool
+
+// How many times we send the --require-server request before giving up. UDP packets can be lost
+// so a single attempt isn't enough.
+const serverCheckAttempts = 3
+
+// How long we wait for a reply to each --require-server request.
+const serverCheckTimeout = time.Second
+
+// This function checks the fleet state server is reachable by sending it a STATS request and
+// waiting for a reply. Sending a UDP packet succeeds whether or not anything is listening, so only
+// a reply proves the server is there. Any reply counts, including an ERROR reply to a server
+// running with auth tokens. If the server's host is up but nothing is listening on the port, the
+// host's ICMP reply surfaces as a read error and we fail immediately.
+func checkServer(serverAddr *net.UDPAddr, namespace string) error {
+	conn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := "STATS"
+	if namespace != "" {
+		request += " fleet=" + namespace
+	}
+
+	buffer := make([]byte, 65507)
+	for attempt := 1; attempt <= serverCheckAttempts; attempt++ {
+		_, err = conn.Write([]byte(request))
+		if err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(serverCheckTimeout))
+		_, err = conn.Read(buffer)
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("no reply after %d attempts", serverCheckAttempts)
+}
+
+// This function runs the --require-server check, if the flag is set, and exits if the server
+// can't be reached.
+func requireReachableServer(serverAddr *net.UDPAddr, namespace string) {
+	if !requireServer {
+		return
+	}
+
+	err := checkServer(serverAddr, namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to reach the fleet state server at '%s'.\n  -->  %s\n", serverAddr, err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import "bytes"
+import "fmt"
+import "net/http"
+import "net/url"
+import "os"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// The simulator's own metrics, aggregated across the fleet. Every vehicle goroutine updates these
+// counters so they're only accessed atomically.
+var packetsSent int64
+var sendErrors int64
+var activeVehicles int64
+
+// If not nil, we push the simulator's metrics to a Prometheus Pushgateway. Set by --pushgateway.
+var metricsPusher *pusher
+
+// The Prometheus job name for the simulator's metrics. Each simulator process pushes to its own
+// group, keyed by an instance label, so several simulators don't overwrite each other's metrics.
+const pushJob = "fleetsim_simulator"
+
+// A push which takes longer than this is abandoned.
+const pushTimeout = 5 * time.Second
+
+// This type pushes the simulator's metrics to a Prometheus Pushgateway. The periodic pushes and
+// the final push on shutdown run in different goroutines so pushes are serialized by the mutex.
+// Ref: https://github.com/prometheus/pushgateway
+type pusher struct {
+	mutex    sync.Mutex
+	gateway  string
+	url      string
+	interval time.Duration
+	client   *http.Client
+	failing  bool
+}
+
+// This function returns a pusher for the Pushgateway at the base URL, e.g. http://localhost:9091,
+// which pushes at the specified interval.
+func newPusher(base string, interval time.Duration) (*pusher, error) {
+	parsed, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("expected an http or https URL, found '%s'", base)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	instance := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+
+	return &pusher{
+		gateway:  base,
+		url:      strings.TrimRight(base, "/") + "/metrics/job/" + pushJob + "/instance/" + url.PathEscape(instance),
+		interval: interval,
+		client:   &http.Client{Timeout: pushTimeout},
+	}, nil
+}
+
+// This function returns the simulator's metrics in the Prometheus text exposition format.
+func formatMetrics() string {
+	var builder strings.Builder
+
+	builder.WriteString("# HELP fleetsim_simulator_packets_sent_total Packets sent to the server.\n")
+	builder.WriteString("# TYPE fleetsim_simulator_packets_sent_total counter\n")
+	fmt.Fprintf(&builder, "fleetsim_simulator_packets_sent_total %d\n", atomic.LoadInt64(&packetsSent))
+
+	builder.WriteString("# HELP fleetsim_simulator_send_errors_total Packets which failed to send.\n")
+	builder.WriteString("# TYPE fleetsim_simulator_send_errors_total counter\n")
+	fmt.Fprintf(&builder, "fleetsim_simulator_send_errors_total %d\n", atomic.LoadInt64(&sendErrors))
+
+	builder.WriteString("# HELP fleetsim_simulator_active_vehicles Vehicles currently running.\n")
+	builder.WriteString("# TYPE fleetsim_simulator_active_vehicles gauge\n")
+	fmt.Fprintf(&builder, "fleetsim_simulator_active_vehicles %d\n", atomic.LoadInt64(&activeVehicles))
+
+	return builder.String()
+}
+
+// This function pushes the current metrics, replacing the group's previous values. A failure is
+// reported but otherwise ignored; we only report the first failure in a run of failures so an
+// unreachable gateway doesn't flood the terminal.
+func (p *pusher) push() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.send()
+	if err != nil {
+		if !p.failing {
+			fmt.Fprintf(os.Stderr, "Error: failed to push metrics.\n  -->  %s\n", err.Error())
+		}
+		p.failing = true
+		return
+	}
+
+	if p.failing {
+		fmt.Printf("Resumed pushing metrics to '%s'.\n", p.gateway)
+		p.failing = false
+	}
+}
+
+// This function sends a single push request.
+func (p *pusher) send() error {
+	request, err := http.NewRequest(http.MethodPut, p.url, bytes.NewBufferString(formatMetrics()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("the gateway replied '%s'", response.Status)
+	}
+	return nil
+}
+
+// This function pushes the metrics at the pusher's interval for the rest of the run. It should be
+// run in its own goroutine so a slow gateway can't hold up the vehicles.
+func (p *pusher) run() {
+	ticker := time.NewTicker(p.interval)
+	for range ticker.C {
+		p.push()
+	}
+}
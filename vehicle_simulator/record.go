@@ -0,0 +1,67 @@
+package main
+
+import "bufio"
+import "fmt"
+import "os"
+import "sync"
+
+// A recorder appends each packet the vehicles send to a file in the --replay format, one packet per
+// line, so a simulation can be replayed deterministically later. Vehicles send from their own
+// goroutines so writes are serialized by the mutex.
+type recorder struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	err    error
+}
+
+// If not nil, we record every packet the vehicles send.
+var recording *recorder
+
+// This function opens a recorder appending to the file at path. The file is created if it doesn't
+// exist.
+func openRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// This function appends a packet to the recording. We only report the first write error so a full
+// disk doesn't flood the terminal.
+func (r *recorder) record(message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	_, err := r.writer.WriteString(message + "\n")
+	if err != nil {
+		r.err = err
+		fmt.Fprintf(os.Stderr, "Error: failed to record packet. Recording stopped.\n  -->  %s\n", err.Error())
+	}
+}
+
+// This function flushes any buffered packets to the file and closes it. Packets recorded after the
+// recorder is closed are discarded.
+func (r *recorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// A write error has already been reported.
+	var err error
+	if r.err == nil {
+		err = r.writer.Flush()
+	}
+
+	closeErr := r.file.Close()
+	r.err = os.ErrClosed
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
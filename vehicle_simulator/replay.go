@@ -0,0 +1,94 @@
+package main
+
+import "bufio"
+import "fmt"
+import "net"
+import "os"
+import "strings"
+import "time"
+
+// This function replays a recorded session from a file, sending each packet to the server. The
+// file contains one vehicle update packet per line in the usual wire format, i.e. each line starts
+// with an RFC3339 timestamp, or one heartbeat packet. Blank lines and lines beginning with '#' are
+// ignored.
+//
+// Packets are spaced out according to the differences between their timestamps divided by the
+// multiplier, so a multiplier of 60 replays an hour-long session in a minute. A multiplier of 0
+// sends the packets as fast as possible. If rewriteTimestamps is true, each packet's timestamp is
+// replaced with the current time as it's sent; otherwise packets are sent with their original
+// timestamps.
+func runReplay(serverAddr *net.UDPAddr, path string, multiplier float64, rewriteTimestamps bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var previous time.Time
+	count := 0
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Heartbeat packets have the format [HEARTBEAT <vin> <timestamp> ...] so the timestamp
+		// follows a prefix rather than starting the line.
+		prefix, rest := "", line
+		if strings.HasPrefix(line, "HEARTBEAT ") {
+			elements := strings.SplitN(line, " ", 3)
+			if len(elements) == 3 {
+				prefix, rest = elements[0]+" "+elements[1]+" ", elements[2]
+			}
+		}
+
+		index := strings.Index(rest, " ")
+		if index == -1 && prefix != "" {
+			index = len(rest)
+		}
+		if index == -1 {
+			fmt.Fprintf(os.Stderr, "Error: invalid packet on line %d.\n", lineNumber)
+			continue
+		}
+
+		timestamp, err := time.Parse(time.RFC3339Nano, rest[:index])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid timestamp on line %d.\n  -->  %s\n", lineNumber, err.Error())
+			continue
+		}
+
+		// Wait for the scaled gap since the previous packet. We don't wait for packets that are
+		// out of order in the recording.
+		if !previous.IsZero() && multiplier > 0 {
+			gap := timestamp.Sub(previous)
+			if gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / multiplier))
+			}
+		}
+		previous = timestamp
+
+		message := line
+		if rewriteTimestamps {
+			message = prefix + time.Now().UTC().Format(time.RFC3339Nano) + rest[index:]
+		}
+
+		err = sendPacket(serverAddr, message)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to send packet.\n  -->  %s\n", err.Error())
+			continue
+		}
+		count++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Replayed %d packets.\n", count)
+	return nil
+}
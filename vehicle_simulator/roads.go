@@ -0,0 +1,240 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "math"
+import "math/rand"
+import "os"
+
+// This type is a road network loaded from a GeoJSON file. Each vertex of each LineString is a
+// node in the graph and consecutive vertices are joined by two-way edges. Lines which share a
+// vertex are connected at that node, i.e. shared vertices are the network's intersections.
+type roadNetwork struct {
+	nodes []roadNode
+}
+
+// This type is a single node in a road network.
+type roadNode struct {
+	latitude   float64
+	longitude  float64
+	neighbours []int
+}
+
+// This type is the subset of GeoJSON we need to extract LineStrings. We decode recursively through
+// FeatureCollections, Features, and GeometryCollections and ignore any other geometry types.
+// Ref: https://datatracker.ietf.org/doc/html/rfc7946
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// This function loads a road network from a GeoJSON file containing LineString or MultiLineString
+// geometries.
+func loadRoadNetwork(path string) (*roadNetwork, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root geoJSON
+	err = json.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	network := &roadNetwork{}
+	index := make(map[[2]float64]int)
+
+	err = network.addGeoJSON(&root, index)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range network.nodes {
+		if len(node.neighbours) > 0 {
+			return network, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no roads found")
+}
+
+// This function adds the LineStrings in a GeoJSON object to the network. The index maps
+// [longitude, latitude] positions to node indices so lines sharing a vertex share a node.
+func (n *roadNetwork) addGeoJSON(object *geoJSON, index map[[2]float64]int) error {
+	switch object.Type {
+	case "FeatureCollection":
+		for i := range object.Features {
+			err := n.addGeoJSON(&object.Features[i], index)
+			if err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if object.Geometry != nil {
+			return n.addGeoJSON(object.Geometry, index)
+		}
+	case "GeometryCollection":
+		for i := range object.Geometries {
+			err := n.addGeoJSON(&object.Geometries[i], index)
+			if err != nil {
+				return err
+			}
+		}
+	case "LineString":
+		var line [][]float64
+		err := json.Unmarshal(object.Coordinates, &line)
+		if err != nil {
+			return fmt.Errorf("invalid LineString coordinates: %w", err)
+		}
+		return n.addLine(line, index)
+	case "MultiLineString":
+		var lines [][][]float64
+		err := json.Unmarshal(object.Coordinates, &lines)
+		if err != nil {
+			return fmt.Errorf("invalid MultiLineString coordinates: %w", err)
+		}
+		for _, line := range lines {
+			err := n.addLine(line, index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// This function adds a single line to the network. GeoJSON positions have the format
+// [longitude, latitude] with an optional elevation which we ignore.
+func (n *roadNetwork) addLine(line [][]float64, index map[[2]float64]int) error {
+	previous := -1
+	for _, position := range line {
+		if len(position) < 2 {
+			return fmt.Errorf("invalid position %v", position)
+		}
+
+		longitude, latitude := position[0], position[1]
+		if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+			return fmt.Errorf("position %v out of range", position)
+		}
+
+		key := [2]float64{longitude, latitude}
+		current, found := index[key]
+		if !found {
+			current = len(n.nodes)
+			n.nodes = append(n.nodes, roadNode{latitude: latitude, longitude: longitude})
+			index[key] = current
+		}
+
+		if previous != -1 && previous != current && !n.connected(previous, current) {
+			n.nodes[previous].neighbours = append(n.nodes[previous].neighbours, current)
+			n.nodes[current].neighbours = append(n.nodes[current].neighbours, previous)
+		}
+		previous = current
+	}
+
+	return nil
+}
+
+// This function returns true if there's an edge between the two nodes.
+func (n *roadNetwork) connected(a, b int) bool {
+	for _, neighbour := range n.nodes[a].neighbours {
+		if neighbour == b {
+			return true
+		}
+	}
+	return false
+}
+
+// This function returns the approximate length in meters of the edge between two nodes. Like
+// [updateLocation], this is a flat-earth approximation which is fine for short road segments.
+func (n *roadNetwork) edgeLength(a, b int) float64 {
+	deltaX, deltaY := n.edgeOffset(a, b)
+	return math.Hypot(deltaX, deltaY)
+}
+
+// This function returns the East-West and North-South offsets in meters from node a to node b.
+func (n *roadNetwork) edgeOffset(a, b int) (float64, float64) {
+	from, to := n.nodes[a], n.nodes[b]
+	deltaX := (to.longitude - from.longitude) * 111319.5 * math.Cos(from.latitude*math.Pi/180.0)
+	deltaY := (to.latitude - from.latitude) / 0.000009
+	return deltaX, deltaY
+}
+
+// This type tracks a single vehicle's progress through a road network. The vehicle is travelling
+// along the edge from node [from] to node [to] and has covered [progress] meters of it.
+type roadRoute struct {
+	network  *roadNetwork
+	from     int
+	to       int
+	progress float64
+}
+
+// This function returns a new route starting at a randomly selected node in the network. The
+// network must have at least one edge.
+func (n *roadNetwork) newRoute() *roadRoute {
+	var candidates []int
+	for i, node := range n.nodes {
+		if len(node.neighbours) > 0 {
+			candidates = append(candidates, i)
+		}
+	}
+
+	from := candidates[rand.Intn(len(candidates))]
+	neighbours := n.nodes[from].neighbours
+	to := neighbours[rand.Intn(len(neighbours))]
+
+	return &roadRoute{network: n, from: from, to: to}
+}
+
+// This function moves the vehicle the specified distance in meters along the network. At each node
+// the vehicle picks a random connected edge to continue along, never doubling back unless it's
+// reached a dead end.
+func (r *roadRoute) advance(distance float64) {
+	for {
+		remaining := r.network.edgeLength(r.from, r.to) - r.progress
+		if distance < remaining {
+			r.progress += distance
+			return
+		}
+
+		distance -= remaining
+		r.from, r.to = r.to, r.nextNode()
+		r.progress = 0
+	}
+}
+
+// This function picks the next node for a vehicle arriving at [to] from [from].
+func (r *roadRoute) nextNode() int {
+	var options []int
+	for _, neighbour := range r.network.nodes[r.to].neighbours {
+		if neighbour != r.from {
+			options = append(options, neighbour)
+		}
+	}
+
+	if len(options) == 0 {
+		return r.from
+	}
+
+	return options[rand.Intn(len(options))]
+}
+
+// This function returns the vehicle's current latitude, longitude, and direction. The direction
+// is measured in radians anticlockwise from due east, as in [simulateVehicle].
+func (r *roadRoute) position() (float64, float64, float64) {
+	from, to := r.network.nodes[r.from], r.network.nodes[r.to]
+	fraction := r.progress / r.network.edgeLength(r.from, r.to)
+
+	latitude := from.latitude + (to.latitude-from.latitude)*fraction
+	longitude := from.longitude + (to.longitude-from.longitude)*fraction
+
+	deltaX, deltaY := r.network.edgeOffset(r.from, r.to)
+	direction := math.Atan2(deltaY, deltaX)
+
+	return latitude, longitude, direction
+}
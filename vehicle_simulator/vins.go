@@ -0,0 +1,104 @@
+package main
+
+import "bufio"
+import "errors"
+import "fmt"
+import "os"
+import "regexp"
+import "strings"
+
+// The length of a standard VIN.
+const vinLength = 17
+
+// The template for generated VINs, with a single integer placeholder for the vehicle's serial
+// number. The default is a random VIN I grabbed from the internet.
+var vinTemplate string
+
+// If not empty, VINs read from the --vin-list file. The vehicle with serial number i uses the i-th
+// VIN in the list; vehicles beyond the end of the list use the template.
+var vinList []string
+
+// A template's placeholder must be a decimal integer verb with an optional zero-padded width, e.g.
+// %d or %06d.
+var vinPlaceholder = regexp.MustCompile(`^%(0[0-9]+)?d`)
+
+// This function returns an error if the string can't be used as a VIN. Besides checking the
+// length, we reject characters which would break the packet format.
+func checkVIN(vin string) error {
+	if len(vin) != vinLength {
+		return fmt.Errorf("'%s' has %d characters, expected %d", vin, len(vin), vinLength)
+	}
+	if strings.ContainsAny(vin, " \t=*") {
+		return fmt.Errorf("'%s' contains an invalid character", vin)
+	}
+	return nil
+}
+
+// This function returns an error if the template doesn't contain exactly one integer placeholder
+// or if it doesn't produce a valid VIN for both the first and last of the specified number of
+// vehicles. A literal percent sign can be written as %%.
+func checkVINTemplate(template string, numVehicles int) error {
+	placeholders := 0
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			continue
+		}
+		if strings.HasPrefix(template[i:], "%%") {
+			i++
+			continue
+		}
+		if !vinPlaceholder.MatchString(template[i:]) {
+			return errors.New("placeholders must have the form %d or %0Nd, e.g. %06d")
+		}
+		placeholders++
+	}
+
+	if placeholders != 1 {
+		return fmt.Errorf("expected 1 placeholder, found %d", placeholders)
+	}
+
+	for _, serial := range []int{0, numVehicles - 1} {
+		if serial < 0 {
+			continue
+		}
+		err := checkVIN(fmt.Sprintf(template, serial))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// This function reads a list of VINs from a file, one per line. Blank lines and lines beginning
+// with '#' are ignored.
+func loadVINList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var vins []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		vin := strings.TrimSpace(scanner.Text())
+		if vin == "" || strings.HasPrefix(vin, "#") {
+			continue
+		}
+
+		if err := checkVIN(vin); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if seen[vin] {
+			return nil, fmt.Errorf("line %d: duplicate VIN '%s'", lineNumber, vin)
+		}
+		seen[vin] = true
+
+		vins = append(vins, vin)
+	}
+
+	return vins, scanner.Err()
+}